@@ -2,33 +2,67 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/veggiedefender/torrent-client/bitfield"
+	"github.com/veggiedefender/torrent-client/mse"
 	"github.com/veggiedefender/torrent-client/peers"
+	"github.com/veggiedefender/torrent-client/utp"
 
 	"github.com/veggiedefender/torrent-client/message"
 
 	"github.com/veggiedefender/torrent-client/handshake"
 )
 
-// A Client is a TCP connection with a peer
+// A Client is a TCP or uTP connection with a peer
 type Client struct {
-	Conn     net.Conn
+	Conn net.Conn
+	// limited is Conn, if the Client wrapped it to apply rate limits
+	limited  *limitedConn
 	Choked   bool
 	Bitfield bitfield.Bitfield
-	peer     peers.Peer
-	infoHash [20]byte
-	peerID   [20]byte
+	// AllowedFast holds the pieces the peer lets us request while choked
+	AllowedFast map[int]bool
+	peer        peers.Peer
+	infoHash    [20]byte
+	peerID      [20]byte
+	numPieces   int
+	// private is set if the torrent is private, so PEX is left out
+	private bool
+
+	// remoteID is the peer ID the peer sent in its handshake
+	remoteID [20]byte
+
+	// fast is set if both sides support the Fast Extension (BEP 6)
+	fast bool
+
+	// extended is set if the peer speaks the extension protocol
+	extended bool
+	// extensions maps the names of the extensions the peer supports to the
+	// IDs it wants them sent with
+	extensions map[string]uint8
+	// listenPort is the port the peer accepts connections on, if it told us
+	listenPort uint16
+	// inbound is set if the peer opened the connection
+	inbound bool
 }
 
-func completeHandshake(conn net.Conn, infohash, peerID [20]byte) (*handshake.Handshake, error) {
+// completeHandshake sends our handshake and reads the peer's. It advertises
+// the Fast Extension if fast is set.
+func completeHandshake(conn net.Conn, infohash, peerID [20]byte, fast bool) (*handshake.Handshake, error) {
 	conn.SetDeadline(time.Now().Add(3 * time.Second))
 	defer conn.SetDeadline(time.Time{}) // Disable the deadline
 
 	req := handshake.New(infohash, peerID)
+	req.SetExtension(handshake.ExtensionProtocol)
+	if fast {
+		req.SetExtension(handshake.ExtensionFast)
+	}
 	_, err := conn.Write(req.Serialize())
 	if err != nil {
 		return nil, err
@@ -44,93 +78,491 @@ func completeHandshake(conn net.Conn, infohash, peerID [20]byte) (*handshake.Han
 	return res, nil
 }
 
-func recvBitfield(conn net.Conn) (bitfield.Bitfield, error) {
-	conn.SetDeadline(time.Now().Add(5 * time.Second))
-	defer conn.SetDeadline(time.Time{}) // Disable the deadline
+// bitfieldTimeout is how long we wait after the handshake for a peer to say
+// which pieces it has. It is a variable so tests can shorten it.
+var bitfieldTimeout = 5 * time.Second
+
+// recvBitfield reads the peer's bitfield, handling any extension handshake
+// and keep-alives that arrive ahead of it. With the Fast Extension, HAVE ALL
+// and HAVE NONE can take the place of the bitfield. The bitfield is optional,
+// so a peer that sends something else first, or sends nothing at all, starts
+// out with no pieces.
+func (c *Client) recvBitfield() (bitfield.Bitfield, error) {
+	c.Conn.SetDeadline(time.Now().Add(bitfieldTimeout))
+	defer c.Conn.SetDeadline(time.Time{}) // Disable the deadline
+
+	empty := make(bitfield.Bitfield, (c.numPieces+7)/8)
+	r := &countingReader{r: c.Conn}
+	for {
+		before := r.n
+		msg, err := message.ReadMax(r, c.maxLength())
+		if err, ok := err.(net.Error); ok && err.Timeout() && r.n == before {
+			// The peer has nothing to tell us yet
+			return empty, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil { // keep-alive
+			continue
+		}
+
+		switch msg.ID {
+		case message.MsgExtended:
+			_, _, err = c.HandleExtended(msg)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		case message.MsgBitfield:
+			bf := bitfield.Bitfield(msg.Payload)
+			err = c.checkBitfield(bf)
+			if err != nil {
+				return nil, err
+			}
+			return bf, nil
+		case message.MsgHaveAll, message.MsgHaveNone:
+			if !c.fast {
+				return nil, fmt.Errorf("Received %s without the Fast Extension", msg)
+			}
+			if msg.ID == message.MsgHaveAll {
+				for i := 0; i < c.numPieces; i++ {
+					empty.SetPiece(i)
+				}
+			}
+			return empty, nil
+		}
+
+		// No bitfield is coming, so what the peer sent applies to an empty one
+		c.Bitfield = empty
+		err = c.handleEarly(msg)
+		if err != nil {
+			return nil, err
+		}
+		return empty, nil
+	}
+}
+
+// checkBitfield makes sure a bitfield has one bit per piece, and that the
+// spare bits at the end are clear. Any bitfield goes if we don't know the
+// number of pieces.
+func (c *Client) checkBitfield(bf bitfield.Bitfield) error {
+	if c.numPieces == 0 {
+		return nil
+	}
+	if len(bf) != (c.numPieces+7)/8 {
+		return fmt.Errorf("Expected bitfield of length %d, got length %d", (c.numPieces+7)/8, len(bf))
+	}
+	for i := c.numPieces; i < len(bf)*8; i++ {
+		if bf.HasPiece(i) {
+			return fmt.Errorf("Bitfield has spare bit %d set", i)
+		}
+	}
+	return nil
+}
+
+// handleEarly applies a message that a peer sent in place of a bitfield
+func (c *Client) handleEarly(msg *message.Message) error {
+	switch msg.ID {
+	case message.MsgChoke:
+		c.Choked = true
+	case message.MsgUnchoke:
+		c.Choked = false
+	case message.MsgHave:
+		index, err := message.ParseHave(msg)
+		if err != nil {
+			return err
+		}
+		if c.numPieces > 0 && index >= c.numPieces {
+			return fmt.Errorf("Peer has piece %d of only %d", index, c.numPieces)
+		}
+		c.Bitfield.SetPiece(index)
+	case message.MsgAllowedFast:
+		index, err := message.ParseAllowedFast(msg)
+		if err != nil {
+			return err
+		}
+		c.AllowedFast[index] = true
+	case message.MsgPiece:
+		return fmt.Errorf("Received %s we didn't ask for", msg)
+	}
+	return nil
+}
+
+// countingReader counts the bytes read through it, so we can tell whether a
+// read that timed out left a message half read
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += n
+	return n, err
+}
+
+// New connects with a peer, completes a handshake, and receives a handshake
+// returns an err if any of those fail
+func New(peer peers.Peer, peerID, infoHash [20]byte) (*Client, error) {
+	return NewContext(context.Background(), peer, peerID, infoHash)
+}
 
-	msg, err := message.Read(conn)
+// NewContext is like New, but gives up and returns the context's error as soon
+// as ctx is done
+func NewContext(ctx context.Context, peer peers.Peer, peerID, infoHash [20]byte) (*Client, error) {
+	return NewOptions(ctx, peer, peerID, infoHash, Options{})
+}
+
+// TransportPolicy decides which transports a Client connects to peers over
+type TransportPolicy int
+
+const (
+	// TCPOnly connects over TCP
+	TCPOnly TransportPolicy = iota
+	// PreferUTP tries uTP first, then TCP
+	PreferUTP
+	// PreferTCP tries TCP first, then uTP
+	PreferTCP
+	// UTPOnly connects over uTP
+	UTPOnly
+)
+
+// networks returns the networks to try, in order
+func (p TransportPolicy) networks() []string {
+	switch p {
+	case PreferUTP:
+		return []string{"utp", "tcp"}
+	case PreferTCP:
+		return []string{"tcp", "utp"}
+	case UTPOnly:
+		return []string{"utp"}
+	default:
+		return []string{"tcp"}
+	}
+}
+
+// A Dialer opens connections to peers. It is asked for network "tcp", or
+// "utp" if the transport policy allows it. *net.Dialer works as a Dialer for
+// TCP.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Options configures how a Client connects to a peer
+type Options struct {
+	// Dialer, if set, opens connections in place of the usual TCP and uTP
+	// dialers, for example to go through a proxy or use an in-memory network
+	Dialer Dialer
+	// Encryption decides whether the connection uses Message Stream
+	// Encryption. The zero value never encrypts.
+	Encryption mse.Policy
+	// Transport decides whether to connect over TCP, uTP or both. The zero
+	// value only uses TCP.
+	Transport TransportPolicy
+	// UTPSocket, if set, is the socket uTP connections are dialed from, so
+	// they come from the port we accept them on. Otherwise each connection
+	// gets a socket of its own.
+	UTPSocket *utp.Socket
+	// Limits caps the rates the connection receives and sends at. They can
+	// be changed later with SetLimits.
+	Limits Limits
+	// NumPieces is the number of pieces in the torrent, which the peer's
+	// bitfield is checked against. The Fast Extension is only used if it is
+	// set, since HAVE ALL can't be understood without it.
+	NumPieces int
+	// Private leaves PEX out of the extensions we advertise, as private
+	// torrents must not swap peers (BEP 27)
+	Private bool
+}
+
+// NewOptions is like NewContext, but connects as opts says
+func NewOptions(ctx context.Context, peer peers.Peer, peerID, infoHash [20]byte, opts Options) (*Client, error) {
+	var conn net.Conn
+	var err error
+	for _, network := range opts.Transport.networks() {
+		conn, err = connect(ctx, network, peer, infoHash, opts)
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
-	if msg == nil {
-		err := fmt.Errorf("Expected bitfield but got %s", msg)
+	limited := newLimitedConn(conn, opts.Limits)
+	conn = limited
+
+	stop := watch(ctx, conn)
+	defer close(stop)
+
+	res, err := completeHandshake(conn, infoHash, peerID, opts.NumPieces > 0)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		return nil, err
 	}
-	if msg.ID != message.MsgBitfield {
-		err := fmt.Errorf("Expected bitfield but got ID %d", msg.ID)
+
+	c := &Client{
+		Conn:        conn,
+		limited:     limited,
+		Choked:      true,
+		AllowedFast: make(map[int]bool),
+		peer:        peer,
+		infoHash:    infoHash,
+		peerID:      peerID,
+		numPieces:   opts.NumPieces,
+		private:     opts.Private,
+	}
+	err = c.setup(res)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		return nil, err
 	}
+	return c, nil
+}
 
-	return msg.Payload, nil
+// connect dials a peer over network and, unless opts.Encryption is
+// mse.Disabled, runs the encryption handshake on the connection. If the peer
+// doesn't take to encryption and opts.Encryption is mse.Prefer, it dials
+// again without.
+func connect(ctx context.Context, network string, peer peers.Peer, infoHash [20]byte, opts Options) (net.Conn, error) {
+	conn, err := encrypt(ctx, network, peer, infoHash, opts, opts.Encryption)
+	if err != nil && opts.Encryption == mse.Prefer && ctx.Err() == nil {
+		conn, err = encrypt(ctx, network, peer, infoHash, opts, mse.Disabled)
+	}
+	return conn, err
 }
 
-// New connects with a peer, completes a handshake, and receives a handshake
-// returns an err if any of those fail.
-func New(peer peers.Peer, peerID, infoHash [20]byte) (*Client, error) {
-	conn, err := net.DialTimeout("tcp", peer.String(), 3*time.Second)
+func encrypt(ctx context.Context, network string, peer peers.Peer, infoHash [20]byte, opts Options, policy mse.Policy) (net.Conn, error) {
+	conn, err := dial(ctx, network, peer, opts)
 	if err != nil {
 		return nil, err
 	}
+	if policy == mse.Disabled {
+		return conn, nil
+	}
 
-	_, err = completeHandshake(conn, infoHash, peerID)
+	stop := watch(ctx, conn)
+	defer close(stop)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetDeadline(time.Time{}) // Disable the deadline
+	enc, err := mse.Initiate(conn, infoHash, policy)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return enc, nil
+}
+
+// dialTimeout is how long we wait for a peer to answer a connection
+const dialTimeout = 3 * time.Second
+
+func dial(ctx context.Context, network string, peer peers.Peer, opts Options) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+	if opts.Dialer != nil {
+		return opts.Dialer.DialContext(ctx, network, peer.String())
+	}
+	if network == "tcp" {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", peer.String())
+	}
+	if opts.UTPSocket != nil {
+		return opts.UTPSocket.DialContext(ctx, peer.String())
+	}
+	return utp.DialContext(ctx, peer.String())
+}
+
+// watch closes conn when ctx is done, which aborts a handshake that is still
+// in progress. Closing the returned channel stops watching.
+func watch(ctx context.Context, conn net.Conn) chan struct{} {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+	return stop
+}
+
+// setup finishes a connection once handshakes have been exchanged. It sends
+// our extension handshake if the peer speaks the extension protocol, and
+// receives the peer's bitfield.
+func (c *Client) setup(remote *handshake.Handshake) error {
+	c.remoteID = remote.PeerID
+	// We only advertise the Fast Extension when we know the number of pieces
+	if remote.HasExtension(handshake.ExtensionFast) && c.numPieces > 0 {
+		// The Fast Extension makes saying what we have mandatory, and we
+		// don't serve anything
+		c.fast = true
+		err := c.send(&message.Message{ID: message.MsgHaveNone})
+		if err != nil {
+			return err
+		}
+	}
+	if remote.HasExtension(handshake.ExtensionProtocol) {
+		c.extended = true
+		err := c.sendExtensionHandshake()
+		if err != nil {
+			return err
+		}
+	}
+
+	bf, err := c.recvBitfield()
+	if err != nil {
+		return err
+	}
+	c.Bitfield = bf
+	return nil
+}
+
+// Accept answers a handshake that a peer sent on a connection it opened to
+// us, and receives its bitfield. The caller has already read the peer's
+// handshake, hs, to decide which torrent the connection belongs to. Of
+// opts, only Limits, NumPieces and Private apply.
+func Accept(conn net.Conn, hs *handshake.Handshake, peerID [20]byte, opts Options) (*Client, error) {
+	limited := newLimitedConn(conn, opts.Limits)
+	conn = limited
+	res := handshake.New(hs.InfoHash, peerID)
+	res.SetExtension(handshake.ExtensionProtocol)
+	if opts.NumPieces > 0 {
+		res.SetExtension(handshake.ExtensionFast)
+	}
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	_, err := conn.Write(res.Serialize())
+	conn.SetDeadline(time.Time{}) // Disable the deadline
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
 
-	bf, err := recvBitfield(conn)
+	c := &Client{
+		Conn:        conn,
+		limited:     limited,
+		Choked:      true,
+		AllowedFast: make(map[int]bool),
+		peer:        peerFromAddr(conn.RemoteAddr()),
+		infoHash:    hs.InfoHash,
+		peerID:      peerID,
+		numPieces:   opts.NumPieces,
+		private:     opts.Private,
+		inbound:     true,
+	}
+	err = c.setup(hs)
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
+	return c, nil
+}
+
+func peerFromAddr(addr net.Addr) peers.Peer {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return peers.Peer{IP: a.IP, Port: uint16(a.Port)}
+	case *net.UDPAddr:
+		return peers.Peer{IP: a.IP, Port: uint16(a.Port)}
+	}
+	return peers.Peer{}
+}
 
-	return &Client{
-		Conn:     conn,
-		Choked:   true,
-		Bitfield: bf,
-		peer:     peer,
-		infoHash: infoHash,
-		peerID:   peerID,
-	}, nil
+// Peer returns the address of the peer on the other end of the connection
+func (c *Client) Peer() peers.Peer {
+	return c.peer
 }
 
-// Read reads and consumes a message from the connection
+// RemotePeerID returns the peer ID the peer sent in its handshake. See
+// peerid.Parse to tell which client it runs.
+func (c *Client) RemotePeerID() [20]byte {
+	return c.remoteID
+}
+
+// Read reads and consumes a message from the connection. A message longer
+// than any the peer has reason to send fails with a *message.TooLongError,
+// and one whose payload is the wrong length for its ID fails too.
 func (c *Client) Read() (*message.Message, error) {
-	msg, err := message.Read(c.Conn)
-	return msg, err
+	msg, err := message.ReadMax(c.Conn, c.maxLength())
+	if err != nil {
+		return nil, err
+	}
+	err = msg.Validate()
+	if err != nil {
+		return nil, err
+	}
+	if c.limited != nil {
+		c.limited.readPayload(msg)
+	}
+	return msg, nil
+}
+
+// maxLength is the longest message we accept from the peer
+func (c *Client) maxLength() int {
+	if c.numPieces == 0 {
+		return message.DefaultMaxLength
+	}
+	return message.MaxLength(message.MaxBlockSize, c.numPieces)
+}
+
+// SupportsFast tells if both sides support the Fast Extension (BEP 6)
+func (c *Client) SupportsFast() bool {
+	return c.fast
 }
 
 // SendRequest sends a Request message to the peer
 func (c *Client) SendRequest(index, begin, length int) error {
 	req := message.FormatRequest(index, begin, length)
-	_, err := c.Conn.Write(req.Serialize())
-	return err
+	return c.send(req)
 }
 
 // SendInterested sends an Interested message to the peer
 func (c *Client) SendInterested() error {
-	msg := message.Message{ID: message.MsgInterested}
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	return c.send(&message.Message{ID: message.MsgInterested})
 }
 
 // SendNotInterested sends a NotInterested message to the peer
 func (c *Client) SendNotInterested() error {
-	msg := message.Message{ID: message.MsgNotInterested}
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	return c.send(&message.Message{ID: message.MsgNotInterested})
 }
 
 // SendUnchoke sends an Unchoke message to the peer
 func (c *Client) SendUnchoke() error {
-	msg := message.Message{ID: message.MsgUnchoke}
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	return c.send(&message.Message{ID: message.MsgUnchoke})
 }
 
 // SendHave sends a Have message to the peer
 func (c *Client) SendHave(index int) error {
 	msg := message.FormatHave(index)
+	return c.send(msg)
+}
+
+// SendRejectRequest tells the peer that we won't answer one of its requests.
+// The peer must support the Fast Extension.
+func (c *Client) SendRejectRequest(index, begin, length int) error {
+	msg := message.FormatRejectRequest(index, begin, length)
+	return c.send(msg)
+}
+
+// send writes a message to the peer
+func (c *Client) send(msg *message.Message) error {
+	if c.limited != nil {
+		err := c.limited.writePayload(msg)
+		if err != nil {
+			return err
+		}
+	}
 	_, err := c.Conn.Write(msg.Serialize())
+	if err == nil && c.limited != nil {
+		atomic.AddInt64(&c.limited.payloadWritten, payloadLength(msg))
+	}
 	return err
 }
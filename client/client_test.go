@@ -1,11 +1,17 @@
 package client
 
 import (
+	"context"
+	"fmt"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/veggiedefender/torrent-client/bitfield"
 	"github.com/veggiedefender/torrent-client/handshake"
+	"github.com/veggiedefender/torrent-client/mse"
+	"github.com/veggiedefender/torrent-client/peers"
+	"github.com/veggiedefender/torrent-client/utp"
 
 	"github.com/veggiedefender/torrent-client/message"
 
@@ -33,39 +39,120 @@ func createClientAndServer(t *testing.T) (clientConn, serverConn net.Conn) {
 }
 
 func TestRecvBitfield(t *testing.T) {
+	defer func(timeout time.Duration) { bitfieldTimeout = timeout }(bitfieldTimeout)
+	bitfieldTimeout = 100 * time.Millisecond
+
 	tests := map[string]struct {
 		msg    []byte
+		fast   bool
 		output bitfield.Bitfield
+		choked bool
 		fails  bool
 	}{
 		"successful bitfield": {
-			msg:    []byte{0x00, 0x00, 0x00, 0x06, 5, 1, 2, 3, 4, 5},
-			output: bitfield.Bitfield{1, 2, 3, 4, 5},
+			msg:    []byte{0x00, 0x00, 0x00, 0x03, 5, 0xf0, 0x80},
+			output: bitfield.Bitfield{0xf0, 0x80},
+			choked: true,
 			fails:  false,
 		},
-		"message is not a bitfield": {
+		"bitfield too short": {
+			msg:    []byte{0x00, 0x00, 0x00, 0x02, 5, 0xf0},
+			output: nil,
+			fails:  true,
+		},
+		"bitfield with spare bits set": {
+			msg:    []byte{0x00, 0x00, 0x00, 0x03, 5, 0xf0, 0x81},
+			output: nil,
+			fails:  true,
+		},
+		"extension handshake before bitfield": {
+			msg: []byte{
+				0x00, 0x00, 0x00, 0x14, 20, 0, 'd', '1', ':', 'm', 'd', '6', ':', 'u', 't', '_', 'p', 'e', 'x', 'i', '2', 'e', 'e', 'e',
+				0x00, 0x00, 0x00, 0x03, 5, 1, 0,
+			},
+			output: bitfield.Bitfield{1, 0},
+			choked: true,
+			fails:  false,
+		},
+		"keep-alive before bitfield": {
+			msg:    []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03, 5, 1, 0},
+			output: bitfield.Bitfield{1, 0},
+			choked: true,
+			fails:  false,
+		},
+		"have instead of bitfield": {
+			msg:    []byte{0x00, 0x00, 0x00, 0x05, 4, 0x00, 0x00, 0x00, 0x03},
+			output: bitfield.Bitfield{0x10, 0x00},
+			choked: true,
+			fails:  false,
+		},
+		"have out of range": {
+			msg:    []byte{0x00, 0x00, 0x00, 0x05, 4, 0x00, 0x00, 0x00, 0x09},
+			output: nil,
+			fails:  true,
+		},
+		"unchoke instead of bitfield": {
+			msg:    []byte{0x00, 0x00, 0x00, 0x01, 1},
+			output: bitfield.Bitfield{0x00, 0x00},
+			choked: false,
+			fails:  false,
+		},
+		"unknown message instead of bitfield": {
 			msg:    []byte{0x00, 0x00, 0x00, 0x06, 99, 1, 2, 3, 4, 5},
+			output: bitfield.Bitfield{0x00, 0x00},
+			choked: true,
+			fails:  false,
+		},
+		"piece we didn't ask for": {
+			msg:    []byte{0x00, 0x00, 0x00, 0x0a, 7, 0, 0, 0, 0, 0, 0, 0, 0, 1},
 			output: nil,
 			fails:  true,
 		},
-		"message is keep-alive": {
-			msg:    []byte{0x00, 0x00, 0x00, 0x00},
+		"nothing sent": {
+			msg:    []byte{},
+			output: bitfield.Bitfield{0x00, 0x00},
+			choked: true,
+			fails:  false,
+		},
+		"half a message sent": {
+			msg:    []byte{0x00, 0x00},
+			output: nil,
+			fails:  true,
+		},
+		"have all": {
+			msg:    []byte{0x00, 0x00, 0x00, 0x01, 14},
+			fast:   true,
+			output: bitfield.Bitfield{0xff, 0x80},
+			choked: true,
+			fails:  false,
+		},
+		"have none": {
+			msg:    []byte{0x00, 0x00, 0x00, 0x01, 15},
+			fast:   true,
+			output: bitfield.Bitfield{0x00, 0x00},
+			choked: true,
+			fails:  false,
+		},
+		"have all without fast extension": {
+			msg:    []byte{0x00, 0x00, 0x00, 0x01, 14},
 			output: nil,
 			fails:  true,
 		},
 	}
 
-	for _, test := range tests {
+	for name, test := range tests {
 		clientConn, serverConn := createClientAndServer(t)
 		serverConn.Write(test.msg)
 
-		bf, err := recvBitfield(clientConn)
+		c := Client{Conn: clientConn, Choked: true, fast: test.fast, numPieces: 9}
+		bf, err := c.recvBitfield()
 
 		if test.fails {
-			assert.NotNil(t, err)
+			assert.NotNil(t, err, name)
 		} else {
-			assert.Nil(t, err)
-			assert.Equal(t, bf, test.output)
+			assert.Nil(t, err, name)
+			assert.Equal(t, test.output, bf, name)
+			assert.Equal(t, test.choked, c.Choked, name)
 		}
 	}
 }
@@ -102,7 +189,7 @@ func TestCompleteHandshake(t *testing.T) {
 		clientConn, serverConn := createClientAndServer(t)
 		serverConn.Write(test.serverHandshake)
 
-		h, err := completeHandshake(clientConn, test.clientInfohash, test.clientPeerID)
+		h, err := completeHandshake(clientConn, test.clientInfohash, test.clientPeerID, true)
 
 		if test.fails {
 			assert.NotNil(t, err)
@@ -211,3 +298,255 @@ func TestSendHave(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, expected, buf)
 }
+
+func TestAccept(t *testing.T) {
+	clientConn, serverConn := createClientAndServer(t)
+	infoHash := [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}
+	peerID := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+	go func() {
+		handshake.Read(clientConn)
+		clientConn.Write([]byte{0x00, 0x00, 0x00, 0x02, 5, 0xf0})
+	}()
+
+	remoteID := [20]byte{'-', 'q', 'B', '4', '2', '5', '0', '-'}
+	c, err := Accept(serverConn, handshake.New(infoHash, remoteID), peerID, Options{NumPieces: 4})
+	require.Nil(t, err)
+	assert.Equal(t, bitfield.Bitfield{0xf0}, c.Bitfield)
+	assert.Equal(t, clientConn.LocalAddr().String(), c.Peer().String())
+	assert.Equal(t, remoteID, c.RemotePeerID())
+}
+
+func TestAcceptFast(t *testing.T) {
+	clientConn, serverConn := createClientAndServer(t)
+	infoHash := [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}
+	hs := handshake.New(infoHash, [20]byte{})
+	hs.SetExtension(handshake.ExtensionFast)
+	received := make(chan *message.Message, 1)
+	go func() {
+		res, _ := handshake.Read(clientConn)
+		assert.True(t, res.HasExtension(handshake.ExtensionFast))
+		msg, _ := message.Read(clientConn)
+		received <- msg
+		clientConn.Write((&message.Message{ID: message.MsgHaveAll}).Serialize())
+	}()
+
+	c, err := Accept(serverConn, hs, [20]byte{}, Options{NumPieces: 3})
+	require.Nil(t, err)
+	assert.Equal(t, &message.Message{ID: message.MsgHaveNone, Payload: []byte{}}, <-received)
+	assert.True(t, c.SupportsFast())
+	assert.Equal(t, bitfield.Bitfield{0xe0}, c.Bitfield)
+}
+
+func TestAcceptWithoutPieceCount(t *testing.T) {
+	clientConn, serverConn := createClientAndServer(t)
+	infoHash := [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}
+	hs := handshake.New(infoHash, [20]byte{})
+	hs.SetExtension(handshake.ExtensionFast)
+	sent := make(chan *handshake.Handshake, 1)
+	go func() {
+		res, _ := handshake.Read(clientConn)
+		sent <- res
+		clientConn.Write(message.FormatBitfield([]byte{0xff}).Serialize())
+	}()
+
+	// We can't keep the Fast Extension's promise to say what we have
+	// without the piece count, so we don't make it
+	c, err := Accept(serverConn, hs, [20]byte{}, Options{})
+	require.Nil(t, err)
+	assert.False(t, (<-sent).HasExtension(handshake.ExtensionFast))
+	assert.False(t, c.SupportsFast())
+	assert.Equal(t, bitfield.Bitfield{0xff}, c.Bitfield)
+}
+
+// startPeer accepts connections, encrypted as policy allows, and answers each
+// handshake with one of its own and a bitfield
+func startPeer(t *testing.T, infoHash [20]byte, policy mse.Policy) (net.Listener, peers.Peer) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	return servePeer(ln, infoHash, policy)
+}
+
+func servePeer(ln net.Listener, infoHash [20]byte, policy mse.Policy) (net.Listener, peers.Peer) {
+	go func() {
+		for {
+			raw, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn, err := mse.Accept(raw, [][20]byte{infoHash}, policy)
+				if err != nil {
+					raw.Close()
+					return
+				}
+				handshake.Read(conn)
+				conn.Write(handshake.New(infoHash, [20]byte{}).Serialize())
+				conn.Write([]byte{0x00, 0x00, 0x00, 0x02, 5, 0xf0})
+			}()
+		}
+	}()
+	return ln, peerFromAddr(ln.Addr())
+}
+
+func TestNewWithoutPieceCount(t *testing.T) {
+	infoHash := [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	sent := make(chan *handshake.Handshake, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		hs, err := handshake.Read(conn)
+		if err != nil {
+			return
+		}
+		sent <- hs
+		res := handshake.New(infoHash, [20]byte{})
+		res.SetExtension(handshake.ExtensionFast)
+		conn.Write(res.Serialize())
+		conn.Write(message.FormatBitfield([]byte{0xff, 0xff}).Serialize())
+		message.Read(conn)
+	}()
+
+	c, err := New(peerFromAddr(ln.Addr()), [20]byte{}, infoHash)
+	require.Nil(t, err)
+	defer c.Conn.Close()
+	// Without the piece count, any bitfield goes, and HAVE ALL couldn't be
+	// understood, so the Fast Extension is left out
+	assert.Equal(t, bitfield.Bitfield{0xff, 0xff}, c.Bitfield)
+	assert.False(t, c.SupportsFast())
+	assert.False(t, (<-sent).HasExtension(handshake.ExtensionFast))
+}
+
+func TestNewOptionsEncryption(t *testing.T) {
+	infoHash := [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}
+	tests := map[string]struct {
+		local     mse.Policy
+		remote    mse.Policy
+		encrypted bool
+		fails     bool
+	}{
+		"both disabled": {
+			local:  mse.Disabled,
+			remote: mse.Disabled,
+		},
+		"prefer falls back to plaintext": {
+			local:  mse.Prefer,
+			remote: mse.Disabled,
+		},
+		"prefer encrypts": {
+			local:     mse.Prefer,
+			remote:    mse.Prefer,
+			encrypted: true,
+		},
+		"require encrypts": {
+			local:     mse.Require,
+			remote:    mse.Require,
+			encrypted: true,
+		},
+		"require refuses plaintext": {
+			local:  mse.Require,
+			remote: mse.Disabled,
+			fails:  true,
+		},
+		"peer requires encryption": {
+			local:  mse.Disabled,
+			remote: mse.Require,
+			fails:  true,
+		},
+	}
+
+	for name, test := range tests {
+		ln, peer := startPeer(t, infoHash, test.remote)
+		c, err := NewOptions(context.Background(), peer, [20]byte{}, infoHash, Options{Encryption: test.local, NumPieces: 4})
+		ln.Close()
+		if test.fails {
+			assert.NotNil(t, err, name)
+			continue
+		}
+		require.Nil(t, err, name)
+		assert.Equal(t, bitfield.Bitfield{0xf0}, c.Bitfield, name)
+		_, encrypted := c.limited.Conn.(*mse.Conn)
+		assert.Equal(t, test.encrypted, encrypted, name)
+		c.Conn.Close()
+	}
+}
+
+func TestNewOptionsTransport(t *testing.T) {
+	infoHash := [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}
+	socket, err := utp.Listen("127.0.0.1:0")
+	require.Nil(t, err)
+	_, peer := servePeer(socket, infoHash, mse.Prefer)
+	defer socket.Close()
+
+	tests := map[string]struct {
+		transport TransportPolicy
+		fails     bool
+	}{
+		"tcp only": {
+			transport: TCPOnly,
+			fails:     true,
+		},
+		"utp only": {
+			transport: UTPOnly,
+		},
+		"prefer tcp falls back to utp": {
+			transport: PreferTCP,
+		},
+		"prefer utp": {
+			transport: PreferUTP,
+		},
+	}
+
+	for name, test := range tests {
+		c, err := NewOptions(context.Background(), peer, [20]byte{}, infoHash, Options{
+			NumPieces:  4,
+			Transport:  test.transport,
+			Encryption: mse.Prefer,
+		})
+		if test.fails {
+			assert.NotNil(t, err, name)
+			continue
+		}
+		require.Nil(t, err, name)
+		assert.Equal(t, bitfield.Bitfield{0xf0}, c.Bitfield, name)
+		assert.Equal(t, "udp", c.Conn.RemoteAddr().Network(), name)
+		c.Conn.Close()
+	}
+}
+
+// recordingDialer dials TCP whatever network it is asked for, and remembers
+// the networks. UTP dials fail.
+type recordingDialer struct {
+	networks []string
+}
+
+func (d *recordingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.networks = append(d.networks, network)
+	if network == "utp" {
+		return nil, fmt.Errorf("No uTP here")
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+func TestNewOptionsDialer(t *testing.T) {
+	infoHash := [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}
+	ln, peer := startPeer(t, infoHash, mse.Disabled)
+	defer ln.Close()
+
+	dialer := &recordingDialer{}
+	c, err := NewOptions(context.Background(), peer, [20]byte{}, infoHash, Options{
+		NumPieces: 4,
+		Dialer:    dialer,
+		Transport: PreferUTP,
+	})
+	require.Nil(t, err)
+	defer c.Conn.Close()
+	assert.Equal(t, []string{"utp", "tcp"}, dialer.networks)
+	assert.Equal(t, bitfield.Bitfield{0xf0}, c.Bitfield)
+}
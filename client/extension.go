@@ -0,0 +1,133 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/veggiedefender/torrent-client/message"
+	"github.com/veggiedefender/torrent-client/peers"
+)
+
+// clientVersion is how we name ourselves in the extension handshake
+const clientVersion = "torrent-client"
+
+// localExtensions maps the extensions we support to the IDs peers should
+// send them to us with. ID 0 is reserved for the extension handshake.
+var localExtensions = map[string]uint8{
+	"ut_pex": 1,
+}
+
+// advertisedExtensions returns the extensions we tell the peer we support.
+// Private torrents don't exchange peers, so they leave out PEX.
+func (c *Client) advertisedExtensions() map[string]uint8 {
+	if !c.private {
+		return localExtensions
+	}
+	m := make(map[string]uint8, len(localExtensions))
+	for name, id := range localExtensions {
+		if name != "ut_pex" {
+			m[name] = id
+		}
+	}
+	return m
+}
+
+func (c *Client) sendExtensionHandshake() error {
+	local := c.advertisedExtensions()
+	m := make(map[string]interface{}, len(local))
+	for name, id := range local {
+		m[name] = int64(id)
+	}
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, map[string]interface{}{
+		"m": m,
+		"v": clientVersion,
+	})
+	if err != nil {
+		return err
+	}
+	return c.send(message.FormatExtended(0, buf.Bytes()))
+}
+
+func (c *Client) handleExtensionHandshake(payload []byte) error {
+	v, err := bencode.Decode(bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("Extension handshake is not a dictionary")
+	}
+
+	// Later handshakes only update what they mention, and ID 0 disables an
+	// extension
+	if c.extensions == nil {
+		c.extensions = make(map[string]uint8)
+	}
+	m, _ := dict["m"].(map[string]interface{})
+	for name, v := range m {
+		id, ok := v.(int64)
+		if !ok || id < 0 || id > 255 {
+			continue
+		}
+		if id == 0 {
+			delete(c.extensions, name)
+		} else {
+			c.extensions[name] = uint8(id)
+		}
+	}
+	if port, ok := dict["p"].(int64); ok && port > 0 && port <= 65535 {
+		c.listenPort = uint16(port)
+	}
+	return nil
+}
+
+// HandleExtended handles an EXTENDED message from the peer. An extension
+// handshake updates which extensions the peer supports and returns an empty
+// name. Any other message returns the name of the extension it belongs to,
+// and its payload.
+func (c *Client) HandleExtended(msg *message.Message) (string, []byte, error) {
+	extID, payload, err := message.ParseExtended(msg)
+	if err != nil {
+		return "", nil, err
+	}
+	if extID == 0 {
+		return "", nil, c.handleExtensionHandshake(payload)
+	}
+	for name, id := range localExtensions {
+		if id == extID {
+			return name, payload, nil
+		}
+	}
+	return "", nil, fmt.Errorf("Unknown extension message ID %d", extID)
+}
+
+// SupportsExtension tells if the peer told us it supports an extension
+func (c *Client) SupportsExtension(name string) bool {
+	_, ok := c.extensions[name]
+	return ok
+}
+
+// SendExtended sends a message of an extension the peer supports
+func (c *Client) SendExtended(name string, payload []byte) error {
+	id, ok := c.extensions[name]
+	if !ok {
+		return fmt.Errorf("Peer does not support extension %s", name)
+	}
+	return c.send(message.FormatExtended(id, payload))
+}
+
+// ListenAddr returns the address the peer accepts connections on. For a
+// connection we opened that is the address we dialed. For one the peer opened
+// to us it is only known if the peer told us its listen port, otherwise ok is
+// false.
+func (c *Client) ListenAddr() (addr peers.Peer, ok bool) {
+	if !c.inbound {
+		return c.peer, true
+	}
+	if c.listenPort == 0 {
+		return peers.Peer{}, false
+	}
+	return peers.Peer{IP: c.peer.IP, Port: c.listenPort}, true
+}
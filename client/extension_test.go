@@ -0,0 +1,57 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/torrent-client/handshake"
+	"github.com/veggiedefender/torrent-client/message"
+	"github.com/veggiedefender/torrent-client/peers"
+)
+
+func TestHandleExtended(t *testing.T) {
+	c := &Client{peer: peers.Peer{IP: []byte{127, 0, 0, 1}, Port: 50000}, inbound: true}
+	_, ok := c.ListenAddr()
+	assert.False(t, ok)
+
+	name, _, err := c.HandleExtended(message.FormatExtended(0, []byte("d1:md6:ut_pexi3ee1:pi6881ee")))
+	require.Nil(t, err)
+	assert.Equal(t, "", name)
+	assert.True(t, c.SupportsExtension("ut_pex"))
+	addr, ok := c.ListenAddr()
+	assert.True(t, ok)
+	assert.Equal(t, "127.0.0.1:6881", addr.String())
+
+	name, payload, err := c.HandleExtended(message.FormatExtended(1, []byte("de")))
+	require.Nil(t, err)
+	assert.Equal(t, "ut_pex", name)
+	assert.Equal(t, []byte("de"), payload)
+
+	_, _, err = c.HandleExtended(message.FormatExtended(9, nil))
+	assert.NotNil(t, err)
+
+	// A later handshake can turn an extension off
+	_, _, err = c.HandleExtended(message.FormatExtended(0, []byte("d1:md6:ut_pexi0eee")))
+	require.Nil(t, err)
+	assert.False(t, c.SupportsExtension("ut_pex"))
+}
+
+func TestPrivateLeavesOutPEX(t *testing.T) {
+	clientConn, serverConn := createClientAndServer(t)
+	hs := handshake.New([20]byte{1}, [20]byte{})
+	hs.SetExtension(handshake.ExtensionProtocol)
+	received := make(chan *message.Message, 1)
+	go func() {
+		handshake.Read(clientConn)
+		msg, _ := message.Read(clientConn)
+		received <- msg
+		clientConn.Write([]byte{0x00, 0x00, 0x00, 0x02, 5, 0x80})
+	}()
+
+	_, err := Accept(serverConn, hs, [20]byte{}, Options{NumPieces: 1, Private: true})
+	require.Nil(t, err)
+	_, payload, err := message.ParseExtended(<-received)
+	require.Nil(t, err)
+	assert.Equal(t, "d1:mde1:v14:torrent-cliente", string(payload))
+}
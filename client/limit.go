@@ -0,0 +1,177 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/veggiedefender/torrent-client/message"
+	"github.com/veggiedefender/torrent-client/ratelimit"
+)
+
+// Limits caps the rates a Client receives and sends at, for example with
+// one limiter shared by every connection, one per torrent and one for the
+// connection alone. Every byte waits on each limiter in turn, so the tightest
+// one wins. Nil limiters allow any rate.
+type Limits struct {
+	Download []*ratelimit.Limiter
+	Upload   []*ratelimit.Limiter
+	// PayloadOnly counts only the block data in PIECE messages against the
+	// limits, so they cap the rate of the download itself. Otherwise protocol
+	// overhead counts as well, since it takes up the link all the same.
+	PayloadOnly bool
+}
+
+// Stats counts the bytes a Client has transferred. Payload is the block data
+// in PIECE messages, and overhead is everything else, from handshakes to
+// message headers.
+type Stats struct {
+	PayloadDownloaded  int64
+	OverheadDownloaded int64
+	PayloadUploaded    int64
+	OverheadUploaded   int64
+}
+
+// Add returns the sum of two Stats
+func (s Stats) Add(other Stats) Stats {
+	return Stats{
+		PayloadDownloaded:  s.PayloadDownloaded + other.PayloadDownloaded,
+		OverheadDownloaded: s.OverheadDownloaded + other.OverheadDownloaded,
+		PayloadUploaded:    s.PayloadUploaded + other.PayloadUploaded,
+		OverheadUploaded:   s.OverheadUploaded + other.OverheadUploaded,
+	}
+}
+
+// limitedConn waits on a Client's limits around every read and write, and
+// counts the bytes that go through it
+type limitedConn struct {
+	// The counters come first so they are aligned for atomic access
+	read           int64
+	written        int64
+	payloadRead    int64
+	payloadWritten int64
+
+	net.Conn
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	limits Limits
+}
+
+func newLimitedConn(conn net.Conn, limits Limits) *limitedConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &limitedConn{Conn: conn, ctx: ctx, cancel: cancel, limits: limits}
+}
+
+func (c *limitedConn) getLimits() Limits {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.limits
+}
+
+func (c *limitedConn) setLimits(limits Limits) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.limits = limits
+}
+
+// Read holds on to the data it reads until the limits let it through, which
+// keeps the peer from sending more once the receive buffers fill up
+func (c *limitedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		atomic.AddInt64(&c.read, int64(n))
+		if limits := c.getLimits(); !limits.PayloadOnly {
+			// The wait only fails once the connection is closed, which the
+			// next read reports
+			waitAll(c.ctx, limits.Download, n)
+		}
+	}
+	return n, err
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	limits := c.getLimits()
+	if !limits.PayloadOnly {
+		err := waitAll(c.ctx, limits.Upload, len(p))
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+// readPayload counts the block data of a message read from the connection,
+// and waits on the limits for it if only payload counts against them
+func (c *limitedConn) readPayload(msg *message.Message) {
+	n := payloadLength(msg)
+	atomic.AddInt64(&c.payloadRead, n)
+	if limits := c.getLimits(); limits.PayloadOnly && n > 0 {
+		// As in Read, a failed wait shows up on the next read
+		waitAll(c.ctx, limits.Download, int(n))
+	}
+}
+
+// writePayload waits on the limits for the block data of a message about to
+// be written, if only payload counts against them
+func (c *limitedConn) writePayload(msg *message.Message) error {
+	n := payloadLength(msg)
+	if limits := c.getLimits(); limits.PayloadOnly && n > 0 {
+		return waitAll(c.ctx, limits.Upload, int(n))
+	}
+	return nil
+}
+
+// waitAll waits on each limiter in turn for n bytes
+func waitAll(ctx context.Context, limiters []*ratelimit.Limiter, n int) error {
+	for _, l := range limiters {
+		err := l.WaitN(ctx, n)
+		if err != nil {
+			return errClosed
+		}
+	}
+	return nil
+}
+
+// Close also cuts short any wait on the limits
+func (c *limitedConn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
+
+// SetLimits changes the rate limits of the connection. It can be called at
+// any time, including while a read or write is waiting on the old limits.
+func (c *Client) SetLimits(limits Limits) {
+	if c.limited != nil {
+		c.limited.setLimits(limits)
+	}
+}
+
+// Stats returns how many bytes have been transferred with the peer
+func (c *Client) Stats() Stats {
+	if c.limited == nil {
+		return Stats{}
+	}
+	s := Stats{
+		PayloadDownloaded: atomic.LoadInt64(&c.limited.payloadRead),
+		PayloadUploaded:   atomic.LoadInt64(&c.limited.payloadWritten),
+	}
+	s.OverheadDownloaded = atomic.LoadInt64(&c.limited.read) - s.PayloadDownloaded
+	s.OverheadUploaded = atomic.LoadInt64(&c.limited.written) - s.PayloadUploaded
+	return s
+}
+
+// payloadLength returns how much block data msg carries
+func payloadLength(msg *message.Message) int64 {
+	if msg == nil || msg.ID != message.MsgPiece || len(msg.Payload) < 8 {
+		return 0
+	}
+	return int64(len(msg.Payload) - 8)
+}
+
+var errClosed = fmt.Errorf("Connection closed")
@@ -0,0 +1,125 @@
+package client
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/torrent-client/message"
+	"github.com/veggiedefender/torrent-client/ratelimit"
+)
+
+func newLimitedClient(limits Limits) (*Client, io.ReadWriteCloser) {
+	clientConn, serverConn := net.Pipe()
+	limited := newLimitedConn(clientConn, limits)
+	return &Client{Conn: limited, limited: limited, numPieces: 1}, serverConn
+}
+
+func TestLimitsDownload(t *testing.T) {
+	// The burst covers the first block, and the second takes half a second
+	limiter := ratelimit.NewLimiter(32 * 1024)
+	c, server := newLimitedClient(Limits{Download: []*ratelimit.Limiter{nil, limiter}})
+	defer c.Conn.Close()
+	defer server.Close()
+
+	block := make([]byte, 16*1024)
+	go func() {
+		for i := 0; i < 3; i++ {
+			server.Write(message.FormatPiece(0, i*len(block), block).Serialize())
+		}
+	}()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		msg, err := c.Read()
+		require.Nil(t, err)
+		assert.Equal(t, message.MsgPiece, msg.ID)
+	}
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 400*time.Millisecond, "took %s", elapsed)
+	assert.True(t, elapsed < 2*time.Second, "took %s", elapsed)
+
+	stats := c.Stats()
+	assert.Equal(t, int64(3*len(block)), stats.PayloadDownloaded)
+	// Each message has a length prefix, an ID, an index and an offset
+	assert.Equal(t, int64(3*13), stats.OverheadDownloaded)
+}
+
+func TestLimitsUpload(t *testing.T) {
+	c, server := newLimitedClient(Limits{})
+	defer c.Conn.Close()
+	defer server.Close()
+	go io.Copy(ioutil.Discard, server)
+
+	// Unlimited at first, then slowed down without reconnecting
+	require.Nil(t, c.SendInterested())
+	limiter := ratelimit.NewLimiter(10)
+	c.SetLimits(Limits{Upload: []*ratelimit.Limiter{limiter}})
+	require.Nil(t, c.SendHave(1)) // 9 bytes out of the burst
+	start := time.Now()
+	require.Nil(t, c.SendHave(2))
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 500*time.Millisecond, "took %s", elapsed)
+
+	stats := c.Stats()
+	assert.Equal(t, int64(0), stats.PayloadUploaded)
+	assert.Equal(t, int64(5+9+9), stats.OverheadUploaded)
+}
+
+func TestLimitsPayloadOnly(t *testing.T) {
+	up := ratelimit.NewLimiter(10)
+	c, server := newLimitedClient(Limits{Upload: []*ratelimit.Limiter{up}, PayloadOnly: true})
+	defer c.Conn.Close()
+	defer server.Close()
+
+	// Messages without payload go out at once, however tight the limit
+	go io.Copy(ioutil.Discard, server)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		require.Nil(t, c.SendHave(i))
+	}
+	assert.True(t, time.Since(start) < 200*time.Millisecond, "took %s", time.Since(start))
+
+	// Blocks still wait on the limit
+	down := ratelimit.NewLimiter(32 * 1024)
+	block := make([]byte, 16*1024)
+	client, server2 := newLimitedClient(Limits{Download: []*ratelimit.Limiter{down}, PayloadOnly: true})
+	defer client.Conn.Close()
+	defer server2.Close()
+	go func() {
+		for i := 0; i < 3; i++ {
+			server2.Write(message.FormatPiece(0, i*len(block), block).Serialize())
+		}
+	}()
+	start = time.Now()
+	for i := 0; i < 3; i++ {
+		_, err := client.Read()
+		require.Nil(t, err)
+	}
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 400*time.Millisecond, "took %s", elapsed)
+	assert.Equal(t, int64(3*len(block)), client.Stats().PayloadDownloaded)
+}
+
+func TestLimitsClose(t *testing.T) {
+	limiter := ratelimit.NewLimiter(1)
+	c, server := newLimitedClient(Limits{Upload: []*ratelimit.Limiter{limiter}})
+	defer server.Close()
+
+	done := make(chan error)
+	go func() {
+		done <- c.SendRequest(0, 0, message.MaxBlockSize)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	c.Conn.Close()
+	select {
+	case err := <-done:
+		assert.NotNil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Close did not interrupt the wait")
+	}
+}
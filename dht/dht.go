@@ -0,0 +1,722 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/veggiedefender/torrent-client/logger"
+	"github.com/veggiedefender/torrent-client/peers"
+)
+
+// DefaultBootstrapNodes are well-known routers used to join the DHT
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"router.utorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+}
+
+// alpha is how many queries a lookup keeps in flight at once
+const alpha = 3
+
+// tokenRotation is how often the secret used to make announce tokens
+// changes. Tokens from the previous secret are still accepted.
+const tokenRotation = 5 * time.Minute
+
+// peerTTL is how long a peer announced to us is handed out to others
+const peerTTL = 30 * time.Minute
+
+// maxValues caps the peers returned for one get_peers query, so the
+// response fits comfortably in a UDP packet
+const maxValues = 50
+
+// refreshCheckInterval is how often the routing table is checked for buckets
+// to refresh. It is a variable so tests can shorten it.
+var refreshCheckInterval = time.Minute
+
+// Config configures a Server. The zero value joins the public DHT on port
+// 6881.
+type Config struct {
+	// ID is our node ID. A random one is used if it is zero and none was
+	// saved in StatePath.
+	ID [20]byte
+	// Conn is the socket to use. If it is nil, the server listens on Addr.
+	Conn net.PacketConn
+	// Addr is the UDP address to listen on if Conn is nil. It defaults to
+	// ":6881".
+	Addr string
+	// BootstrapNodes are contacted to join the DHT when the routing table is
+	// empty. It defaults to DefaultBootstrapNodes.
+	BootstrapNodes []string
+	// StatePath, if set, is where the routing table is saved on Close and
+	// loaded from on New
+	StatePath string
+	// QueryTimeout is how long to wait for a node to answer. It defaults to
+	// two seconds.
+	QueryTimeout time.Duration
+	// Logger receives the server's log messages
+	Logger logger.Logger
+}
+
+type storedPeer struct {
+	peer    peers.Peer
+	expires time.Time
+}
+
+// A Server is a node in the mainline DHT (BEP 5). It answers other nodes'
+// queries and looks up and announces peers for torrents.
+type Server struct {
+	cfg   Config
+	id    [20]byte
+	conn  net.PacketConn
+	table *table
+	log   logger.Logger
+
+	mu      sync.Mutex
+	pending map[string]chan *message
+	nextT   uint16
+	secret  [2][]byte
+	rotated time.Time
+	store   map[[20]byte]map[string]storedPeer
+
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+// New starts a DHT node. It doesn't contact anybody until the first lookup,
+// or until Bootstrap is called.
+func New(cfg Config) (*Server, error) {
+	s := &Server{
+		cfg:     cfg,
+		id:      cfg.ID,
+		log:     cfg.Logger,
+		pending: make(map[string]chan *message),
+		store:   make(map[[20]byte]map[string]storedPeer),
+		closed:  make(chan struct{}),
+	}
+	if s.log == nil {
+		s.log = logger.Discard
+	}
+	if s.cfg.BootstrapNodes == nil {
+		s.cfg.BootstrapNodes = DefaultBootstrapNodes
+	}
+	if s.cfg.QueryTimeout == 0 {
+		s.cfg.QueryTimeout = 2 * time.Second
+	}
+
+	var saved []Node
+	if cfg.StatePath != "" {
+		id, nodes, err := loadState(cfg.StatePath)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if s.id == [20]byte{} {
+			s.id = id
+		}
+		saved = nodes
+	}
+	if s.id == [20]byte{} {
+		_, err := rand.Read(s.id[:])
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.table = newTable(s.id)
+	for _, n := range saved {
+		s.table.add(n)
+	}
+	if err := s.rotateSecret(); err != nil {
+		return nil, err
+	}
+
+	s.conn = cfg.Conn
+	if s.conn == nil {
+		addr := cfg.Addr
+		if addr == "" {
+			addr = ":6881"
+		}
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		s.conn = conn
+	}
+
+	s.wg.Add(2)
+	go s.readLoop()
+	go s.refreshLoop()
+	return s, nil
+}
+
+// ID returns our node ID
+func (s *Server) ID() [20]byte {
+	return s.id
+}
+
+// Addr returns the address the server is listening on
+func (s *Server) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Nodes returns every node in the routing table
+func (s *Server) Nodes() []Node {
+	return s.table.nodes()
+}
+
+// AddNode adds a node to the routing table without contacting it
+func (s *Server) AddNode(n Node) {
+	s.table.add(n)
+}
+
+// Close stops the server, saving the routing table if StatePath is set
+func (s *Server) Close() error {
+	select {
+	case <-s.closed:
+		return nil
+	default:
+	}
+	close(s.closed)
+	err := s.conn.Close()
+	s.wg.Wait()
+	if s.cfg.StatePath != "" {
+		if saveErr := s.saveState(s.cfg.StatePath); saveErr != nil {
+			return saveErr
+		}
+	}
+	return err
+}
+
+// refreshLoop refreshes buckets that have gone without changes for a while,
+// by looking up a random ID in each. Nothing is refreshed until the table has
+// nodes in it, so an unused server stays quiet.
+func (s *Server) refreshLoop() {
+	defer s.wg.Done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.closed:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+
+	ticker := time.NewTicker(refreshCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.closed:
+			return
+		}
+		for _, i := range s.table.staleBuckets(time.Now()) {
+			target, err := s.table.randomIDInBucket(i)
+			if err != nil {
+				s.log.Errorf("Could not refresh bucket %d: %s", i, err)
+				continue
+			}
+			s.log.Debugf("Refreshing bucket %d", i)
+			s.lookup(ctx, target, false)
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) readLoop() {
+	defer s.wg.Done()
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.closed:
+			default:
+				s.log.Errorf("DHT stopped reading: %s", err)
+			}
+			return
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		msg, err := decodeMessage(buf[:n])
+		if err != nil {
+			s.log.Debugf("Dropping malformed DHT message from %s: %s", addr, err)
+			continue
+		}
+
+		switch msg.Y {
+		case "q":
+			s.handleQuery(udpAddr, msg)
+		case "r", "e":
+			s.mu.Lock()
+			ch, ok := s.pending[msg.T+udpAddr.String()]
+			delete(s.pending, msg.T+udpAddr.String())
+			s.mu.Unlock()
+			if ok {
+				ch <- msg
+			}
+		}
+	}
+}
+
+func (s *Server) send(addr *net.UDPAddr, msg *message) error {
+	buf, err := msg.encode()
+	if err != nil {
+		return err
+	}
+	_, err = s.conn.WriteTo(buf, addr)
+	return err
+}
+
+// query sends a query and waits for its response. Nodes that answer are
+// added to the routing table, and ones that don't are marked as failing.
+func (s *Server) query(ctx context.Context, addr *net.UDPAddr, method string, args map[string]interface{}) (map[string]interface{}, error) {
+	args["id"] = string(s.id[:])
+
+	s.mu.Lock()
+	s.nextT++
+	t := string([]byte{byte(s.nextT >> 8), byte(s.nextT)})
+	key := t + addr.String()
+	ch := make(chan *message, 1)
+	s.pending[key] = ch
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, key)
+		s.mu.Unlock()
+	}()
+
+	err := s.send(addr, &message{T: t, Y: "q", Q: method, A: args})
+	if err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(s.cfg.QueryTimeout)
+	defer timer.Stop()
+	select {
+	case msg := <-ch:
+		if msg.E != nil {
+			return nil, msg.E
+		}
+		id, err := getID(msg.R, "id")
+		if err != nil {
+			return nil, err
+		}
+		s.table.add(Node{ID: id, Addr: addr})
+		return msg.R, nil
+	case <-timer.C:
+		s.table.failed(addr.String())
+		return nil, fmt.Errorf("%s query to %s timed out", method, addr)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.closed:
+		return nil, fmt.Errorf("DHT server closed")
+	}
+}
+
+// Ping checks that a node is up and returns its ID
+func (s *Server) Ping(ctx context.Context, addr *net.UDPAddr) ([20]byte, error) {
+	r, err := s.query(ctx, addr, "ping", map[string]interface{}{})
+	if err != nil {
+		return [20]byte{}, err
+	}
+	return getID(r, "id")
+}
+
+// FindNode asks the node at addr for the nodes it knows closest to target
+func (s *Server) FindNode(ctx context.Context, addr *net.UDPAddr, target [20]byte) ([]Node, error) {
+	r, err := s.query(ctx, addr, "find_node", map[string]interface{}{
+		"target": string(target[:]),
+	})
+	if err != nil {
+		return nil, err
+	}
+	nodes, _ := r["nodes"].(string)
+	return decodeNodes(nodes)
+}
+
+// Bootstrap joins the DHT through the bootstrap nodes and fills the routing
+// table with the nodes closest to us
+func (s *Server) Bootstrap(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, host := range s.cfg.BootstrapNodes {
+		addr, err := net.ResolveUDPAddr("udp", host)
+		if err != nil {
+			s.log.Debugf("Could not resolve bootstrap node %s: %s", host, err)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			nodes, err := s.FindNode(ctx, addr, s.id)
+			if err != nil {
+				s.log.Debugf("Bootstrap node %s failed: %s", addr, err)
+				return
+			}
+			for _, n := range nodes {
+				s.table.add(n)
+			}
+		}()
+	}
+	wg.Wait()
+
+	s.lookup(ctx, s.id, false)
+	if s.table.len() == 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("Could not reach any DHT nodes")
+	}
+	return nil
+}
+
+// GetPeers looks up peers for a torrent
+func (s *Server) GetPeers(ctx context.Context, infoHash [20]byte) ([]peers.Peer, error) {
+	if err := s.ensureBootstrapped(ctx); err != nil {
+		return nil, err
+	}
+	_, found := s.lookup(ctx, infoHash, true)
+	return found, nil
+}
+
+// Announce tells the nodes closest to infoHash that we accept connections
+// for it on port
+func (s *Server) Announce(ctx context.Context, infoHash [20]byte, port uint16) error {
+	_, err := s.FindPeers(ctx, infoHash, port)
+	return err
+}
+
+// FindPeers looks up peers for a torrent and announces that we accept
+// connections for it on port, in a single lookup. It satisfies
+// p2p.PeerSource.
+func (s *Server) FindPeers(ctx context.Context, infoHash [20]byte, port uint16) ([]peers.Peer, error) {
+	if err := s.ensureBootstrapped(ctx); err != nil {
+		return nil, err
+	}
+	closest, found := s.lookup(ctx, infoHash, true)
+
+	var wg sync.WaitGroup
+	announced := 0
+	var mu sync.Mutex
+	for _, c := range closest {
+		if c.token == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(c *candidate) {
+			defer wg.Done()
+			_, err := s.query(ctx, c.node.Addr, "announce_peer", map[string]interface{}{
+				"info_hash": string(infoHash[:]),
+				"port":      int64(port),
+				"token":     c.token,
+			})
+			if err == nil {
+				mu.Lock()
+				announced++
+				mu.Unlock()
+			}
+		}(c)
+	}
+	wg.Wait()
+	if announced == 0 && len(found) == 0 {
+		return nil, fmt.Errorf("No DHT node accepted an announce for %x", infoHash)
+	}
+	return found, nil
+}
+
+func (s *Server) ensureBootstrapped(ctx context.Context) error {
+	if s.table.len() > 0 {
+		return nil
+	}
+	return s.Bootstrap(ctx)
+}
+
+type candidate struct {
+	node    Node
+	dist    [20]byte
+	queried bool
+	failed  bool
+	token   string
+}
+
+type lookupResponse struct {
+	c   *candidate
+	r   map[string]interface{}
+	err error
+}
+
+// lookup runs an iterative Kademlia lookup for target, starting from the
+// closest nodes in the routing table. It returns the K closest nodes that
+// answered, with the tokens they gave us if getPeers is set, and any peers
+// found along the way.
+func (s *Server) lookup(ctx context.Context, target [20]byte, getPeers bool) ([]*candidate, []peers.Peer) {
+	var candidates []*candidate
+	seen := make(map[string]bool)
+	addCandidate := func(n Node) {
+		if n.ID == s.id || seen[n.Addr.String()] {
+			return
+		}
+		seen[n.Addr.String()] = true
+		candidates = append(candidates, &candidate{node: n, dist: distance(n.ID, target)})
+	}
+	for _, n := range s.table.closest(target, K) {
+		addCandidate(n)
+	}
+
+	method, key := "find_node", "target"
+	if getPeers {
+		method, key = "get_peers", "info_hash"
+	}
+
+	var found []peers.Peer
+	seenPeers := make(map[string]bool)
+	responses := make(chan lookupResponse)
+	inflight := 0
+	for {
+		sort.Slice(candidates, func(i, j int) bool {
+			return bytes.Compare(candidates[i].dist[:], candidates[j].dist[:]) < 0
+		})
+
+		// Query the closest K nodes that haven't failed, a few at a time
+		considered := 0
+		for _, c := range candidates {
+			if inflight >= alpha || considered >= K {
+				break
+			}
+			if c.failed {
+				continue
+			}
+			considered++
+			if c.queried {
+				continue
+			}
+			c.queried = true
+			inflight++
+			go func(c *candidate) {
+				r, err := s.query(ctx, c.node.Addr, method, map[string]interface{}{
+					key: string(target[:]),
+				})
+				responses <- lookupResponse{c: c, r: r, err: err}
+			}(c)
+		}
+		if inflight == 0 {
+			break
+		}
+
+		res := <-responses
+		inflight--
+		if res.err != nil {
+			res.c.failed = true
+			continue
+		}
+		if token, ok := res.r["token"].(string); ok {
+			res.c.token = token
+		}
+		if nodes, ok := res.r["nodes"].(string); ok {
+			decoded, err := decodeNodes(nodes)
+			if err == nil {
+				for _, n := range decoded {
+					addCandidate(n)
+				}
+			}
+		}
+		for _, p := range decodeValues(res.r["values"]) {
+			if !seenPeers[p.String()] {
+				seenPeers[p.String()] = true
+				found = append(found, p)
+			}
+		}
+	}
+
+	var closest []*candidate
+	for _, c := range candidates {
+		if len(closest) >= K {
+			break
+		}
+		if c.queried && !c.failed {
+			closest = append(closest, c)
+		}
+	}
+	return closest, found
+}
+
+func (s *Server) handleQuery(addr *net.UDPAddr, msg *message) {
+	id, err := getID(msg.A, "id")
+	if err != nil {
+		s.replyError(addr, msg.T, errProtocol, "Missing id")
+		return
+	}
+	s.table.add(Node{ID: id, Addr: addr})
+
+	r := map[string]interface{}{"id": string(s.id[:])}
+	switch msg.Q {
+	case "ping":
+	case "find_node":
+		target, err := getID(msg.A, "target")
+		if err != nil {
+			s.replyError(addr, msg.T, errProtocol, "Missing target")
+			return
+		}
+		r["nodes"] = encodeNodes(s.table.closest(target, K))
+	case "get_peers":
+		infoHash, err := getID(msg.A, "info_hash")
+		if err != nil {
+			s.replyError(addr, msg.T, errProtocol, "Missing info_hash")
+			return
+		}
+		r["token"] = s.token(addr.IP, 0)
+		values := s.storedPeers(infoHash)
+		if len(values) > 0 {
+			r["values"] = values
+		} else {
+			r["nodes"] = encodeNodes(s.table.closest(infoHash, K))
+		}
+	case "announce_peer":
+		infoHash, err := getID(msg.A, "info_hash")
+		if err != nil {
+			s.replyError(addr, msg.T, errProtocol, "Missing info_hash")
+			return
+		}
+		token, _ := msg.A["token"].(string)
+		if !s.validToken(addr.IP, token) {
+			s.replyError(addr, msg.T, errProtocol, "Bad token")
+			return
+		}
+		port, _ := msg.A["port"].(int64)
+		if implied, _ := msg.A["implied_port"].(int64); implied != 0 {
+			port = int64(addr.Port)
+		}
+		if port <= 0 || port > 65535 {
+			s.replyError(addr, msg.T, errProtocol, "Bad port")
+			return
+		}
+		s.storePeer(infoHash, peers.Peer{IP: addr.IP, Port: uint16(port)})
+	default:
+		s.replyError(addr, msg.T, errMethodUnknown, "Method Unknown")
+		return
+	}
+	s.send(addr, &message{T: msg.T, Y: "r", R: r})
+}
+
+func (s *Server) replyError(addr *net.UDPAddr, t string, code int, msg string) {
+	s.send(addr, &message{T: t, Y: "e", E: &KRPCError{Code: code, Message: msg}})
+}
+
+func (s *Server) rotateSecret() error {
+	secret := make([]byte, 20)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return err
+	}
+	s.secret[1] = s.secret[0]
+	s.secret[0] = secret
+	s.rotated = time.Now()
+	return nil
+}
+
+// token returns the announce token we hand to ip, made from the current
+// secret (0) or the previous one (1)
+func (s *Server) token(ip net.IP, which int) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if which == 0 && time.Since(s.rotated) > tokenRotation {
+		s.rotateSecret()
+	}
+	if s.secret[which] == nil {
+		return ""
+	}
+	h := sha1.New()
+	h.Write(s.secret[which])
+	h.Write(ip)
+	return string(h.Sum(nil))
+}
+
+func (s *Server) validToken(ip net.IP, token string) bool {
+	if token == "" {
+		return false
+	}
+	return token == s.token(ip, 0) || token == s.token(ip, 1)
+}
+
+func (s *Server) storePeer(infoHash [20]byte, p peers.Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.store[infoHash]
+	if !ok {
+		stored = make(map[string]storedPeer)
+		s.store[infoHash] = stored
+	}
+	stored[p.String()] = storedPeer{peer: p, expires: time.Now().Add(peerTTL)}
+}
+
+// storedPeers returns peers announced to us for infoHash in compact form,
+// dropping the ones that have expired
+func (s *Server) storedPeers(infoHash [20]byte) []interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var values []interface{}
+	now := time.Now()
+	for key, sp := range s.store[infoHash] {
+		if now.After(sp.expires) {
+			delete(s.store[infoHash], key)
+			continue
+		}
+		if compact := encodePeer(sp.peer); compact != "" && len(values) < maxValues {
+			values = append(values, compact)
+		}
+	}
+	return values
+}
+
+type bencodeState struct {
+	ID    string `bencode:"id"`
+	Nodes string `bencode:"nodes"`
+}
+
+func (s *Server) saveState(path string) error {
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, bencodeState{
+		ID:    string(s.id[:]),
+		Nodes: encodeNodes(s.table.nodes()),
+	})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
+
+func loadState(path string) ([20]byte, []Node, error) {
+	var id [20]byte
+	file, err := os.Open(path)
+	if err != nil {
+		return id, nil, err
+	}
+	defer file.Close()
+
+	state := bencodeState{}
+	err = bencode.Unmarshal(file, &state)
+	if err != nil {
+		return id, nil, err
+	}
+	if len(state.ID) != len(id) {
+		return id, nil, fmt.Errorf("Malformed node ID in %s", path)
+	}
+	copy(id[:], state.ID)
+	nodes, err := decodeNodes(state.Nodes)
+	if err != nil {
+		return id, nil, err
+	}
+	return id, nodes, nil
+}
@@ -0,0 +1,139 @@
+package dht
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/torrent-client/peers"
+)
+
+// startNetwork starts n DHT nodes on loopback that bootstrap off the first
+func startNetwork(t *testing.T, n int) []*Server {
+	var servers []*Server
+	for i := 0; i < n; i++ {
+		cfg := Config{Addr: "127.0.0.1:0", QueryTimeout: 500 * time.Millisecond, BootstrapNodes: []string{}}
+		if i > 0 {
+			cfg.BootstrapNodes = []string{servers[0].Addr().String()}
+		}
+		s, err := New(cfg)
+		require.Nil(t, err)
+		servers = append(servers, s)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, s := range servers[1:] {
+		require.Nil(t, s.Bootstrap(ctx))
+	}
+	return servers
+}
+
+func closeAll(servers []*Server) {
+	for _, s := range servers {
+		s.Close()
+	}
+}
+
+func TestPing(t *testing.T) {
+	servers := startNetwork(t, 2)
+	defer closeAll(servers)
+
+	id, err := servers[1].Ping(context.Background(), servers[0].Addr().(*net.UDPAddr))
+	require.Nil(t, err)
+	assert.Equal(t, servers[0].ID(), id)
+}
+
+func TestAnnounceAndGetPeers(t *testing.T) {
+	servers := startNetwork(t, 10)
+	defer closeAll(servers)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	infoHash := [20]byte{0xde, 0xad, 0xbe, 0xef}
+	_, err := servers[3].FindPeers(ctx, infoHash, 6881)
+	require.Nil(t, err)
+
+	found, err := servers[8].GetPeers(ctx, infoHash)
+	require.Nil(t, err)
+	assert.Contains(t, found, peers.Peer{IP: net.IP{127, 0, 0, 1}, Port: 6881})
+}
+
+func TestAnnounceBadToken(t *testing.T) {
+	servers := startNetwork(t, 2)
+	defer closeAll(servers)
+
+	_, err := servers[1].query(context.Background(), servers[0].Addr().(*net.UDPAddr), "announce_peer", map[string]interface{}{
+		"info_hash": string(make([]byte, 20)),
+		"port":      int64(6881),
+		"token":     "forged",
+	})
+	require.NotNil(t, err)
+	assert.Equal(t, errProtocol, err.(*KRPCError).Code)
+}
+
+func TestUnknownMethod(t *testing.T) {
+	servers := startNetwork(t, 2)
+	defer closeAll(servers)
+
+	_, err := servers[1].query(context.Background(), servers[0].Addr().(*net.UDPAddr), "vote", map[string]interface{}{})
+	require.NotNil(t, err)
+	assert.Equal(t, errMethodUnknown, err.(*KRPCError).Code)
+}
+
+func TestPersistRoutingTable(t *testing.T) {
+	servers := startNetwork(t, 3)
+	defer closeAll(servers)
+
+	dir, err := ioutil.TempDir("", "dht")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dht.dat")
+
+	s, err := New(Config{Addr: "127.0.0.1:0", StatePath: path, BootstrapNodes: []string{servers[0].Addr().String()}})
+	require.Nil(t, err)
+	require.Nil(t, s.Bootstrap(context.Background()))
+	id, numNodes := s.ID(), len(s.Nodes())
+	require.Nil(t, s.Close())
+
+	restored, err := New(Config{Addr: "127.0.0.1:0", StatePath: path, BootstrapNodes: []string{}})
+	require.Nil(t, err)
+	defer restored.Close()
+	assert.Equal(t, id, restored.ID())
+	assert.Len(t, restored.Nodes(), numNodes)
+}
+
+func TestRefreshStaleBuckets(t *testing.T) {
+	defer func(old time.Duration) { refreshCheckInterval = old }(refreshCheckInterval)
+	refreshCheckInterval = 20 * time.Millisecond
+
+	// A node that only listens, to see what the server asks it
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer conn.Close()
+	s, err := New(Config{Addr: "127.0.0.1:0", BootstrapNodes: []string{}, QueryTimeout: 100 * time.Millisecond})
+	require.Nil(t, err)
+	defer s.Close()
+	id := s.ID()
+	id[0] ^= 0x80
+	s.AddNode(Node{ID: id, Addr: conn.LocalAddr().(*net.UDPAddr)})
+	s.table.mu.Lock()
+	s.table.changed[0] = time.Now().Add(-refreshAfter)
+	s.table.mu.Unlock()
+
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	require.Nil(t, err)
+	msg, err := decodeMessage(buf[:n])
+	require.Nil(t, err)
+	assert.Equal(t, "find_node", msg.Q)
+	target, err := getID(msg.A, "target")
+	require.Nil(t, err)
+	assert.Equal(t, 0, commonPrefixLen(s.ID(), target))
+}
@@ -0,0 +1,182 @@
+package dht
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/veggiedefender/torrent-client/peers"
+)
+
+// KRPC error codes from BEP 5
+const (
+	errGeneric       = 201
+	errServer        = 202
+	errProtocol      = 203
+	errMethodUnknown = 204
+)
+
+// A KRPCError is an error that a remote node sent in reply to a query
+type KRPCError struct {
+	Code    int
+	Message string
+}
+
+func (e *KRPCError) Error() string {
+	return fmt.Sprintf("KRPC error %d: %s", e.Code, e.Message)
+}
+
+// A message is a KRPC query, response or error. Only the fields that apply
+// to its type Y are set.
+type message struct {
+	T string
+	Y string
+	Q string
+	A map[string]interface{}
+	R map[string]interface{}
+	E *KRPCError
+}
+
+func (m *message) encode() ([]byte, error) {
+	dict := map[string]interface{}{
+		"t": m.T,
+		"y": m.Y,
+	}
+	switch m.Y {
+	case "q":
+		dict["q"] = m.Q
+		dict["a"] = m.A
+	case "r":
+		dict["r"] = m.R
+	case "e":
+		dict["e"] = []interface{}{int64(m.E.Code), m.E.Message}
+	}
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, dict)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeMessage(buf []byte) (*message, error) {
+	v, err := bencode.Decode(bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("KRPC message is not a dictionary")
+	}
+
+	m := &message{}
+	m.T, _ = dict["t"].(string)
+	m.Y, _ = dict["y"].(string)
+	switch m.Y {
+	case "q":
+		m.Q, _ = dict["q"].(string)
+		m.A, ok = dict["a"].(map[string]interface{})
+		if !ok || m.Q == "" {
+			return nil, fmt.Errorf("Malformed KRPC query")
+		}
+	case "r":
+		m.R, ok = dict["r"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Malformed KRPC response")
+		}
+	case "e":
+		list, ok := dict["e"].([]interface{})
+		if !ok || len(list) != 2 {
+			return nil, fmt.Errorf("Malformed KRPC error")
+		}
+		code, _ := list[0].(int64)
+		msg, _ := list[1].(string)
+		m.E = &KRPCError{Code: int(code), Message: msg}
+	default:
+		return nil, fmt.Errorf("Unknown KRPC message type %q", m.Y)
+	}
+	return m, nil
+}
+
+// getID reads a 20-byte node ID or infohash from a query's arguments or a
+// response's values
+func getID(dict map[string]interface{}, key string) ([20]byte, error) {
+	var id [20]byte
+	s, ok := dict[key].(string)
+	if !ok || len(s) != len(id) {
+		return id, fmt.Errorf("Missing or malformed %s", key)
+	}
+	copy(id[:], s)
+	return id, nil
+}
+
+// Node is the ID and address of a DHT node
+type Node struct {
+	ID   [20]byte
+	Addr *net.UDPAddr
+}
+
+// compactNodeSize is the length of a node in compact node info: its ID
+// followed by its IPv4 address and port
+const compactNodeSize = 26
+
+func encodeNodes(nodes []Node) string {
+	buf := make([]byte, 0, len(nodes)*compactNodeSize)
+	for _, n := range nodes {
+		ip := n.Addr.IP.To4()
+		if ip == nil {
+			continue
+		}
+		buf = append(buf, n.ID[:]...)
+		buf = append(buf, ip...)
+		buf = append(buf, byte(n.Addr.Port>>8), byte(n.Addr.Port))
+	}
+	return string(buf)
+}
+
+func decodeNodes(s string) ([]Node, error) {
+	if len(s)%compactNodeSize != 0 {
+		return nil, fmt.Errorf("Received malformed nodes of length %d", len(s))
+	}
+	nodes := make([]Node, len(s)/compactNodeSize)
+	for i := range nodes {
+		buf := []byte(s[i*compactNodeSize : (i+1)*compactNodeSize])
+		copy(nodes[i].ID[:], buf[:20])
+		nodes[i].Addr = &net.UDPAddr{
+			IP:   net.IP(buf[20:24]),
+			Port: int(binary.BigEndian.Uint16(buf[24:26])),
+		}
+	}
+	return nodes, nil
+}
+
+// encodePeer packs an IPv4 peer into the 6-byte compact format used in
+// get_peers values
+func encodePeer(p peers.Peer) string {
+	ip := p.IP.To4()
+	if ip == nil {
+		return ""
+	}
+	return string(append(append([]byte{}, ip...), byte(p.Port>>8), byte(p.Port)))
+}
+
+// decodeValues parses the compact peers in a get_peers response, skipping
+// anything that isn't a 6-byte IPv4 peer
+func decodeValues(v interface{}) []peers.Peer {
+	list, _ := v.([]interface{})
+	var found []peers.Peer
+	for _, item := range list {
+		s, ok := item.(string)
+		if !ok || len(s) != 6 {
+			continue
+		}
+		parsed, err := peers.Unmarshal([]byte(s))
+		if err != nil {
+			continue
+		}
+		found = append(found, parsed...)
+	}
+	return found
+}
@@ -0,0 +1,76 @@
+package dht
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/torrent-client/peers"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	tests := map[string]*message{
+		"query": {
+			T: "aa", Y: "q", Q: "ping",
+			A: map[string]interface{}{"id": "abcdefghij0123456789"},
+		},
+		"response": {
+			T: "aa", Y: "r",
+			R: map[string]interface{}{"id": "mnopqrstuvwxyz123456"},
+		},
+		"error": {
+			T: "aa", Y: "e",
+			E: &KRPCError{Code: errGeneric, Message: "A Generic Error Ocurred"},
+		},
+	}
+	for name, msg := range tests {
+		buf, err := msg.encode()
+		require.Nil(t, err, name)
+		decoded, err := decodeMessage(buf)
+		require.Nil(t, err, name)
+		assert.Equal(t, msg, decoded, name)
+	}
+}
+
+func TestDecodeBEP5Example(t *testing.T) {
+	msg, err := decodeMessage([]byte("d1:ad2:id20:abcdefghij01234567896:target20:mnopqrstuvwxyz123456e1:q9:find_node1:t2:aa1:y1:qe"))
+	require.Nil(t, err)
+	assert.Equal(t, "find_node", msg.Q)
+	target, err := getID(msg.A, "target")
+	require.Nil(t, err)
+	assert.Equal(t, "mnopqrstuvwxyz123456", string(target[:]))
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	inputs := []string{
+		"i5e",
+		"d1:t2:aa1:y1:qe",
+		"d1:t2:aa1:y1:ze",
+		"d1:eli201ee1:t2:aa1:y1:ee",
+		"not bencode",
+	}
+	for _, input := range inputs {
+		_, err := decodeMessage([]byte(input))
+		assert.NotNil(t, err, input)
+	}
+}
+
+func TestNodesRoundTrip(t *testing.T) {
+	nodes := []Node{
+		{ID: [20]byte{1, 2, 3}, Addr: &net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 6881}},
+		{ID: [20]byte{4, 5, 6}, Addr: &net.UDPAddr{IP: net.IP{198, 51, 100, 7}, Port: 51413}},
+	}
+	decoded, err := decodeNodes(encodeNodes(nodes))
+	require.Nil(t, err)
+	assert.Equal(t, nodes, decoded)
+
+	_, err = decodeNodes("short")
+	assert.NotNil(t, err)
+}
+
+func TestDecodeValues(t *testing.T) {
+	p := peers.Peer{IP: net.IP{192, 0, 2, 1}, Port: 6881}
+	values := []interface{}{encodePeer(p), "too long to be a peer", int64(5)}
+	assert.Equal(t, []peers.Peer{p}, decodeValues(values))
+}
@@ -0,0 +1,211 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// K is the number of nodes kept in each bucket, and the number of closest
+// nodes a lookup converges on
+const K = 8
+
+// staleAfter is how long a node can go without being heard from before it
+// may be replaced by a new one
+const staleAfter = 15 * time.Minute
+
+// refreshAfter is how long a bucket can go without changes before it is
+// refreshed, as BEP 5 asks
+const refreshAfter = 15 * time.Minute
+
+// maxFails is how many queries in a row a node can fail before it is removed
+const maxFails = 2
+
+type entry struct {
+	Node
+	lastSeen time.Time
+	fails    int
+}
+
+// A table is a Kademlia routing table. Bucket i holds nodes whose IDs share
+// exactly i leading bits with ours.
+type table struct {
+	self    [20]byte
+	mu      sync.Mutex
+	buckets [160][]*entry
+	// changed is when each bucket last had a node added or heard from, or
+	// was last refreshed
+	changed [160]time.Time
+}
+
+func newTable(self [20]byte) *table {
+	return &table{self: self}
+}
+
+// distance is the XOR metric between two IDs
+func distance(a, b [20]byte) [20]byte {
+	var d [20]byte
+	for i := range d {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
+}
+
+// commonPrefixLen counts the leading bits that two IDs share
+func commonPrefixLen(a, b [20]byte) int {
+	for i := range a {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			continue
+		}
+		n := i * 8
+		for x&0x80 == 0 {
+			n++
+			x <<= 1
+		}
+		return n
+	}
+	return 160
+}
+
+// add records that we heard from a node. It returns false if the node's
+// bucket is full of good nodes and it was left out.
+func (t *table) add(n Node) bool {
+	if n.ID == t.self || n.Addr == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	i := commonPrefixLen(t.self, n.ID)
+	bucket := t.buckets[i]
+	for _, e := range bucket {
+		if e.ID == n.ID {
+			e.Addr = n.Addr
+			e.lastSeen = time.Now()
+			e.fails = 0
+			t.changed[i] = e.lastSeen
+			return true
+		}
+	}
+	if len(bucket) < K {
+		t.buckets[i] = append(bucket, &entry{Node: n, lastSeen: time.Now()})
+		t.changed[i] = time.Now()
+		return true
+	}
+
+	// Replace a failing node, or else the one we have gone longest without
+	// hearing from if it has gone quiet
+	var worst *entry
+	for _, e := range bucket {
+		if worst == nil || e.fails > worst.fails ||
+			(e.fails == worst.fails && e.lastSeen.Before(worst.lastSeen)) {
+			worst = e
+		}
+	}
+	if worst.fails == 0 && time.Since(worst.lastSeen) < staleAfter {
+		return false
+	}
+	*worst = entry{Node: n, lastSeen: time.Now()}
+	t.changed[i] = worst.lastSeen
+	return true
+}
+
+// staleBuckets returns the buckets that haven't changed in refreshAfter, and
+// counts them as refreshed. Buckets past the deepest one holding a node are
+// left out, since the IDs they cover are too close to ours to likely exist.
+func (t *table) staleBuckets(now time.Time) []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	deepest := -1
+	for i, bucket := range t.buckets {
+		if len(bucket) > 0 {
+			deepest = i
+		}
+	}
+	var stale []int
+	for i := 0; i <= deepest; i++ {
+		if now.Sub(t.changed[i]) >= refreshAfter {
+			t.changed[i] = now
+			stale = append(stale, i)
+		}
+	}
+	return stale
+}
+
+// randomIDInBucket returns a random ID that falls in bucket i, which is one
+// that shares exactly i leading bits with ours
+func (t *table) randomIDInBucket(i int) ([20]byte, error) {
+	var id [20]byte
+	_, err := rand.Read(id[:])
+	if err != nil {
+		return id, err
+	}
+	// Copy our first i bits, then flip the next one
+	for b := 0; b < i; b++ {
+		mask := byte(0x80 >> uint(b%8))
+		id[b/8] = id[b/8]&^mask | t.self[b/8]&mask
+	}
+	if i < 160 {
+		mask := byte(0x80 >> uint(i%8))
+		id[i/8] = id[i/8]&^mask | ^t.self[i/8]&mask
+	}
+	return id, nil
+}
+
+// failed records that a node at addr didn't answer, removing it once it has
+// failed too often
+func (t *table) failed(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, bucket := range t.buckets {
+		for j, e := range bucket {
+			if e.Addr.String() != addr {
+				continue
+			}
+			e.fails++
+			if e.fails >= maxFails {
+				t.buckets[i] = append(bucket[:j], bucket[j+1:]...)
+			}
+			return
+		}
+	}
+}
+
+// closest returns up to n known nodes, nearest to target first
+func (t *table) closest(target [20]byte, n int) []Node {
+	nodes := t.nodes()
+	sort.Slice(nodes, func(i, j int) bool {
+		di, dj := distance(nodes[i].ID, target), distance(nodes[j].ID, target)
+		return bytes.Compare(di[:], dj[:]) < 0
+	})
+	if len(nodes) > n {
+		nodes = nodes[:n]
+	}
+	return nodes
+}
+
+// nodes returns every node in the table
+func (t *table) nodes() []Node {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var nodes []Node
+	for _, bucket := range t.buckets {
+		for _, e := range bucket {
+			nodes = append(nodes, e.Node)
+		}
+	}
+	return nodes
+}
+
+func (t *table) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, bucket := range t.buckets {
+		n += len(bucket)
+	}
+	return n
+}
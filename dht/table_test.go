@@ -0,0 +1,89 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testNode(id byte, port int) Node {
+	return Node{
+		ID:   [20]byte{id},
+		Addr: &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: port},
+	}
+}
+
+func TestCommonPrefixLen(t *testing.T) {
+	assert.Equal(t, 160, commonPrefixLen([20]byte{1}, [20]byte{1}))
+	assert.Equal(t, 0, commonPrefixLen([20]byte{0x80}, [20]byte{0x00}))
+	assert.Equal(t, 7, commonPrefixLen([20]byte{0x01}, [20]byte{0x00}))
+	assert.Equal(t, 12, commonPrefixLen([20]byte{0, 0x08}, [20]byte{0, 0x00}))
+}
+
+func TestTableClosest(t *testing.T) {
+	tab := newTable([20]byte{})
+	for i := 1; i <= 5; i++ {
+		assert.True(t, tab.add(testNode(byte(i), 6880+i)))
+	}
+	assert.False(t, tab.add(testNode(0, 1)), "our own ID is never added")
+
+	closest := tab.closest([20]byte{4}, 3)
+	assert.Equal(t, [][20]byte{{4}, {5}, {1}}, [][20]byte{closest[0].ID, closest[1].ID, closest[2].ID})
+}
+
+func TestTableFullBucket(t *testing.T) {
+	tab := newTable([20]byte{})
+	// IDs 0x80 to 0x87 all land in bucket 0
+	for i := 0; i < K; i++ {
+		assert.True(t, tab.add(testNode(0x80+byte(i), 7000+i)))
+	}
+	assert.False(t, tab.add(testNode(0xf0, 8000)))
+
+	// A failing node makes room
+	tab.failed("127.0.0.1:7003")
+	assert.True(t, tab.add(testNode(0xf0, 8000)))
+	assert.Equal(t, K, tab.len())
+
+	// So does a stale one
+	tab.buckets[0][0].lastSeen = time.Now().Add(-time.Hour)
+	assert.True(t, tab.add(testNode(0xf1, 8001)))
+	assert.Equal(t, K, tab.len())
+}
+
+func TestTableFailedRemoves(t *testing.T) {
+	tab := newTable([20]byte{})
+	tab.add(testNode(1, 7000))
+	for i := 0; i < maxFails; i++ {
+		tab.failed("127.0.0.1:7000")
+	}
+	assert.Equal(t, 0, tab.len())
+}
+
+func TestTableStaleBuckets(t *testing.T) {
+	tab := newTable([20]byte{})
+	now := time.Now()
+	assert.Empty(t, tab.staleBuckets(now))
+
+	// 0x80 lands in bucket 0 and 0x01 in bucket 7. The empty buckets
+	// between them have never changed, and the refresh resets them.
+	tab.add(testNode(0x80, 7000))
+	tab.add(testNode(0x01, 7001))
+	assert.Equal(t, []int{1, 2, 3, 4, 5, 6}, tab.staleBuckets(now))
+	assert.Empty(t, tab.staleBuckets(now))
+
+	tab.changed[0] = now.Add(-refreshAfter)
+	assert.Equal(t, []int{0}, tab.staleBuckets(now.Add(time.Minute)))
+}
+
+func TestRandomIDInBucket(t *testing.T) {
+	self := [20]byte{0xa5, 0x5a, 0xff}
+	tab := newTable(self)
+	for _, i := range []int{0, 1, 7, 8, 13, 100, 159} {
+		id, err := tab.randomIDInBucket(i)
+		require.Nil(t, err)
+		assert.Equal(t, i, commonPrefixLen(self, id), "bucket %d", i)
+	}
+}
@@ -5,13 +5,35 @@ import (
 	"io"
 )
 
+// Bits of the reserved bytes that advertise protocol extensions, numbered
+// from the right as in the BEPs
+const (
+	// ExtensionDHT advertises a DHT node (BEP 5)
+	ExtensionDHT = 0
+	// ExtensionFast advertises the Fast Extension (BEP 6)
+	ExtensionFast = 2
+	// ExtensionProtocol advertises the extension protocol (BEP 10)
+	ExtensionProtocol = 20
+)
+
 // A Handshake is a special message that a peer uses to identify itself
 type Handshake struct {
 	Pstr     string
+	Reserved [8]byte
 	InfoHash [20]byte
 	PeerID   [20]byte
 }
 
+// SetExtension sets a bit of the reserved bytes to advertise an extension
+func (h *Handshake) SetExtension(bit int) {
+	h.Reserved[7-bit/8] |= 1 << uint(bit%8)
+}
+
+// HasExtension tells if a bit of the reserved bytes is set
+func (h *Handshake) HasExtension(bit int) bool {
+	return h.Reserved[7-bit/8]&(1<<uint(bit%8)) != 0
+}
+
 // New creates a new handshake with the standard pstr
 func New(infoHash, peerID [20]byte) *Handshake {
 	return &Handshake{
@@ -27,7 +49,7 @@ func (h *Handshake) Serialize() []byte {
 	buf[0] = byte(len(h.Pstr))
 	curr := 1
 	curr += copy(buf[curr:], h.Pstr)
-	curr += copy(buf[curr:], make([]byte, 8)) // 8 reserved bytes
+	curr += copy(buf[curr:], h.Reserved[:])
 	curr += copy(buf[curr:], h.InfoHash[:])
 	curr += copy(buf[curr:], h.PeerID[:])
 	return buf
@@ -53,13 +75,16 @@ func Read(r io.Reader) (*Handshake, error) {
 		return nil, err
 	}
 
+	var reserved [8]byte
 	var infoHash, peerID [20]byte
 
+	copy(reserved[:], handshakeBuf[pstrlen:pstrlen+8])
 	copy(infoHash[:], handshakeBuf[pstrlen+8:pstrlen+8+20])
 	copy(peerID[:], handshakeBuf[pstrlen+8+20:])
 
 	h := Handshake{
 		Pstr:     string(handshakeBuf[0:pstrlen]),
+		Reserved: reserved,
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
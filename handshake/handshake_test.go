@@ -91,3 +91,17 @@ func TestRead(t *testing.T) {
 		assert.Equal(t, test.output, m)
 	}
 }
+
+func TestExtensions(t *testing.T) {
+	h := New([20]byte{}, [20]byte{})
+	h.SetExtension(ExtensionProtocol)
+	h.SetExtension(ExtensionFast)
+	assert.Equal(t, [8]byte{0, 0, 0, 0, 0, 0x10, 0, 0x04}, h.Reserved)
+	assert.True(t, h.HasExtension(ExtensionProtocol))
+	assert.True(t, h.HasExtension(ExtensionFast))
+	assert.False(t, h.HasExtension(ExtensionDHT))
+
+	parsed, err := Read(bytes.NewReader(h.Serialize()))
+	assert.Nil(t, err)
+	assert.Equal(t, h, parsed)
+}
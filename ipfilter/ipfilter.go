@@ -0,0 +1,278 @@
+// Package ipfilter blocks peers by IP address, using eMule ipfilter.dat and
+// PeerGuardian P2P blocklists along with CIDR allow and deny rules
+package ipfilter
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// blockedLevel is the access level below which ipfilter.dat entries block
+// their range, as eMule reads them
+const blockedLevel = 128
+
+// A Filter decides which IP addresses to refuse. Allow rules take precedence
+// over deny rules and blocklists, so they can carve exceptions out of a list.
+// It is safe for concurrent use. A nil Filter blocks nothing.
+type Filter struct {
+	mu    sync.RWMutex
+	deny  ranges
+	allow ranges
+}
+
+// ipRange is an inclusive range of addresses in their 16-byte form
+type ipRange struct {
+	first net.IP
+	last  net.IP
+}
+
+// New returns a Filter that blocks nothing
+func New() *Filter {
+	return &Filter{}
+}
+
+// LoadFile adds the ranges in a blocklist file to the filter. See Load.
+func (f *Filter) LoadFile(path string) (skipped int, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return f.Load(file)
+}
+
+// Load adds the ranges in a blocklist to the filter. Each line is either in
+// the eMule ipfilter.dat format:
+//
+//	001.002.004.000 - 001.002.004.255 , 000 , Some organization
+//
+// or in the PeerGuardian P2P format:
+//
+//	Some organization:1.2.4.0-1.2.4.255
+//
+// Blank lines and lines starting with # or // are ignored. ipfilter.dat
+// entries with an access level of 128 or more allow their range instead of
+// blocking it, so they are left out. Lines that are in neither format are
+// skipped, since big lists tend to have a few, and their number is returned.
+func (f *Filter) Load(r io.Reader) (skipped int, err error) {
+	var deny []ipRange
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		r, blocked, err := parseLine(line)
+		if err != nil {
+			skipped++
+			continue
+		}
+		if blocked {
+			deny = append(deny, r)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return skipped, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deny = f.deny.add(deny...)
+	return skipped, nil
+}
+
+// parseLine parses a line of a blocklist in either format, and tells if the
+// range is blocked
+func parseLine(line string) (ipRange, bool, error) {
+	// P2P: the description can contain anything, colons included, but the
+	// range after the last colon can't, since the format only holds IPv4
+	// addresses
+	if i := strings.LastIndex(line, ":"); i >= 0 {
+		if r, err := parseRange(line[i+1:]); err == nil {
+			return r, true, nil
+		}
+	}
+	// ipfilter.dat: range, access level, description
+	fields := strings.SplitN(line, ",", 3)
+	if len(fields) < 2 {
+		return ipRange{}, false, fmt.Errorf("Unrecognized format")
+	}
+	r, err := parseRange(fields[0])
+	if err != nil {
+		return ipRange{}, false, err
+	}
+	level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+	if err != nil {
+		return ipRange{}, false, fmt.Errorf("Bad access level %q", fields[1])
+	}
+	return r, level < blockedLevel, nil
+}
+
+// parseRange parses a range like "1.2.3.0 - 1.2.3.255". Addresses may have
+// leading zeros, as they do in ipfilter.dat.
+func parseRange(s string) (ipRange, error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return ipRange{}, fmt.Errorf("Bad range %q", s)
+	}
+	first, err := parseIPv4(parts[0])
+	if err != nil {
+		return ipRange{}, err
+	}
+	last, err := parseIPv4(parts[1])
+	if err != nil {
+		return ipRange{}, err
+	}
+	if bytes.Compare(first, last) > 0 {
+		return ipRange{}, fmt.Errorf("Range %q ends before it starts", s)
+	}
+	return ipRange{first, last}, nil
+}
+
+// parseIPv4 parses a dotted IPv4 address whose parts may have leading zeros,
+// which net.ParseIP rejects
+func parseIPv4(s string) (net.IP, error) {
+	parts := strings.Split(strings.TrimSpace(s), ".")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("Bad address %q", s)
+	}
+	ip := make(net.IP, 4)
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("Bad address %q", s)
+		}
+		ip[i] = byte(n)
+	}
+	return ip.To16(), nil
+}
+
+// Deny blocks the addresses in a CIDR block like "10.0.0.0/8", or a single
+// address
+func (f *Filter) Deny(cidr string) error {
+	r, err := parseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deny = f.deny.add(r)
+	return nil
+}
+
+// Allow lets through the addresses in a CIDR block, or a single address,
+// even if deny rules or blocklists cover them
+func (f *Filter) Allow(cidr string) error {
+	r, err := parseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.allow = f.allow.add(r)
+	return nil
+}
+
+func parseCIDR(s string) (ipRange, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return ipRange{}, fmt.Errorf("Bad address %q", s)
+		}
+		return ipRange{ip.To16(), ip.To16()}, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return ipRange{}, err
+	}
+	first := network.IP.To16()
+	last := make(net.IP, net.IPv6len)
+	mask := network.Mask
+	if len(mask) == net.IPv4len {
+		// Line the mask up with the 16-byte form of the address
+		mask = append(net.CIDRMask(96, 128)[:12], mask...)
+	}
+	for i := range last {
+		last[i] = first[i] | ^mask[i]
+	}
+	return ipRange{first, last}, nil
+}
+
+// Blocked tells if ip is denied and not allowed
+func (f *Filter) Blocked(ip net.IP) bool {
+	if f == nil {
+		return false
+	}
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.deny.contains(ip) && !f.allow.contains(ip)
+}
+
+// Len returns the number of denied ranges, after merging those that overlap
+func (f *Filter) Len() int {
+	if f == nil {
+		return 0
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return len(f.deny)
+}
+
+// ranges is a sorted list of ranges that don't overlap or touch
+type ranges []ipRange
+
+// add returns the list with more ranges merged in
+func (rs ranges) add(more ...ipRange) ranges {
+	all := append(append([]ipRange{}, rs...), more...)
+	sort.Slice(all, func(i, j int) bool {
+		return bytes.Compare(all[i].first, all[j].first) < 0
+	})
+	var merged ranges
+	for _, r := range all {
+		if n := len(merged); n > 0 && touches(merged[n-1], r) {
+			if bytes.Compare(r.last, merged[n-1].last) > 0 {
+				merged[n-1].last = r.last
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// touches tells if r starts no later than just after prev ends
+func touches(prev, r ipRange) bool {
+	next := make(net.IP, len(prev.last))
+	copy(next, prev.last)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+		if i == 0 {
+			// prev ends at the last address there is
+			return true
+		}
+	}
+	return bytes.Compare(r.first, next) <= 0
+}
+
+func (rs ranges) contains(ip net.IP) bool {
+	// Find the last range starting at or before ip
+	i := sort.Search(len(rs), func(i int) bool {
+		return bytes.Compare(rs[i].first, ip) > 0
+	}) - 1
+	return i >= 0 && bytes.Compare(ip, rs[i].last) <= 0
+}
@@ -0,0 +1,122 @@
+package ipfilter
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadIPFilterDat(t *testing.T) {
+	f := New()
+	skipped, err := f.Load(strings.NewReader(`# Comment
+001.002.004.000 - 001.002.004.255 , 000 , Some organization
+// Another comment
+
+010.000.000.000 - 010.255.255.255 , 200 , Allowed by access level
+020.000.000.000 - 020.000.000.255 , 100 , Description with a colon: and, commas
+`))
+	require.Nil(t, err)
+	assert.Equal(t, 0, skipped)
+	assert.True(t, f.Blocked(net.ParseIP("20.0.0.1")))
+	assert.True(t, f.Blocked(net.ParseIP("1.2.4.0")))
+	assert.True(t, f.Blocked(net.ParseIP("1.2.4.255")))
+	assert.False(t, f.Blocked(net.ParseIP("1.2.5.0")))
+	assert.False(t, f.Blocked(net.ParseIP("1.2.3.255")))
+	assert.False(t, f.Blocked(net.ParseIP("10.1.2.3")))
+}
+
+func TestLoadP2P(t *testing.T) {
+	f := New()
+	skipped, err := f.Load(strings.NewReader(`Some: organization:1.2.4.0-1.2.4.255
+Other:5.6.7.8-5.6.7.8
+T-Mobile USA, Inc.:9.9.9.0-9.9.9.255
+`))
+	require.Nil(t, err)
+	assert.Equal(t, 0, skipped)
+	assert.True(t, f.Blocked(net.ParseIP("9.9.9.9")))
+	assert.True(t, f.Blocked(net.ParseIP("1.2.4.128")))
+	assert.True(t, f.Blocked(net.ParseIP("5.6.7.8")))
+	assert.False(t, f.Blocked(net.ParseIP("5.6.7.9")))
+	// IPv4 addresses match in either form
+	assert.True(t, f.Blocked(net.IP{5, 6, 7, 8}))
+}
+
+func TestLoadSkipsMalformedLines(t *testing.T) {
+	tests := []string{
+		"no range here",
+		"Org:1.2.3-1.2.3.4",
+		"Org:1.2.3.4-1.2.3.0",
+		"001.002.004.000 - 001.002.004.255 , x , Bad level",
+		"Org:256.0.0.0-256.0.0.1",
+		"A-B, Inc.:1.2.3.4",
+	}
+	f := New()
+	skipped, err := f.Load(strings.NewReader(strings.Join(tests, "\n") + "\nGood:1.1.1.1-1.1.1.1\n"))
+	require.Nil(t, err)
+	// The rest of the list still loads
+	assert.Equal(t, len(tests), skipped)
+	assert.Equal(t, 1, f.Len())
+	assert.True(t, f.Blocked(net.ParseIP("1.1.1.1")))
+}
+
+func TestLoadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfilter")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ipfilter.dat")
+	require.Nil(t, ioutil.WriteFile(path, []byte("Org:1.2.3.4-1.2.3.4\n"), 0644))
+
+	f := New()
+	_, err = f.LoadFile(path)
+	require.Nil(t, err)
+	assert.True(t, f.Blocked(net.ParseIP("1.2.3.4")))
+	_, err = f.LoadFile(filepath.Join(dir, "missing"))
+	assert.NotNil(t, err)
+}
+
+func TestCIDRRules(t *testing.T) {
+	f := New()
+	require.Nil(t, f.Deny("10.0.0.0/8"))
+	require.Nil(t, f.Deny("2001:db8::/32"))
+	require.Nil(t, f.Allow("10.1.0.0/16"))
+	require.Nil(t, f.Allow("10.2.3.4"))
+	assert.NotNil(t, f.Deny("10.0.0.0/33"))
+	assert.NotNil(t, f.Allow("not an address"))
+
+	assert.True(t, f.Blocked(net.ParseIP("10.0.0.1")))
+	assert.True(t, f.Blocked(net.ParseIP("10.255.255.255")))
+	assert.False(t, f.Blocked(net.ParseIP("11.0.0.0")))
+	assert.False(t, f.Blocked(net.ParseIP("10.1.200.3")))
+	assert.False(t, f.Blocked(net.ParseIP("10.2.3.4")))
+	assert.True(t, f.Blocked(net.ParseIP("10.2.3.5")))
+	assert.True(t, f.Blocked(net.ParseIP("2001:db8:1::1")))
+	assert.False(t, f.Blocked(net.ParseIP("2001:db9::1")))
+}
+
+func TestMergeRanges(t *testing.T) {
+	f := New()
+	_, err := f.Load(strings.NewReader(`A:1.0.0.0-1.0.0.10
+B:1.0.0.5-1.0.0.20
+C:1.0.0.21-1.0.0.30
+D:2.0.0.0-2.0.0.0
+E:255.255.255.0-255.255.255.255
+`))
+	require.Nil(t, err)
+	require.Nil(t, f.Deny("255.255.255.255"))
+	assert.Equal(t, 3, f.Len())
+	assert.True(t, f.Blocked(net.ParseIP("1.0.0.25")))
+	assert.False(t, f.Blocked(net.ParseIP("1.0.0.31")))
+	assert.True(t, f.Blocked(net.ParseIP("255.255.255.255")))
+}
+
+func TestNilFilter(t *testing.T) {
+	var f *Filter
+	assert.False(t, f.Blocked(net.ParseIP("1.2.3.4")))
+	assert.Equal(t, 0, f.Len())
+}
@@ -0,0 +1,95 @@
+package logger
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// Level is the severity of a log message
+type Level int
+
+const (
+	// LevelDebug is for detail that is only useful when chasing a problem
+	LevelDebug Level = iota
+	// LevelInfo is for normal progress
+	LevelInfo
+	// LevelWarn is for things that went wrong but were recovered from
+	LevelWarn
+	// LevelError is for failures
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	default:
+		return fmt.Sprintf("LEVEL%d", l)
+	}
+}
+
+// A Logger writes leveled messages tagged with key/value fields
+type Logger interface {
+	Debugf(format string, v ...interface{})
+	Infof(format string, v ...interface{})
+	Warnf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+	// With returns a Logger that tags every message with key=value in addition
+	// to this Logger's fields
+	With(key string, value interface{}) Logger
+}
+
+// Discard is a Logger that drops every message
+var Discard Logger = discard{}
+
+type discard struct{}
+
+func (discard) Debugf(format string, v ...interface{})      {}
+func (discard) Infof(format string, v ...interface{})       {}
+func (discard) Warnf(format string, v ...interface{})       {}
+func (discard) Errorf(format string, v ...interface{})      {}
+func (d discard) With(key string, value interface{}) Logger { return d }
+
+type stdLogger struct {
+	out    *log.Logger
+	level  Level
+	fields string
+}
+
+// New returns a Logger that writes messages at level and above to w, one
+// per line, with the standard log timestamp
+func New(w io.Writer, level Level) Logger {
+	return &stdLogger{
+		out:   log.New(w, "", log.LstdFlags),
+		level: level,
+	}
+}
+
+func (l *stdLogger) logf(level Level, format string, v ...interface{}) {
+	if level < l.level {
+		return
+	}
+	msg := strings.TrimSuffix(fmt.Sprintf(format, v...), "\n")
+	l.out.Printf("%-5s %s%s", level, msg, l.fields)
+}
+
+func (l *stdLogger) Debugf(format string, v ...interface{}) { l.logf(LevelDebug, format, v...) }
+func (l *stdLogger) Infof(format string, v ...interface{})  { l.logf(LevelInfo, format, v...) }
+func (l *stdLogger) Warnf(format string, v ...interface{})  { l.logf(LevelWarn, format, v...) }
+func (l *stdLogger) Errorf(format string, v ...interface{}) { l.logf(LevelError, format, v...) }
+
+func (l *stdLogger) With(key string, value interface{}) Logger {
+	return &stdLogger{
+		out:    l.out,
+		level:  l.level,
+		fields: fmt.Sprintf("%s %s=%v", l.fields, key, value),
+	}
+}
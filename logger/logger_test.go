@@ -0,0 +1,39 @@
+package logger
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLevels(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, LevelWarn)
+	l.Debugf("debug %d", 1)
+	l.Infof("info %d", 2)
+	assert.Equal(t, "", buf.String())
+
+	l.Warnf("warn %d", 3)
+	assert.Contains(t, buf.String(), "WARN  warn 3\n")
+	l.Errorf("error %d\n", 4)
+	assert.Contains(t, buf.String(), "ERROR error 4\n")
+}
+
+func TestWith(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, LevelDebug)
+	torrent := l.With("torrent", "debian.iso")
+	torrent.With("peer", "192.0.2.1:6881").Infof("hello")
+	assert.Contains(t, buf.String(), "INFO  hello torrent=debian.iso peer=192.0.2.1:6881\n")
+
+	buf.Reset()
+	torrent.Infof("hello")
+	assert.Contains(t, buf.String(), "INFO  hello torrent=debian.iso\n")
+}
+
+func TestDiscard(t *testing.T) {
+	l := Discard.With("peer", "192.0.2.1:6881")
+	l.Errorf("dropped")
+	assert.Equal(t, Discard, l)
+}
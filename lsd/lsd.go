@@ -0,0 +1,407 @@
+// Package lsd finds peers on the local network with Local Service Discovery
+// (BEP 14), by announcing torrents to a multicast group and listening for
+// other peers' announces.
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/veggiedefender/torrent-client/logger"
+	"github.com/veggiedefender/torrent-client/peers"
+)
+
+// IPv4Group and IPv6Group are the multicast groups LSD announces are sent to
+var (
+	IPv4Group = &net.UDPAddr{IP: net.IPv4(239, 192, 152, 143), Port: 6771}
+	IPv6Group = &net.UDPAddr{IP: net.ParseIP("ff15::efc0:988f"), Port: 6771}
+)
+
+// minAnnounceInterval is how often a torrent may be announced at most, as
+// asked by BEP 14
+const minAnnounceInterval = time.Minute
+
+// defaultAnnounceInterval is how often each torrent is announced again, as
+// BEP 14 suggests
+const defaultAnnounceInterval = 5 * time.Minute
+
+// announceTTL is how long a torrent keeps being announced after the last
+// call to Announce or FindPeers for it. Downloads look for peers more often
+// than this while they run.
+const announceTTL = 20 * time.Minute
+
+// peerTTL is how long a peer is remembered after its last announce. Peers
+// announce every five minutes or so.
+const peerTTL = 15 * time.Minute
+
+// A Socket is a connection to send announces to a multicast group from, and
+// to read other peers' announces on
+type Socket struct {
+	Conn  net.PacketConn
+	Group *net.UDPAddr
+}
+
+// Config configures a Service. The zero value joins both multicast groups.
+type Config struct {
+	// Sockets are the connections to use. If it is nil, New joins IPv4Group
+	// and IPv6Group on the default interface, skipping a group it can't join.
+	Sockets []Socket
+	// Wait is how long FindPeers waits after announcing for other peers to
+	// announce back. It defaults to two seconds.
+	Wait time.Duration
+	// AnnounceInterval is how often torrents are announced again while they
+	// are being looked up. It defaults to five minutes.
+	AnnounceInterval time.Duration
+	// Logger receives the service's log messages
+	Logger logger.Logger
+}
+
+// announcing is a torrent the service keeps announcing
+type announcing struct {
+	port uint16
+	last time.Time
+	// until is when to stop announcing the torrent
+	until time.Time
+}
+
+type announcedPeer struct {
+	peer    peers.Peer
+	expires time.Time
+}
+
+// A Service announces torrents on the local network and remembers the peers
+// that announce theirs
+type Service struct {
+	cfg     Config
+	sockets []Socket
+	log     logger.Logger
+	// cookie tells our own announces apart when the group sends them back
+	cookie string
+
+	mu        sync.Mutex
+	found     map[[20]byte]map[string]announcedPeer
+	announced map[[20]byte]*announcing
+	// heard is closed and replaced whenever a peer announces
+	heard chan struct{}
+
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+// New starts listening for announces
+func New(cfg Config) (*Service, error) {
+	s := &Service{
+		cfg:       cfg,
+		log:       cfg.Logger,
+		found:     make(map[[20]byte]map[string]announcedPeer),
+		announced: make(map[[20]byte]*announcing),
+		heard:     make(chan struct{}),
+		closed:    make(chan struct{}),
+	}
+	if s.log == nil {
+		s.log = logger.Discard
+	}
+	if s.cfg.Wait == 0 {
+		s.cfg.Wait = 2 * time.Second
+	}
+	if s.cfg.AnnounceInterval == 0 {
+		s.cfg.AnnounceInterval = defaultAnnounceInterval
+	}
+	cookie := make([]byte, 8)
+	_, err := rand.Read(cookie)
+	if err != nil {
+		return nil, err
+	}
+	s.cookie = hex.EncodeToString(cookie)
+
+	s.sockets = cfg.Sockets
+	if s.sockets == nil {
+		for _, group := range []*net.UDPAddr{IPv4Group, IPv6Group} {
+			network := "udp4"
+			if group.IP.To4() == nil {
+				network = "udp6"
+			}
+			conn, err := net.ListenMulticastUDP(network, nil, group)
+			if err != nil {
+				s.log.Warnf("Could not join %s: %s", group, err)
+				continue
+			}
+			s.sockets = append(s.sockets, Socket{Conn: conn, Group: group})
+		}
+		if len(s.sockets) == 0 {
+			return nil, fmt.Errorf("Could not join any LSD multicast group")
+		}
+	}
+
+	for _, sock := range s.sockets {
+		s.wg.Add(1)
+		go s.readLoop(sock.Conn)
+	}
+	s.wg.Add(1)
+	go s.announceLoop()
+	return s, nil
+}
+
+// Close stops the service and closes its sockets
+func (s *Service) Close() error {
+	select {
+	case <-s.closed:
+		return nil
+	default:
+	}
+	close(s.closed)
+	var err error
+	for _, sock := range s.sockets {
+		if closeErr := sock.Conn.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	s.wg.Wait()
+	return err
+}
+
+// Announce tells the local network that we accept connections for infoHash
+// on port, and keeps telling it every AnnounceInterval for a while. Announces
+// more frequent than once a minute per torrent are skipped.
+func (s *Service) Announce(infoHash [20]byte, port uint16) error {
+	now := time.Now()
+	s.mu.Lock()
+	a := s.announced[infoHash]
+	if a == nil {
+		a = &announcing{}
+		s.announced[infoHash] = a
+	}
+	a.port = port
+	a.until = now.Add(announceTTL)
+	if now.Sub(a.last) < minAnnounceInterval {
+		s.mu.Unlock()
+		return nil
+	}
+	a.last = now
+	s.mu.Unlock()
+	return s.send(infoHash, port)
+}
+
+// send announces infoHash on every socket
+func (s *Service) send(infoHash [20]byte, port uint16) error {
+	var err error
+	sent := 0
+	for _, sock := range s.sockets {
+		msg := formatAnnounce(sock.Group, port, [][20]byte{infoHash}, s.cookie)
+		_, writeErr := sock.Conn.WriteTo(msg, sock.Group)
+		if writeErr != nil {
+			err = writeErr
+			continue
+		}
+		sent++
+	}
+	if sent == 0 {
+		return err
+	}
+	return nil
+}
+
+// announceLoop announces torrents again once their interval is up, and
+// forgets those nobody has looked up in a while
+func (s *Service) announceLoop() {
+	defer s.wg.Done()
+	// Checking more often than the interval keeps torrents announced at
+	// different times from drifting late
+	ticker := time.NewTicker(s.cfg.AnnounceInterval / 5)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.closed:
+			return
+		}
+		now := time.Now()
+		due := make(map[[20]byte]uint16)
+		s.mu.Lock()
+		for infoHash, a := range s.announced {
+			if now.After(a.until) {
+				delete(s.announced, infoHash)
+				continue
+			}
+			if now.Sub(a.last) >= s.cfg.AnnounceInterval {
+				a.last = now
+				due[infoHash] = a.port
+			}
+		}
+		s.mu.Unlock()
+		for infoHash, port := range due {
+			err := s.send(infoHash, port)
+			if err != nil {
+				s.log.Debugf("Could not announce %x: %s", infoHash, err)
+			}
+		}
+	}
+}
+
+// Peers returns the peers on the local network that announced infoHash
+func (s *Service) Peers(infoHash [20]byte) []peers.Peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var found []peers.Peer
+	for key, a := range s.found[infoHash] {
+		if now.After(a.expires) {
+			delete(s.found[infoHash], key)
+			continue
+		}
+		found = append(found, a.peer)
+	}
+	return found
+}
+
+// FindPeers announces infoHash and returns the peers that announced it, after
+// waiting a moment for any to answer if none are known. It satisfies
+// p2p.PeerSource.
+func (s *Service) FindPeers(ctx context.Context, infoHash [20]byte, port uint16) ([]peers.Peer, error) {
+	err := s.Announce(infoHash, port)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := time.NewTimer(s.cfg.Wait)
+	defer timeout.Stop()
+	for {
+		s.mu.Lock()
+		heard := s.heard
+		s.mu.Unlock()
+		if found := s.Peers(infoHash); len(found) > 0 {
+			return found, nil
+		}
+		select {
+		case <-heard:
+		case <-timeout.C:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-s.closed:
+			return nil, fmt.Errorf("LSD service is closed")
+		}
+	}
+}
+
+func (s *Service) readLoop(conn net.PacketConn) {
+	defer s.wg.Done()
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.closed:
+			default:
+				s.log.Errorf("Stopped reading announces: %s", err)
+			}
+			return
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		a, err := parseAnnounce(buf[:n])
+		if err != nil {
+			s.log.Debugf("Ignoring announce from %s: %s", addr, err)
+			continue
+		}
+		if a.cookie == s.cookie {
+			continue
+		}
+		ip := udpAddr.IP
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		s.record(peers.Peer{IP: ip, Port: a.port}, a.infoHashes)
+	}
+}
+
+func (s *Service) record(peer peers.Peer, infoHashes [][20]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expires := time.Now().Add(peerTTL)
+	for _, infoHash := range infoHashes {
+		if s.found[infoHash] == nil {
+			s.found[infoHash] = make(map[string]announcedPeer)
+		}
+		s.found[infoHash][peer.String()] = announcedPeer{peer, expires}
+	}
+	close(s.heard)
+	s.heard = make(chan struct{})
+}
+
+type announce struct {
+	port       uint16
+	infoHashes [][20]byte
+	cookie     string
+}
+
+func formatAnnounce(group *net.UDPAddr, port uint16, infoHashes [][20]byte, cookie string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(&buf, "Host: %s\r\n", group)
+	fmt.Fprintf(&buf, "Port: %d\r\n", port)
+	for _, infoHash := range infoHashes {
+		fmt.Fprintf(&buf, "Infohash: %x\r\n", infoHash)
+	}
+	if cookie != "" {
+		fmt.Fprintf(&buf, "cookie: %s\r\n", cookie)
+	}
+	buf.WriteString("\r\n\r\n")
+	return buf.Bytes()
+}
+
+func parseAnnounce(buf []byte) (*announce, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	if !scanner.Scan() || strings.TrimSpace(scanner.Text()) != "BT-SEARCH * HTTP/1.1" {
+		return nil, fmt.Errorf("Not a BT-SEARCH message")
+	}
+
+	a := &announce{}
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			break
+		}
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			return nil, fmt.Errorf("Malformed header %q", line)
+		}
+		value := strings.TrimSpace(line[colon+1:])
+		switch strings.ToLower(line[:colon]) {
+		case "port":
+			port, err := strconv.ParseUint(value, 10, 16)
+			if err != nil || port == 0 {
+				return nil, fmt.Errorf("Invalid port %q", value)
+			}
+			a.port = uint16(port)
+		case "infohash":
+			var infoHash [20]byte
+			decoded, err := hex.DecodeString(value)
+			if err != nil || len(decoded) != len(infoHash) {
+				return nil, fmt.Errorf("Invalid infohash %q", value)
+			}
+			copy(infoHash[:], decoded)
+			a.infoHashes = append(a.infoHashes, infoHash)
+		case "cookie":
+			a.cookie = value
+		}
+	}
+	if a.port == 0 {
+		return nil, fmt.Errorf("Missing port")
+	}
+	if len(a.infoHashes) == 0 {
+		return nil, fmt.Errorf("Missing infohash")
+	}
+	return a, nil
+}
@@ -0,0 +1,123 @@
+package lsd
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/torrent-client/peers"
+)
+
+func TestFormatAndParseAnnounce(t *testing.T) {
+	infoHash := [20]byte{0xde, 0xad, 0xbe, 0xef}
+	msg := formatAnnounce(IPv4Group, 6881, [][20]byte{infoHash}, "abc")
+	assert.Equal(t, "BT-SEARCH * HTTP/1.1\r\n"+
+		"Host: 239.192.152.143:6771\r\n"+
+		"Port: 6881\r\n"+
+		"Infohash: deadbeef00000000000000000000000000000000\r\n"+
+		"cookie: abc\r\n"+
+		"\r\n\r\n", string(msg))
+
+	a, err := parseAnnounce(msg)
+	require.Nil(t, err)
+	assert.Equal(t, &announce{port: 6881, infoHashes: [][20]byte{infoHash}, cookie: "abc"}, a)
+
+	assert.Contains(t, string(formatAnnounce(IPv6Group, 1, nil, "")), "Host: [ff15::efc0:988f]:6771\r\n")
+}
+
+func TestParseAnnounceMalformed(t *testing.T) {
+	tests := map[string]string{
+		"wrong method":     "NOTIFY * HTTP/1.1\r\nPort: 1\r\nInfohash: deadbeef00000000000000000000000000000000\r\n\r\n",
+		"missing port":     "BT-SEARCH * HTTP/1.1\r\nInfohash: deadbeef00000000000000000000000000000000\r\n\r\n",
+		"bad port":         "BT-SEARCH * HTTP/1.1\r\nPort: 70000\r\nInfohash: deadbeef00000000000000000000000000000000\r\n\r\n",
+		"missing infohash": "BT-SEARCH * HTTP/1.1\r\nPort: 1\r\n\r\n",
+		"short infohash":   "BT-SEARCH * HTTP/1.1\r\nPort: 1\r\nInfohash: deadbeef\r\n\r\n",
+		"malformed header": "BT-SEARCH * HTTP/1.1\r\nPort 1\r\n\r\n",
+		"empty":            "",
+	}
+	for name, msg := range tests {
+		_, err := parseAnnounce([]byte(msg))
+		assert.NotNil(t, err, name)
+	}
+}
+
+// startPair starts two services configured as cfg on loopback, which send
+// their announces to each other in place of a multicast group
+func startPair(t *testing.T, cfg Config) (*Service, *Service) {
+	connA, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	connB, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	cfg.Sockets = []Socket{{Conn: connA, Group: connB.LocalAddr().(*net.UDPAddr)}}
+	a, err := New(cfg)
+	require.Nil(t, err)
+	cfg.Sockets = []Socket{{Conn: connB, Group: connA.LocalAddr().(*net.UDPAddr)}}
+	b, err := New(cfg)
+	require.Nil(t, err)
+	return a, b
+}
+
+func TestFindPeers(t *testing.T) {
+	a, b := startPair(t, Config{})
+	defer a.Close()
+	defer b.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	infoHash := [20]byte{1, 2, 3}
+
+	// Nobody announced yet, so a only gets to tell b about itself
+	a.cfg.Wait = 100 * time.Millisecond
+	found, err := a.FindPeers(ctx, infoHash, 7000)
+	require.Nil(t, err)
+	assert.Empty(t, found)
+
+	found, err = b.FindPeers(ctx, infoHash, 8000)
+	require.Nil(t, err)
+	assert.Equal(t, []peers.Peer{{IP: net.IP{127, 0, 0, 1}, Port: 7000}}, found)
+
+	// b's announce reached a as well
+	found, err = a.FindPeers(ctx, infoHash, 7000)
+	require.Nil(t, err)
+	assert.Equal(t, []peers.Peer{{IP: net.IP{127, 0, 0, 1}, Port: 8000}}, found)
+}
+
+func TestAnnouncesAgain(t *testing.T) {
+	a, b := startPair(t, Config{AnnounceInterval: 50 * time.Millisecond})
+	defer a.Close()
+	defer b.Close()
+
+	infoHash := [20]byte{1, 2, 3}
+	require.Nil(t, a.Announce(infoHash, 7000))
+	for i := 0; len(b.Peers(infoHash)) == 0; i++ {
+		require.True(t, i < 100, "first announce never arrived")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// b forgets a, and hears of it again without a being asked to announce
+	b.mu.Lock()
+	delete(b.found, infoHash)
+	b.mu.Unlock()
+	for i := 0; len(b.Peers(infoHash)) == 0; i++ {
+		require.True(t, i < 100, "announce was never repeated")
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestIgnoresOwnAnnounces(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	// Announces loop back to the sender, like multicast does
+	s, err := New(Config{
+		Sockets: []Socket{{Conn: conn, Group: conn.LocalAddr().(*net.UDPAddr)}},
+		Wait:    100 * time.Millisecond,
+	})
+	require.Nil(t, err)
+	defer s.Close()
+
+	found, err := s.FindPeers(context.Background(), [20]byte{1}, 7000)
+	require.Nil(t, err)
+	assert.Empty(t, found)
+}
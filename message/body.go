@@ -0,0 +1,233 @@
+package message
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// A Body is the decoded payload of a message. Each message ID has its own
+// Body type, and Message encodes it back into a message with that ID.
+type Body interface {
+	Message() *Message
+}
+
+// Choke is the body of a CHOKE message
+type Choke struct{}
+
+// Unchoke is the body of an UNCHOKE message
+type Unchoke struct{}
+
+// Interested is the body of an INTERESTED message
+type Interested struct{}
+
+// NotInterested is the body of a NOT INTERESTED message
+type NotInterested struct{}
+
+// Have is the body of a HAVE message
+type Have struct {
+	Index int
+}
+
+// Bitfield is the body of a BITFIELD message
+type Bitfield struct {
+	Bits []byte
+}
+
+// Request is the body of a REQUEST message
+type Request struct {
+	Index  int
+	Begin  int
+	Length int
+}
+
+// Piece is the body of a PIECE message
+type Piece struct {
+	Index int
+	Begin int
+	Block []byte
+}
+
+// Cancel is the body of a CANCEL message
+type Cancel struct {
+	Index  int
+	Begin  int
+	Length int
+}
+
+// Port is the body of a PORT message, which gives the port of the sender's
+// DHT node
+type Port struct {
+	Port uint16
+}
+
+// SuggestPiece is the body of a SUGGEST PIECE message
+type SuggestPiece struct {
+	Index int
+}
+
+// HaveAll is the body of a HAVE ALL message
+type HaveAll struct{}
+
+// HaveNone is the body of a HAVE NONE message
+type HaveNone struct{}
+
+// RejectRequest is the body of a REJECT REQUEST message
+type RejectRequest struct {
+	Index  int
+	Begin  int
+	Length int
+}
+
+// AllowedFast is the body of an ALLOWED FAST message
+type AllowedFast struct {
+	Index int
+}
+
+// Extended is the body of an EXTENDED message
+type Extended struct {
+	ExtID   uint8
+	Payload []byte
+}
+
+// Message encodes a CHOKE message
+func (Choke) Message() *Message { return &Message{ID: MsgChoke} }
+
+// Message encodes an UNCHOKE message
+func (Unchoke) Message() *Message { return &Message{ID: MsgUnchoke} }
+
+// Message encodes an INTERESTED message
+func (Interested) Message() *Message { return &Message{ID: MsgInterested} }
+
+// Message encodes a NOT INTERESTED message
+func (NotInterested) Message() *Message { return &Message{ID: MsgNotInterested} }
+
+// Message encodes a HAVE message
+func (b Have) Message() *Message { return FormatHave(b.Index) }
+
+// Message encodes a BITFIELD message
+func (b Bitfield) Message() *Message { return FormatBitfield(b.Bits) }
+
+// Message encodes a REQUEST message
+func (b Request) Message() *Message { return FormatRequest(b.Index, b.Begin, b.Length) }
+
+// Message encodes a PIECE message
+func (b Piece) Message() *Message { return FormatPiece(b.Index, b.Begin, b.Block) }
+
+// Message encodes a CANCEL message
+func (b Cancel) Message() *Message { return FormatCancel(b.Index, b.Begin, b.Length) }
+
+// Message encodes a PORT message
+func (b Port) Message() *Message { return FormatPort(b.Port) }
+
+// Message encodes a SUGGEST PIECE message
+func (b SuggestPiece) Message() *Message { return formatIndex(MsgSuggestPiece, b.Index) }
+
+// Message encodes a HAVE ALL message
+func (HaveAll) Message() *Message { return &Message{ID: MsgHaveAll} }
+
+// Message encodes a HAVE NONE message
+func (HaveNone) Message() *Message { return &Message{ID: MsgHaveNone} }
+
+// Message encodes a REJECT REQUEST message
+func (b RejectRequest) Message() *Message {
+	return FormatRejectRequest(b.Index, b.Begin, b.Length)
+}
+
+// Message encodes an ALLOWED FAST message
+func (b AllowedFast) Message() *Message { return formatIndex(MsgAllowedFast, b.Index) }
+
+// Message encodes an EXTENDED message
+func (b Extended) Message() *Message { return FormatExtended(b.ExtID, b.Payload) }
+
+// payloadLengths gives the exact payload length of messages that have one
+var payloadLengths = map[messageID]int{
+	MsgChoke:         0,
+	MsgUnchoke:       0,
+	MsgInterested:    0,
+	MsgNotInterested: 0,
+	MsgHave:          4,
+	MsgRequest:       12,
+	MsgCancel:        12,
+	MsgPort:          2,
+	MsgSuggestPiece:  4,
+	MsgHaveAll:       0,
+	MsgHaveNone:      0,
+	MsgRejectRequest: 12,
+	MsgAllowedFast:   4,
+}
+
+// Validate checks that the message's payload has the right length for its
+// ID. Messages with unknown IDs are always valid.
+func (m *Message) Validate() error {
+	if m == nil {
+		return nil
+	}
+	if length, ok := payloadLengths[m.ID]; ok && len(m.Payload) != length {
+		return fmt.Errorf("Expected %s payload length %d, got length %d", m.name(), length, len(m.Payload))
+	}
+	switch m.ID {
+	case MsgPiece:
+		if len(m.Payload) < 8 {
+			return fmt.Errorf("Payload too short. %d < 8", len(m.Payload))
+		}
+	case MsgExtended:
+		if len(m.Payload) < 1 {
+			return fmt.Errorf("Payload too short. %d < 1", len(m.Payload))
+		}
+	}
+	return nil
+}
+
+// Decode validates a message and decodes its payload into the Body type for
+// its ID. The body shares memory with the message's payload.
+func Decode(m *Message) (Body, error) {
+	if m == nil {
+		return nil, fmt.Errorf("Keep-alive messages have no body")
+	}
+	err := m.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	p := m.Payload
+	switch m.ID {
+	case MsgChoke:
+		return Choke{}, nil
+	case MsgUnchoke:
+		return Unchoke{}, nil
+	case MsgInterested:
+		return Interested{}, nil
+	case MsgNotInterested:
+		return NotInterested{}, nil
+	case MsgHave:
+		return Have{Index: readInt(p[0:4])}, nil
+	case MsgBitfield:
+		return Bitfield{Bits: p}, nil
+	case MsgRequest:
+		return Request{readInt(p[0:4]), readInt(p[4:8]), readInt(p[8:12])}, nil
+	case MsgPiece:
+		return Piece{readInt(p[0:4]), readInt(p[4:8]), p[8:]}, nil
+	case MsgCancel:
+		return Cancel{readInt(p[0:4]), readInt(p[4:8]), readInt(p[8:12])}, nil
+	case MsgPort:
+		return Port{Port: binary.BigEndian.Uint16(p)}, nil
+	case MsgSuggestPiece:
+		return SuggestPiece{Index: readInt(p[0:4])}, nil
+	case MsgHaveAll:
+		return HaveAll{}, nil
+	case MsgHaveNone:
+		return HaveNone{}, nil
+	case MsgRejectRequest:
+		return RejectRequest{readInt(p[0:4]), readInt(p[4:8]), readInt(p[8:12])}, nil
+	case MsgAllowedFast:
+		return AllowedFast{Index: readInt(p[0:4])}, nil
+	case MsgExtended:
+		return Extended{ExtID: p[0], Payload: p[1:]}, nil
+	default:
+		return nil, fmt.Errorf("Unknown message ID %d", m.ID)
+	}
+}
+
+func readInt(buf []byte) int {
+	return int(binary.BigEndian.Uint32(buf))
+}
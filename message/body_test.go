@@ -0,0 +1,77 @@
+package message
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBodyRoundTrip(t *testing.T) {
+	bodies := []Body{
+		Choke{},
+		Unchoke{},
+		Interested{},
+		NotInterested{},
+		Have{Index: 7},
+		Bitfield{Bits: []byte{0xf0, 0x01}},
+		Request{Index: 1, Begin: 16384, Length: 16384},
+		Piece{Index: 1, Begin: 16384, Block: []byte{1, 2, 3}},
+		Cancel{Index: 1, Begin: 16384, Length: 16384},
+		Port{Port: 6881},
+		SuggestPiece{Index: 3},
+		HaveAll{},
+		HaveNone{},
+		RejectRequest{Index: 2, Begin: 0, Length: 100},
+		AllowedFast{Index: 4},
+		Extended{ExtID: 1, Payload: []byte("de")},
+	}
+
+	for _, body := range bodies {
+		msg, err := Read(bytes.NewReader(body.Message().Serialize()))
+		require.Nil(t, err)
+		decoded, err := Decode(msg)
+		require.Nil(t, err, "%T", body)
+		assert.Equal(t, body, decoded)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := map[string]struct {
+		input *Message
+		fails bool
+	}{
+		"valid have":         {&Message{ID: MsgHave, Payload: []byte{0, 0, 0, 1}}, false},
+		"short have":         {&Message{ID: MsgHave, Payload: []byte{0, 0, 1}}, true},
+		"choke with payload": {&Message{ID: MsgChoke, Payload: []byte{1}}, true},
+		"long request":       {&Message{ID: MsgRequest, Payload: make([]byte, 13)}, true},
+		"short cancel":       {&Message{ID: MsgCancel, Payload: make([]byte, 11)}, true},
+		"short port":         {&Message{ID: MsgPort, Payload: []byte{1}}, true},
+		"empty piece block":  {&Message{ID: MsgPiece, Payload: make([]byte, 8)}, false},
+		"short piece":        {&Message{ID: MsgPiece, Payload: make([]byte, 7)}, true},
+		"empty bitfield":     {&Message{ID: MsgBitfield}, false},
+		"empty extended":     {&Message{ID: MsgExtended}, true},
+		"have all payload":   {&Message{ID: MsgHaveAll, Payload: []byte{1}}, true},
+		"unknown":            {&Message{ID: 99, Payload: []byte{1, 2, 3}}, false},
+		"keep-alive":         {nil, false},
+	}
+
+	for name, test := range tests {
+		err := test.input.Validate()
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	_, err := Decode(nil)
+	assert.NotNil(t, err)
+	_, err = Decode(&Message{ID: MsgHave, Payload: []byte{1}})
+	assert.NotNil(t, err)
+	_, err = Decode(&Message{ID: 99})
+	assert.NotNil(t, err)
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"sync"
 )
 
 type messageID uint8
@@ -27,6 +28,21 @@ const (
 	MsgPiece messageID = 7
 	// MsgCancel cancels a request
 	MsgCancel messageID = 8
+	// MsgPort gives the port of the sender's DHT node
+	MsgPort messageID = 9
+	// MsgSuggestPiece suggests a piece the receiver could download (BEP 6)
+	MsgSuggestPiece messageID = 13
+	// MsgHaveAll takes the place of a bitfield with every piece set (BEP 6)
+	MsgHaveAll messageID = 14
+	// MsgHaveNone takes the place of a bitfield with no piece set (BEP 6)
+	MsgHaveNone messageID = 15
+	// MsgRejectRequest tells the receiver a request won't be answered (BEP 6)
+	MsgRejectRequest messageID = 16
+	// MsgAllowedFast lets the receiver request a piece even while choked
+	// (BEP 6)
+	MsgAllowedFast messageID = 17
+	// MsgExtended carries a message of the extension protocol (BEP 10)
+	MsgExtended messageID = 20
 )
 
 // Message stores ID and payload of a message
@@ -46,9 +62,72 @@ func FormatRequest(index, begin, length int) *Message {
 
 // FormatHave creates a HAVE message
 func FormatHave(index int) *Message {
+	return formatIndex(MsgHave, index)
+}
+
+// formatIndex creates a message whose payload is a piece index
+func formatIndex(id messageID, index int) *Message {
 	payload := make([]byte, 4)
 	binary.BigEndian.PutUint32(payload, uint32(index))
-	return &Message{ID: MsgHave, Payload: payload}
+	return &Message{ID: id, Payload: payload}
+}
+
+// FormatBitfield creates a BITFIELD message
+func FormatBitfield(bf []byte) *Message {
+	payload := make([]byte, len(bf))
+	copy(payload, bf)
+	return &Message{ID: MsgBitfield, Payload: payload}
+}
+
+// FormatPiece creates a PIECE message carrying a block of a piece
+func FormatPiece(index, begin int, block []byte) *Message {
+	payload := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], block)
+	return &Message{ID: MsgPiece, Payload: payload}
+}
+
+// FormatCancel creates a CANCEL message for a request
+func FormatCancel(index, begin, length int) *Message {
+	msg := FormatRequest(index, begin, length)
+	msg.ID = MsgCancel
+	return msg
+}
+
+// FormatPort creates a PORT message
+func FormatPort(port uint16) *Message {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, port)
+	return &Message{ID: MsgPort, Payload: payload}
+}
+
+// FormatRejectRequest creates a REJECT REQUEST message for a request
+func FormatRejectRequest(index, begin, length int) *Message {
+	msg := FormatRequest(index, begin, length)
+	msg.ID = MsgRejectRequest
+	return msg
+}
+
+// FormatExtended creates an EXTENDED message for the extension message with
+// the given ID. ID 0 is the extension handshake.
+func FormatExtended(extID uint8, payload []byte) *Message {
+	buf := make([]byte, 1+len(payload))
+	buf[0] = extID
+	copy(buf[1:], payload)
+	return &Message{ID: MsgExtended, Payload: buf}
+}
+
+// ParseExtended parses an EXTENDED message into its extension message ID and
+// payload
+func ParseExtended(msg *Message) (uint8, []byte, error) {
+	if msg.ID != MsgExtended {
+		return 0, nil, fmt.Errorf("Expected EXTENDED (ID %d), got ID %d", MsgExtended, msg.ID)
+	}
+	if len(msg.Payload) < 1 {
+		return 0, nil, fmt.Errorf("Payload too short. %d < 1", len(msg.Payload))
+	}
+	return msg.Payload[0], msg.Payload[1:], nil
 }
 
 // ParsePiece parses a PIECE message and copies its payload into a buffer
@@ -87,6 +166,58 @@ func ParseHave(msg *Message) (int, error) {
 	return index, nil
 }
 
+// ParseRequest parses a REQUEST or REJECT REQUEST message
+func ParseRequest(msg *Message) (index, begin, length int, err error) {
+	if msg.ID != MsgRequest && msg.ID != MsgRejectRequest {
+		return 0, 0, 0, fmt.Errorf("Expected REQUEST (ID %d) or REJECT REQUEST (ID %d), got ID %d", MsgRequest, MsgRejectRequest, msg.ID)
+	}
+	return parseBlockRange(msg)
+}
+
+// ParseCancel parses a CANCEL message
+func ParseCancel(msg *Message) (index, begin, length int, err error) {
+	if msg.ID != MsgCancel {
+		return 0, 0, 0, fmt.Errorf("Expected CANCEL (ID %d), got ID %d", MsgCancel, msg.ID)
+	}
+	return parseBlockRange(msg)
+}
+
+// ParsePort parses a PORT message
+func ParsePort(msg *Message) (uint16, error) {
+	if msg.ID != MsgPort {
+		return 0, fmt.Errorf("Expected PORT (ID %d), got ID %d", MsgPort, msg.ID)
+	}
+	if len(msg.Payload) != 2 {
+		return 0, fmt.Errorf("Expected payload length 2, got length %d", len(msg.Payload))
+	}
+	return binary.BigEndian.Uint16(msg.Payload), nil
+}
+
+// parseBlockRange parses the index, begin and length that REQUEST, CANCEL
+// and REJECT REQUEST messages carry
+func parseBlockRange(msg *Message) (index, begin, length int, err error) {
+	if len(msg.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("Expected payload length 12, got length %d", len(msg.Payload))
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+	return index, begin, length, nil
+}
+
+// ParseAllowedFast parses an ALLOWED FAST or SUGGEST PIECE message, which
+// carry a piece index like HAVE
+func ParseAllowedFast(msg *Message) (int, error) {
+	if msg.ID != MsgAllowedFast && msg.ID != MsgSuggestPiece {
+		return 0, fmt.Errorf("Expected ALLOWED FAST (ID %d) or SUGGEST PIECE (ID %d), got ID %d", MsgAllowedFast, MsgSuggestPiece, msg.ID)
+	}
+	if len(msg.Payload) != 4 {
+		return 0, fmt.Errorf("Expected payload length 4, got length %d", len(msg.Payload))
+	}
+	index := int(binary.BigEndian.Uint32(msg.Payload))
+	return index, nil
+}
+
 // Serialize serializes a message into a buffer of the form
 // <length prefix><message ID><payload>
 // Interprets `nil` as a keep-alive message
@@ -102,34 +233,110 @@ func (m *Message) Serialize() []byte {
 	return buf
 }
 
+// MaxBlockSize is the largest block that peers are expected to send in a
+// PIECE message
+const MaxBlockSize = 16384
+
+// DefaultMaxLength is the longest message Read accepts. It fits a block, or
+// the bitfield of a torrent with over a million pieces.
+const DefaultMaxLength = 1 << 17
+
+// extendedRoom is how much longer than a block we let extension messages be,
+// to fit their headers
+const extendedRoom = 1024
+
+// MaxLength returns the longest message a peer should send in a torrent with
+// numPieces pieces, when blocks are at most blockSize bytes: either a block
+// with the headers of a PIECE or extension message, or a bitfield
+func MaxLength(blockSize, numPieces int) int {
+	max := 1 + 8 + blockSize + extendedRoom
+	if bitfield := 1 + (numPieces+7)/8; bitfield > max {
+		max = bitfield
+	}
+	return max
+}
+
+// A TooLongError reports a message longer than a reader accepts. Peers don't
+// send these by mistake, so it is a reason to stop talking to them.
+type TooLongError struct {
+	Length uint32
+	Max    int
+}
+
+func (e *TooLongError) Error() string {
+	return fmt.Sprintf("Message length %d is over the maximum of %d", e.Length, e.Max)
+}
+
+// pooledPayloadSize is the capacity of pooled payload buffers, which fits a
+// PIECE message carrying a full block
+const pooledPayloadSize = 8 + MaxBlockSize
+
+var payloadPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, pooledPayloadSize)
+		return &buf
+	},
+}
+
 // Read parses a message from a stream. Returns `nil` on keep-alive message
 func Read(r io.Reader) (*Message, error) {
-	lengthBuf := make([]byte, 4)
-	_, err := io.ReadFull(r, lengthBuf)
+	return ReadMax(r, DefaultMaxLength)
+}
+
+// ReadMax is like Read, but returns a *TooLongError without reading the
+// message if it is longer than maxLength
+func ReadMax(r io.Reader, maxLength int) (*Message, error) {
+	var lengthBuf [4]byte
+	_, err := io.ReadFull(r, lengthBuf[:])
 	if err != nil {
 		return nil, err
 	}
-	length := binary.BigEndian.Uint32(lengthBuf)
+	length := binary.BigEndian.Uint32(lengthBuf[:])
 
 	// keep-alive message
 	if length == 0 {
 		return nil, nil
 	}
+	if uint64(length) > uint64(maxLength) {
+		return nil, &TooLongError{Length: length, Max: maxLength}
+	}
 
-	messageBuf := make([]byte, length)
-	_, err = io.ReadFull(r, messageBuf)
+	var idBuf [1]byte
+	_, err = io.ReadFull(r, idBuf[:])
+	if err != nil {
+		return nil, err
+	}
+
+	var payload []byte
+	if length-1 <= pooledPayloadSize {
+		payload = (*payloadPool.Get().(*[]byte))[:length-1]
+	} else {
+		payload = make([]byte, length-1)
+	}
+	_, err = io.ReadFull(r, payload)
 	if err != nil {
 		return nil, err
 	}
 
 	m := Message{
-		ID:      messageID(messageBuf[0]),
-		Payload: messageBuf[1:],
+		ID:      messageID(idBuf[0]),
+		Payload: payload,
 	}
 
 	return &m, nil
 }
 
+// Release lets the message's payload be reused by a later Read. Neither the
+// message nor its payload may be used afterwards. Calling it is optional.
+func (m *Message) Release() {
+	if m == nil || cap(m.Payload) != pooledPayloadSize {
+		return
+	}
+	payload := m.Payload[:pooledPayloadSize]
+	m.Payload = nil
+	payloadPool.Put(&payload)
+}
+
 func (m *Message) name() string {
 	if m == nil {
 		return "KeepAlive"
@@ -153,6 +360,20 @@ func (m *Message) name() string {
 		return "Piece"
 	case MsgCancel:
 		return "Cancel"
+	case MsgPort:
+		return "Port"
+	case MsgSuggestPiece:
+		return "SuggestPiece"
+	case MsgHaveAll:
+		return "HaveAll"
+	case MsgHaveNone:
+		return "HaveNone"
+	case MsgRejectRequest:
+		return "RejectRequest"
+	case MsgAllowedFast:
+		return "AllowedFast"
+	case MsgExtended:
+		return "Extended"
 	default:
 		return fmt.Sprintf("Unknown#%d", m.ID)
 	}
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestFormatRequest(t *testing.T) {
@@ -29,6 +30,115 @@ func TestFormatHave(t *testing.T) {
 	assert.Equal(t, expected, msg)
 }
 
+func TestExtended(t *testing.T) {
+	msg := FormatExtended(1, []byte("d5:addedi0ee"))
+	assert.Equal(t, &Message{ID: MsgExtended, Payload: []byte("\x01d5:addedi0ee")}, msg)
+
+	extID, payload, err := ParseExtended(msg)
+	assert.Nil(t, err)
+	assert.Equal(t, uint8(1), extID)
+	assert.Equal(t, []byte("d5:addedi0ee"), payload)
+
+	_, _, err = ParseExtended(&Message{ID: MsgExtended})
+	assert.NotNil(t, err)
+	_, _, err = ParseExtended(&Message{ID: MsgHave, Payload: []byte{1}})
+	assert.NotNil(t, err)
+}
+
+func TestFormatPiece(t *testing.T) {
+	msg := FormatPiece(4, 567, []byte{1, 2, 3})
+	expected := &Message{
+		ID: MsgPiece,
+		Payload: []byte{
+			0x00, 0x00, 0x00, 0x04, // Index
+			0x00, 0x00, 0x02, 0x37, // Begin
+			1, 2, 3, // Block
+		},
+	}
+	assert.Equal(t, expected, msg)
+
+	buf := make([]byte, 570)
+	n, err := ParsePiece(4, buf, msg)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, []byte{1, 2, 3}, buf[567:])
+}
+
+func TestFormatBitfield(t *testing.T) {
+	bf := []byte{0xf0, 0x01}
+	msg := FormatBitfield(bf)
+	assert.Equal(t, &Message{ID: MsgBitfield, Payload: []byte{0xf0, 0x01}}, msg)
+	// The message has its own copy
+	bf[0] = 0
+	assert.Equal(t, byte(0xf0), msg.Payload[0])
+}
+
+func TestCancel(t *testing.T) {
+	msg := FormatCancel(4, 567, 4321)
+	assert.Equal(t, MsgCancel, msg.ID)
+	assert.Equal(t, FormatRequest(4, 567, 4321).Payload, msg.Payload)
+
+	index, begin, length, err := ParseCancel(msg)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{4, 567, 4321}, []int{index, begin, length})
+
+	_, _, _, err = ParseCancel(FormatRequest(4, 567, 4321))
+	assert.NotNil(t, err)
+	_, _, _, err = ParseCancel(&Message{ID: MsgCancel, Payload: []byte{1}})
+	assert.NotNil(t, err)
+}
+
+func TestPort(t *testing.T) {
+	msg := FormatPort(6881)
+	assert.Equal(t, &Message{ID: MsgPort, Payload: []byte{0x1a, 0xe1}}, msg)
+
+	port, err := ParsePort(msg)
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(6881), port)
+
+	_, err = ParsePort(&Message{ID: MsgPort, Payload: []byte{1, 2, 3}})
+	assert.NotNil(t, err)
+	_, err = ParsePort(&Message{ID: MsgHave, Payload: []byte{1, 2}})
+	assert.NotNil(t, err)
+}
+
+func TestRejectRequest(t *testing.T) {
+	msg := FormatRejectRequest(4, 567, 4321)
+	expected := &Message{
+		ID: MsgRejectRequest,
+		Payload: []byte{
+			0x00, 0x00, 0x00, 0x04, // Index
+			0x00, 0x00, 0x02, 0x37, // Begin
+			0x00, 0x00, 0x10, 0xe1, // Length
+		},
+	}
+	assert.Equal(t, expected, msg)
+
+	index, begin, length, err := ParseRequest(msg)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{4, 567, 4321}, []int{index, begin, length})
+
+	_, _, _, err = ParseRequest(&Message{ID: MsgRejectRequest, Payload: []byte{1, 2, 3}})
+	assert.NotNil(t, err)
+	_, _, _, err = ParseRequest(&Message{ID: MsgHave, Payload: make([]byte, 12)})
+	assert.NotNil(t, err)
+}
+
+func TestParseAllowedFast(t *testing.T) {
+	index, err := ParseAllowedFast(&Message{ID: MsgAllowedFast, Payload: []byte{0x00, 0x00, 0x01, 0x04}})
+	assert.Nil(t, err)
+	assert.Equal(t, 260, index)
+
+	index, err = ParseAllowedFast(&Message{ID: MsgSuggestPiece, Payload: []byte{0x00, 0x00, 0x00, 0x02}})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, index)
+
+	_, err = ParseAllowedFast(&Message{ID: MsgAllowedFast, Payload: []byte{1}})
+	assert.NotNil(t, err)
+	_, err = ParseAllowedFast(&Message{ID: MsgHave, Payload: make([]byte, 4)})
+	assert.NotNil(t, err)
+}
+
 func TestParsePiece(t *testing.T) {
 	tests := map[string]struct {
 		inputIndex int
@@ -238,6 +348,43 @@ func TestRead(t *testing.T) {
 	}
 }
 
+func TestReadMax(t *testing.T) {
+	msg, err := ReadMax(bytes.NewReader([]byte{0, 0, 0, 5, 4, 1, 2, 3, 4}), 5)
+	require.Nil(t, err)
+	assert.Equal(t, &Message{ID: MsgHave, Payload: []byte{1, 2, 3, 4}}, msg)
+
+	// A huge length is turned down before anything is allocated for it
+	_, err = ReadMax(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, 7}), 5)
+	assert.Equal(t, &TooLongError{Length: 0xffffffff, Max: 5}, err)
+
+	_, err = Read(bytes.NewReader([]byte{0x00, 0x02, 0x00, 0x01, 7}))
+	assert.IsType(t, &TooLongError{}, err)
+}
+
+func TestMaxLength(t *testing.T) {
+	assert.Equal(t, 1+8+16384+1024, MaxLength(16384, 1000))
+	assert.Equal(t, 1+125000, MaxLength(16384, 1000000))
+}
+
+func TestRelease(t *testing.T) {
+	input := []byte{0, 0, 0, 5, 4, 1, 2, 3, 4}
+	msg, err := Read(bytes.NewReader(input))
+	require.Nil(t, err)
+	msg.Release()
+	assert.Nil(t, msg.Payload)
+
+	msg, err = Read(bytes.NewReader(input))
+	require.Nil(t, err)
+	assert.Equal(t, &Message{ID: MsgHave, Payload: []byte{1, 2, 3, 4}}, msg)
+
+	// Keep-alives and messages that aren't from Read are left alone
+	var keepAlive *Message
+	keepAlive.Release()
+	msg = &Message{ID: MsgHave, Payload: []byte{1, 2, 3, 4}}
+	msg.Release()
+	assert.Equal(t, []byte{1, 2, 3, 4}, msg.Payload)
+}
+
 func TestString(t *testing.T) {
 	tests := []struct {
 		input  *Message
@@ -253,6 +400,13 @@ func TestString(t *testing.T) {
 		{&Message{MsgRequest, []byte{1, 2, 3}}, "Request [3]"},
 		{&Message{MsgPiece, []byte{1, 2, 3}}, "Piece [3]"},
 		{&Message{MsgCancel, []byte{1, 2, 3}}, "Cancel [3]"},
+		{&Message{MsgPort, []byte{1, 2}}, "Port [2]"},
+		{&Message{MsgSuggestPiece, []byte{1, 2, 3}}, "SuggestPiece [3]"},
+		{&Message{MsgHaveAll, []byte{}}, "HaveAll [0]"},
+		{&Message{MsgHaveNone, []byte{}}, "HaveNone [0]"},
+		{&Message{MsgRejectRequest, []byte{1, 2, 3}}, "RejectRequest [3]"},
+		{&Message{MsgAllowedFast, []byte{1, 2, 3}}, "AllowedFast [3]"},
+		{&Message{MsgExtended, []byte{1, 2, 3}}, "Extended [3]"},
 		{&Message{99, []byte{1, 2, 3}}, "Unknown#99 [3]"},
 	}
 
@@ -0,0 +1,426 @@
+// Package mse implements Message Stream Encryption, which hides the
+// BitTorrent handshake and, optionally, the whole connection from anyone
+// watching the network. A Diffie-Hellman key exchange sets up RC4 keys, and
+// both sides then agree on whether to keep using RC4 or carry on in the
+// clear.
+package mse
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+)
+
+// Policy decides whether connections are encrypted
+type Policy int
+
+const (
+	// Disabled never uses encryption, and turns away peers that do
+	Disabled Policy = iota
+	// Prefer tries encryption first, but falls back to plaintext for peers
+	// that don't support it
+	Prefer
+	// Require only talks to peers over encrypted connections
+	Require
+)
+
+func (p Policy) String() string {
+	switch p {
+	case Disabled:
+		return "Disabled"
+	case Prefer:
+		return "Prefer"
+	case Require:
+		return "Require"
+	default:
+		return "Unknown"
+	}
+}
+
+// Crypto methods offered in crypto_provide and chosen in crypto_select
+const (
+	CryptoPlaintext uint32 = 0x01
+	CryptoRC4       uint32 = 0x02
+)
+
+// methods returns the crypto methods a policy allows
+func (p Policy) methods() uint32 {
+	switch p {
+	case Disabled:
+		return CryptoPlaintext
+	case Require:
+		return CryptoRC4
+	default:
+		return CryptoPlaintext | CryptoRC4
+	}
+}
+
+// maxPadding is the most random padding either side may send
+const maxPadding = 512
+
+// keyLength is the length of a public key and the shared secret
+const keyLength = 96
+
+var (
+	prime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	generator = big.NewInt(2)
+)
+
+// verificationConstant is sent encrypted so the other side can find where
+// the padding ends
+var verificationConstant = make([]byte, 8)
+
+// A Conn is a connection that went through the encryption handshake. It
+// encrypts and decrypts with RC4 if that was the method agreed on.
+type Conn struct {
+	net.Conn
+	// Method is the crypto method the two sides agreed on
+	Method uint32
+
+	r       io.Reader
+	writeMu sync.Mutex
+	enc     *rc4.Cipher
+}
+
+// Read reads decrypted data from the connection
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// Write encrypts p and writes it to the connection
+func (c *Conn) Write(p []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(p)
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	buf := make([]byte, len(p))
+	c.enc.XORKeyStream(buf, p)
+	return c.Conn.Write(buf)
+}
+
+// A cipherReader decrypts everything read through it
+type cipherReader struct {
+	r      io.Reader
+	cipher *rc4.Cipher
+}
+
+func (r *cipherReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.cipher.XORKeyStream(p[:n], p[:n])
+	return n, err
+}
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+// newCipher returns an RC4 cipher keyed for one direction of the stream,
+// having discarded the first kilobyte of keystream as the spec asks
+func newCipher(name string, secret []byte, skey [20]byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(hash([]byte(name), secret, skey[:]))
+	discard := make([]byte, 1024)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+// newKeyPair makes a private key and the public key to send
+func newKeyPair() (*big.Int, []byte, error) {
+	buf := make([]byte, 20)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	private := new(big.Int).SetBytes(buf)
+	public := new(big.Int).Exp(generator, private, prime)
+	return private, padKey(public), nil
+}
+
+// sharedSecret combines our private key with the other side's public key
+func sharedSecret(private *big.Int, public []byte) []byte {
+	y := new(big.Int).SetBytes(public)
+	return padKey(new(big.Int).Exp(y, private, prime))
+}
+
+// padKey writes a key as exactly keyLength big-endian bytes
+func padKey(n *big.Int) []byte {
+	buf := make([]byte, keyLength)
+	b := n.Bytes()
+	copy(buf[keyLength-len(b):], b)
+	return buf
+}
+
+// randomPadding returns up to maxPadding random bytes
+func randomPadding() ([]byte, error) {
+	var n [2]byte
+	_, err := rand.Read(n[:])
+	if err != nil {
+		return nil, err
+	}
+	pad := make([]byte, int(binary.BigEndian.Uint16(n[:]))%(maxPadding+1))
+	_, err = rand.Read(pad)
+	return pad, err
+}
+
+// synchronize reads from r up to and including pattern, which must start
+// within max bytes
+func synchronize(r io.Reader, pattern []byte, max int) error {
+	buf := make([]byte, len(pattern), len(pattern)+max)
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return err
+	}
+	for !bytes.Equal(buf[len(buf)-len(pattern):], pattern) {
+		if len(buf) == cap(buf) {
+			return fmt.Errorf("Could not find the end of the padding")
+		}
+		buf = buf[:len(buf)+1]
+		_, err = io.ReadFull(r, buf[len(buf)-1:])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// selectMethod picks the crypto method to use out of those offered
+func selectMethod(offered, allowed uint32) (uint32, error) {
+	both := offered & allowed
+	switch {
+	case both&CryptoRC4 != 0:
+		return CryptoRC4, nil
+	case both&CryptoPlaintext != 0:
+		return CryptoPlaintext, nil
+	default:
+		return 0, fmt.Errorf("No crypto method in common: offered %#x, allowed %#x", offered, allowed)
+	}
+}
+
+// Initiate runs the encryption handshake on a connection we opened to a peer,
+// for the torrent with infoHash. Under the Require policy only RC4 is
+// offered, otherwise plaintext is offered too. The BitTorrent handshake is
+// sent afterwards over the returned Conn.
+func Initiate(conn net.Conn, infoHash [20]byte, policy Policy) (*Conn, error) {
+	private, public, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	pad, err := randomPadding()
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(append(public, pad...))
+	if err != nil {
+		return nil, err
+	}
+
+	theirs := make([]byte, keyLength)
+	_, err = io.ReadFull(conn, theirs)
+	if err != nil {
+		return nil, err
+	}
+	secret := sharedSecret(private, theirs)
+
+	enc := newCipher("keyA", secret, infoHash)
+	req := hash([]byte("req1"), secret)
+	req2 := hash([]byte("req2"), infoHash[:])
+	req3 := hash([]byte("req3"), secret)
+	for i := range req2 {
+		req2[i] ^= req3[i]
+	}
+	req = append(req, req2...)
+	// VC, crypto_provide, len(PadC) and len(IA). We send no padding, and the
+	// BitTorrent handshake follows instead of going in IA.
+	offer := make([]byte, 8+4+2+2)
+	binary.BigEndian.PutUint32(offer[8:12], policy.methods())
+	enc.XORKeyStream(offer, offer)
+	_, err = conn.Write(append(req, offer...))
+	if err != nil {
+		return nil, err
+	}
+
+	// The peer's reply starts with VC encrypted, after up to maxPadding bytes
+	// of padding
+	dec := newCipher("keyB", secret, infoHash)
+	vc := make([]byte, len(verificationConstant))
+	dec.XORKeyStream(vc, verificationConstant)
+	err = synchronize(conn, vc, maxPadding)
+	if err != nil {
+		return nil, err
+	}
+	r := &cipherReader{conn, dec}
+	reply := make([]byte, 4+2)
+	_, err = io.ReadFull(r, reply)
+	if err != nil {
+		return nil, err
+	}
+	method := binary.BigEndian.Uint32(reply[0:4])
+	if method != CryptoRC4 && method != CryptoPlaintext || method&policy.methods() == 0 {
+		return nil, fmt.Errorf("Peer selected crypto method %#x we didn't offer", method)
+	}
+	padLength := int(binary.BigEndian.Uint16(reply[4:6]))
+	if padLength > maxPadding {
+		return nil, fmt.Errorf("Padding too long. %d > %d", padLength, maxPadding)
+	}
+	_, err = io.ReadFull(r, make([]byte, padLength))
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Conn{Conn: conn, Method: method, r: conn}
+	if method == CryptoRC4 {
+		c.r = r
+		c.enc = enc
+	}
+	return c, nil
+}
+
+// Receive runs the encryption handshake on a connection a peer opened to us.
+// skeys returns the infohashes of the torrents the peer may ask for. The
+// returned Conn replays the initial payload the peer sent, if any, before
+// the rest of the stream.
+func Receive(conn net.Conn, skeys [][20]byte, policy Policy) (*Conn, error) {
+	theirs := make([]byte, keyLength)
+	_, err := io.ReadFull(conn, theirs)
+	if err != nil {
+		return nil, err
+	}
+	private, public, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	pad, err := randomPadding()
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(append(public, pad...))
+	if err != nil {
+		return nil, err
+	}
+	secret := sharedSecret(private, theirs)
+
+	err = synchronize(conn, hash([]byte("req1"), secret), maxPadding)
+	if err != nil {
+		return nil, err
+	}
+	req := make([]byte, 20)
+	_, err = io.ReadFull(conn, req)
+	if err != nil {
+		return nil, err
+	}
+	req3 := hash([]byte("req3"), secret)
+	for i := range req {
+		req[i] ^= req3[i]
+	}
+	var skey [20]byte
+	found := false
+	for _, k := range skeys {
+		if bytes.Equal(req, hash([]byte("req2"), k[:])) {
+			skey, found = k, true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("Peer asked for a torrent we don't have")
+	}
+
+	dec := newCipher("keyA", secret, skey)
+	r := &cipherReader{conn, dec}
+	offer := make([]byte, 8+4+2)
+	_, err = io.ReadFull(r, offer)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(offer[0:8], verificationConstant) {
+		return nil, fmt.Errorf("Bad verification constant")
+	}
+	method, err := selectMethod(binary.BigEndian.Uint32(offer[8:12]), policy.methods())
+	if err != nil {
+		return nil, err
+	}
+	padLength := int(binary.BigEndian.Uint16(offer[12:14]))
+	if padLength > maxPadding {
+		return nil, fmt.Errorf("Padding too long. %d > %d", padLength, maxPadding)
+	}
+	_, err = io.ReadFull(r, make([]byte, padLength))
+	if err != nil {
+		return nil, err
+	}
+	var iaLength [2]byte
+	_, err = io.ReadFull(r, iaLength[:])
+	if err != nil {
+		return nil, err
+	}
+	ia := make([]byte, binary.BigEndian.Uint16(iaLength[:]))
+	_, err = io.ReadFull(r, ia)
+	if err != nil {
+		return nil, err
+	}
+
+	enc := newCipher("keyB", secret, skey)
+	reply := make([]byte, 8+4+2)
+	binary.BigEndian.PutUint32(reply[8:12], method)
+	enc.XORKeyStream(reply, reply)
+	_, err = conn.Write(reply)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Conn{Conn: conn, Method: method}
+	if method == CryptoRC4 {
+		c.r = io.MultiReader(bytes.NewReader(ia), r)
+		c.enc = enc
+	} else {
+		c.r = io.MultiReader(bytes.NewReader(ia), conn)
+	}
+	return c, nil
+}
+
+// protocolHeader is how a plaintext BitTorrent handshake starts
+var protocolHeader = []byte("\x13BitTorrent protocol")
+
+// Accept works out whether a peer that connected to us started an encryption
+// handshake or a plaintext BitTorrent one, and completes an encryption
+// handshake if the policy allows it. Plaintext connections are refused under
+// the Require policy. The returned connection replays whatever was read to
+// tell the two apart.
+func Accept(conn net.Conn, skeys [][20]byte, policy Policy) (net.Conn, error) {
+	start := make([]byte, len(protocolHeader))
+	_, err := io.ReadFull(conn, start)
+	if err != nil {
+		return nil, err
+	}
+	replay := &replayConn{Conn: conn, r: io.MultiReader(bytes.NewReader(start), conn)}
+
+	if bytes.Equal(start, protocolHeader) {
+		if policy == Require {
+			return nil, fmt.Errorf("Peer did not encrypt the connection")
+		}
+		return replay, nil
+	}
+	if policy == Disabled {
+		return nil, fmt.Errorf("Peer tried to encrypt the connection")
+	}
+	return Receive(replay, skeys, policy)
+}
+
+// A replayConn reads from r instead of straight from the connection
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,232 @@
+package mse
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// connPair returns both ends of a loopback TCP connection. net.Pipe won't
+// do, since both sides write before they read.
+func connPair(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	require.Nil(t, err)
+	return dialed, <-accepted
+}
+
+type result struct {
+	conn net.Conn
+	err  error
+}
+
+// handshake runs Initiate and Accept against each other
+func handshake(t *testing.T, infoHash [20]byte, skeys [][20]byte, initiator, receiver Policy) (*Conn, error, net.Conn, error) {
+	a, b := connPair(t)
+	received := make(chan result, 1)
+	go func() {
+		conn, err := Accept(b, skeys, receiver)
+		if err != nil {
+			b.Close()
+		}
+		received <- result{conn, err}
+	}()
+	initiated, err := Initiate(a, infoHash, initiator)
+	if err != nil {
+		a.Close()
+	}
+	r := <-received
+	return initiated, err, r.conn, r.err
+}
+
+func TestHandshake(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	skeys := [][20]byte{{9, 9, 9}, infoHash}
+	tests := map[string]struct {
+		initiator Policy
+		receiver  Policy
+		method    uint32
+	}{
+		"both prefer": {
+			initiator: Prefer,
+			receiver:  Prefer,
+			method:    CryptoRC4,
+		},
+		"initiator requires": {
+			initiator: Require,
+			receiver:  Prefer,
+			method:    CryptoRC4,
+		},
+		"receiver requires": {
+			initiator: Prefer,
+			receiver:  Require,
+			method:    CryptoRC4,
+		},
+	}
+
+	for name, test := range tests {
+		a, errA, b, errB := handshake(t, infoHash, skeys, test.initiator, test.receiver)
+		require.Nil(t, errA, name)
+		require.Nil(t, errB, name)
+		assert.Equal(t, test.method, a.Method, name)
+		assert.Equal(t, test.method, b.(*Conn).Method, name)
+
+		// Data makes it through in both directions
+		go a.Write([]byte("\x13BitTorrent protocol"))
+		buf := make([]byte, 20)
+		_, err := io.ReadFull(b, buf)
+		require.Nil(t, err, name)
+		assert.Equal(t, "\x13BitTorrent protocol", string(buf), name)
+		go b.Write([]byte("reply"))
+		buf = make([]byte, 5)
+		_, err = io.ReadFull(a, buf)
+		require.Nil(t, err, name)
+		assert.Equal(t, "reply", string(buf), name)
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestHandshakeEncryptsStream(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	raw, peer := connPair(t)
+	defer raw.Close()
+	defer peer.Close()
+
+	received := make(chan result, 1)
+	go func() {
+		conn, err := Receive(peer, [][20]byte{infoHash}, Prefer)
+		received <- result{conn, err}
+	}()
+	a, err := Initiate(raw, infoHash, Prefer)
+	require.Nil(t, err)
+	r := <-received
+	require.Nil(t, r.err)
+
+	// Read what goes over the wire without decrypting it
+	go a.Write([]byte("secret"))
+	buf := make([]byte, 6)
+	_, err = io.ReadFull(peer, buf)
+	require.Nil(t, err)
+	assert.NotEqual(t, "secret", string(buf))
+}
+
+func TestHandshakePlaintext(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	raw, peer := connPair(t)
+	defer raw.Close()
+	defer peer.Close()
+
+	// A receiver that only allows plaintext picks it once the handshake is
+	// done, and the stream carries on in the clear
+	received := make(chan result, 1)
+	go func() {
+		conn, err := Receive(peer, [][20]byte{infoHash}, Disabled)
+		received <- result{conn, err}
+	}()
+	a, err := Initiate(raw, infoHash, Prefer)
+	require.Nil(t, err)
+	r := <-received
+	require.Nil(t, r.err)
+	assert.Equal(t, CryptoPlaintext, a.Method)
+
+	go a.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(peer, buf)
+	require.Nil(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
+
+func TestHandshakeNoCommonMethod(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	raw, peer := connPair(t)
+	defer raw.Close()
+	defer peer.Close()
+
+	received := make(chan error, 1)
+	go func() {
+		_, err := Receive(peer, [][20]byte{infoHash}, Disabled)
+		peer.Close()
+		received <- err
+	}()
+	_, err := Initiate(raw, infoHash, Require)
+	assert.NotNil(t, err)
+	assert.NotNil(t, <-received)
+}
+
+func TestHandshakeUnknownTorrent(t *testing.T) {
+	_, errA, _, errB := handshake(t, [20]byte{1, 2, 3}, [][20]byte{{4, 5, 6}}, Prefer, Prefer)
+	assert.NotNil(t, errA)
+	assert.NotNil(t, errB)
+}
+
+func TestAcceptPlaintext(t *testing.T) {
+	hs := "\x13BitTorrent protocol" + string(make([]byte, 48))
+	tests := map[string]struct {
+		policy Policy
+		fails  bool
+	}{
+		"disabled": {policy: Disabled},
+		"prefer":   {policy: Prefer},
+		"require":  {policy: Require, fails: true},
+	}
+
+	for name, test := range tests {
+		a, b := connPair(t)
+		go a.Write([]byte(hs))
+		conn, err := Accept(b, nil, test.policy)
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			require.Nil(t, err, name)
+			// The whole handshake can still be read
+			buf := make([]byte, len(hs))
+			_, err = io.ReadFull(conn, buf)
+			require.Nil(t, err, name)
+			assert.Equal(t, hs, string(buf), name)
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestAcceptEncryptedWhenDisabled(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	_, errA, _, errB := handshake(t, infoHash, [][20]byte{infoHash}, Prefer, Disabled)
+	assert.NotNil(t, errA)
+	assert.NotNil(t, errB)
+}
+
+func TestSynchronize(t *testing.T) {
+	r, w := net.Pipe()
+	defer r.Close()
+	go func() {
+		w.Write([]byte("paddingPATTERNrest"))
+		w.Close()
+	}()
+	err := synchronize(r, []byte("PATTERN"), 7)
+	require.Nil(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(r, buf)
+	require.Nil(t, err)
+	assert.Equal(t, "rest", string(buf))
+
+	r2, w2 := net.Pipe()
+	defer r2.Close()
+	go func() {
+		w2.Write([]byte("too much paddingPATTERN"))
+		w2.Close()
+	}()
+	err = synchronize(r2, []byte("PATTERN"), 7)
+	assert.NotNil(t, err)
+}
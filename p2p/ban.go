@@ -0,0 +1,62 @@
+package p2p
+
+import (
+	"net"
+	"sync"
+
+	"github.com/veggiedefender/torrent-client/message"
+)
+
+// A BanList holds the IP addresses of peers we refuse to talk to. One list
+// can be shared by many torrents.
+type BanList struct {
+	mu  sync.Mutex
+	ips map[string]bool
+}
+
+// NewBanList returns an empty BanList
+func NewBanList() *BanList {
+	return &BanList{ips: make(map[string]bool)}
+}
+
+// Ban adds ip to the list
+func (b *BanList) Ban(ip net.IP) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ips[ip.String()] = true
+}
+
+// Banned tells if ip is on the list
+func (b *BanList) Banned(ip net.IP) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.ips[ip.String()]
+}
+
+// Len returns the number of banned addresses
+func (b *BanList) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.ips)
+}
+
+// bans returns the torrent's ban list, creating one if none was set
+func (t *Torrent) bans() *BanList {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.BanList == nil {
+		t.BanList = NewBanList()
+	}
+	return t.BanList
+}
+
+// banIfMalicious bans a peer whose connection failed with an error that a
+// well-behaved peer can't cause
+func (t *Torrent) banIfMalicious(peer net.IP, err error) bool {
+	if _, ok := err.(*message.TooLongError); !ok {
+		return false
+	}
+	t.bans().Ban(peer)
+	t.log().With("peer", peer).Warnf("Banned: %s", err)
+	return true
+}
@@ -0,0 +1,55 @@
+package p2p
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/torrent-client/handshake"
+	"github.com/veggiedefender/torrent-client/peers"
+)
+
+func TestBanOversizedMessage(t *testing.T) {
+	torrent, _ := testTorrent(t, 100000, 32768)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	// A peer that claims to send a 4 GB message right after the handshake
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			handshake.Read(conn)
+			conn.Write(handshake.New(torrent.InfoHash, [20]byte{}).Serialize())
+			conn.Write([]byte{0xff, 0xff, 0xff, 0xff, 7})
+			defer conn.Close()
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	peer := peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	torrent.Peers = []peers.Peer{peer}
+	torrent.BanList = NewBanList()
+	connected := 0
+	torrent.OnEvent = func(e Event) {
+		if e.Type == EventPeerConnected {
+			connected++
+		}
+	}
+
+	_, err = torrent.Download()
+	assert.NotNil(t, err)
+	assert.True(t, torrent.BanList.Banned(peer.IP))
+	assert.Equal(t, 0, connected)
+}
+
+func TestBanList(t *testing.T) {
+	b := NewBanList()
+	b.Ban(net.IP{10, 0, 0, 1})
+	assert.True(t, b.Banned(net.IP{10, 0, 0, 1}))
+	assert.True(t, b.Banned(net.ParseIP("10.0.0.1")))
+	assert.False(t, b.Banned(net.IP{10, 0, 0, 2}))
+	assert.Equal(t, 1, b.Len())
+}
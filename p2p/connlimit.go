@@ -0,0 +1,57 @@
+package p2p
+
+import "context"
+
+// A ConnLimiter caps how many peer connections are open at once. One limiter
+// can be shared by many torrents to enforce a global limit. A nil
+// ConnLimiter allows any number of connections.
+type ConnLimiter struct {
+	slots chan struct{}
+}
+
+// NewConnLimiter returns a ConnLimiter that allows up to max connections
+func NewConnLimiter(max int) *ConnLimiter {
+	return &ConnLimiter{slots: make(chan struct{}, max)}
+}
+
+// acquire blocks until a connection slot is free or ctx is done
+func (l *ConnLimiter) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// tryAcquire takes a connection slot if one is free right now
+func (l *ConnLimiter) tryAcquire() bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// release frees a slot taken by acquire or tryAcquire
+func (l *ConnLimiter) release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
+
+// Open returns the number of connections currently holding a slot
+func (l *ConnLimiter) Open() int {
+	if l == nil {
+		return 0
+	}
+	return len(l.slots)
+}
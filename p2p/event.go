@@ -0,0 +1,93 @@
+package p2p
+
+import (
+	"time"
+
+	"github.com/veggiedefender/torrent-client/peerid"
+	"github.com/veggiedefender/torrent-client/peers"
+)
+
+// rateInterval is how often a download reports its transfer rate
+const rateInterval = time.Second
+
+// EventType identifies what an Event is reporting
+type EventType int
+
+const (
+	// EventPieceDone reports a piece that was downloaded and verified
+	EventPieceDone EventType = iota
+	// EventPieceFailed reports a piece from Peer that failed its hash check
+	EventPieceFailed
+	// EventPeerConnected reports a completed handshake with Peer
+	EventPeerConnected
+	// EventPeerDisconnected reports that the connection with Peer ended
+	EventPeerDisconnected
+	// EventAnnounce reports the result of asking the tracker for peers
+	EventAnnounce
+	// EventRate reports the download rate over the last sample interval
+	EventRate
+	// EventComplete reports that every piece has been downloaded
+	EventComplete
+)
+
+func (e EventType) String() string {
+	switch e {
+	case EventPieceDone:
+		return "PieceDone"
+	case EventPieceFailed:
+		return "PieceFailed"
+	case EventPeerConnected:
+		return "PeerConnected"
+	case EventPeerDisconnected:
+		return "PeerDisconnected"
+	case EventAnnounce:
+		return "Announce"
+	case EventRate:
+		return "Rate"
+	case EventComplete:
+		return "Complete"
+	default:
+		return "Unknown"
+	}
+}
+
+// An Event reports progress of a download. Fields that don't apply to the
+// event's Type are left zero.
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	// Index is the piece for EventPieceDone and EventPieceFailed
+	Index int
+	// Peer is the peer involved in piece and peer events. It is zero for pieces
+	// downloaded from a web seed.
+	Peer peers.Peer
+	// Client is the software the peer runs for EventPeerConnected, as told
+	// by its peer ID. It is zero if the peer ID isn't recognized.
+	Client peerid.Client
+	// NumPeers is how many peers were returned by an EventAnnounce, and how
+	// many are connected for every other event
+	NumPeers int
+	// Err is why an announce failed or a peer disconnected
+	Err error
+
+	// DonePieces and TotalPieces count the pieces verified so far
+	DonePieces  int
+	TotalPieces int
+	// Downloaded is the number of verified bytes so far
+	Downloaded int
+	// Rate is the download rate in bytes per second for EventRate
+	Rate float64
+}
+
+// emit sends an event to OnEvent. Events are delivered one at a time, even
+// though workers emit them from many goroutines.
+func (t *Torrent) emit(e Event) {
+	if t.OnEvent == nil {
+		return
+	}
+	e.Time = time.Now()
+	t.eventMu.Lock()
+	defer t.eventMu.Unlock()
+	t.OnEvent(e)
+}
@@ -0,0 +1,63 @@
+package p2p
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// File is one file in a multi-file torrent
+type File struct {
+	// Path is the file's path below the torrent's directory, one element per
+	// directory and the file name last
+	Path   []string
+	Length int
+}
+
+// WriteFiles writes the downloaded data of the torrent, buf, to disk. A
+// single-file torrent is written to the file at path, and the files of a
+// multi-file torrent are written below the directory path/Name.
+func (t *Torrent) WriteFiles(path string, buf []byte) error {
+	if t.Files == nil {
+		return ioutil.WriteFile(path, buf, 0644)
+	}
+	err := checkPathElement(t.Name)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(path, t.Name)
+	offset := 0
+	for _, f := range t.Files {
+		if offset+f.Length > len(buf) {
+			return fmt.Errorf("Files are longer than the %d bytes downloaded", len(buf))
+		}
+		for _, elem := range f.Path {
+			err := checkPathElement(elem)
+			if err != nil {
+				return err
+			}
+		}
+		name := filepath.Join(append([]string{dir}, f.Path...)...)
+		err := os.MkdirAll(filepath.Dir(name), 0755)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(name, buf[offset:offset+f.Length], 0644)
+		if err != nil {
+			return err
+		}
+		offset += f.Length
+	}
+	return nil
+}
+
+// checkPathElement makes sure a name from a torrent file names something
+// inside the directory it is joined to
+func checkPathElement(elem string) error {
+	if elem == "" || elem == "." || elem == ".." || strings.ContainsAny(elem, "/\\\x00") {
+		return fmt.Errorf("Unsafe file name %q", elem)
+	}
+	return nil
+}
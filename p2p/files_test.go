@@ -0,0 +1,53 @@
+package p2p
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "files")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	data := []byte("0123456789")
+
+	torrent := Torrent{Name: "single"}
+	require.Nil(t, torrent.WriteFiles(filepath.Join(dir, "out"), data))
+	written, err := ioutil.ReadFile(filepath.Join(dir, "out"))
+	require.Nil(t, err)
+	assert.Equal(t, data, written)
+
+	torrent = Torrent{Name: "multi", Files: []File{
+		{Path: []string{"a"}, Length: 3},
+		{Path: []string{"empty"}, Length: 0},
+		{Path: []string{"sub", "b"}, Length: 7},
+	}}
+	require.Nil(t, torrent.WriteFiles(dir, data))
+	for name, expected := range map[string]string{"a": "012", "empty": "", "sub/b": "3456789"} {
+		written, err := ioutil.ReadFile(filepath.Join(dir, "multi", filepath.FromSlash(name)))
+		require.Nil(t, err, name)
+		assert.Equal(t, expected, string(written), name)
+	}
+}
+
+func TestWriteFilesRejectsUnsafePaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "files")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	tests := []*Torrent{
+		{Name: "..", Files: []File{{Path: []string{"a"}, Length: 1}}},
+		{Name: "ok", Files: []File{{Path: []string{"..", "a"}, Length: 1}}},
+		{Name: "ok", Files: []File{{Path: []string{"a/b"}, Length: 1}}},
+		{Name: "ok", Files: []File{{Path: []string{""}, Length: 1}}},
+		{Name: "ok", Files: []File{{Path: []string{"a"}, Length: 2}}},
+	}
+	for _, torrent := range tests {
+		assert.NotNil(t, torrent.WriteFiles(dir, []byte{1}), torrent.Files[0].Path)
+	}
+}
@@ -0,0 +1,98 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRetryAfter caps how long a busy HTTP seed can ask us to wait
+const maxRetryAfter = 10 * time.Minute
+
+// httpSeedURL builds the request for a piece from the HTTP seed at base
+func (t *Torrent) httpSeedURL(base string, pw *pieceWork) (string, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	// url.Values would escape the infohash the same way, but sorts the
+	// parameters, so build the query in the order BEP 17 lists them
+	query := fmt.Sprintf("info_hash=%s&piece=%d&ranges=0-%d",
+		url.QueryEscape(string(t.InfoHash[:])), pw.index, pw.length-1)
+	if u.RawQuery != "" {
+		query = u.RawQuery + "&" + query
+	}
+	u.RawQuery = query
+	return u.String(), nil
+}
+
+// parseRetryAfter reads how many seconds a busy HTTP seed wants us to wait,
+// which it sends in the body of a 503 response
+func parseRetryAfter(body []byte) (time.Duration, error) {
+	seconds, err := strconv.Atoi(strings.TrimSpace(string(body)))
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("HTTP seed sent malformed retry time %q", body)
+	}
+	wait := time.Duration(seconds) * time.Second
+	if wait > maxRetryAfter {
+		wait = maxRetryAfter
+	}
+	return wait, nil
+}
+
+// downloadFromHTTPSeed fetches a piece from the HTTP seed at base
+func (t *Torrent) downloadFromHTTPSeed(ctx context.Context, base string, pw *pieceWork) ([]byte, error) {
+	u, err := t.httpSeedURL(base, pw)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, webSeedTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusServiceUnavailable:
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64))
+		if err != nil {
+			return nil, err
+		}
+		wait, err := parseRetryAfter(body)
+		if err != nil {
+			return nil, err
+		}
+		return nil, &retryAfterError{wait}
+	default:
+		return nil, fmt.Errorf("HTTP seed %s returned %s", base, resp.Status)
+	}
+
+	buf := make([]byte, pw.length)
+	_, err = io.ReadFull(resp.Body, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// startHTTPSeedWorker downloads pieces from the HTTP seed at base, waiting
+// whenever it says it is busy
+func (t *Torrent) startHTTPSeedWorker(ctx context.Context, base string, workQueue chan *pieceWork, results chan *pieceResult) {
+	fetch := func(ctx context.Context, pw *pieceWork) ([]byte, error) {
+		return t.downloadFromHTTPSeed(ctx, base, pw)
+	}
+	t.runSeedWorker(ctx, t.log().With("httpseed", base), fetch, workQueue, results)
+}
@@ -0,0 +1,67 @@
+package p2p
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPSeedURL(t *testing.T) {
+	torrent := Torrent{InfoHash: [20]byte{'a', ' ', 0xff}}
+	u, err := torrent.httpSeedURL("http://seed/script?key=1", &pieceWork{index: 3, length: 100})
+	require.Nil(t, err)
+	assert.Equal(t, "http://seed/script?key=1&info_hash=a+%FF"+
+		"%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00&piece=3&ranges=0-99", u)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	wait, err := parseRetryAfter([]byte("30\n"))
+	require.Nil(t, err)
+	assert.Equal(t, 30*time.Second, wait)
+
+	wait, err = parseRetryAfter([]byte("86400"))
+	require.Nil(t, err)
+	assert.Equal(t, maxRetryAfter, wait)
+
+	_, err = parseRetryAfter([]byte("soon"))
+	assert.NotNil(t, err)
+}
+
+func TestDownloadFromHTTPSeed(t *testing.T) {
+	torrent, data := testTorrent(t, 100000, 32768)
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Turn the first request away to check that we come back
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("0"))
+			return
+		}
+		query := r.URL.Query()
+		if query.Get("info_hash") != string(torrent.InfoHash[:]) {
+			http.NotFound(w, r)
+			return
+		}
+		index, err := strconv.Atoi(query.Get("piece"))
+		if err != nil || index >= len(torrent.PieceHashes) {
+			http.NotFound(w, r)
+			return
+		}
+		begin, end := torrent.calculateBoundsForPiece(index)
+		assert.Equal(t, "0-"+strconv.Itoa(end-begin-1), query.Get("ranges"))
+		w.Write(data[begin:end])
+	}))
+	defer server.Close()
+	torrent.HTTPSeeds = []string{server.URL}
+
+	buf, err := torrent.Download()
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+	assert.Equal(t, int32(len(torrent.PieceHashes)+1), atomic.LoadInt32(&requests))
+}
@@ -2,23 +2,40 @@ package p2p
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"fmt"
-	"log"
-	"runtime"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/veggiedefender/torrent-client/bitfield"
 	"github.com/veggiedefender/torrent-client/client"
+	"github.com/veggiedefender/torrent-client/ipfilter"
+	"github.com/veggiedefender/torrent-client/logger"
 	"github.com/veggiedefender/torrent-client/message"
+	"github.com/veggiedefender/torrent-client/mse"
+	"github.com/veggiedefender/torrent-client/peerid"
 	"github.com/veggiedefender/torrent-client/peers"
+	"github.com/veggiedefender/torrent-client/pex"
+	"github.com/veggiedefender/torrent-client/ratelimit"
+	"github.com/veggiedefender/torrent-client/utp"
 )
 
 // MaxBlockSize is the largest number of bytes a request can ask for
-const MaxBlockSize = 16384
+const MaxBlockSize = message.MaxBlockSize
 
 // MaxBacklog is the number of unfulfilled requests a client can have in its pipeline
 const MaxBacklog = 5
 
+// idleTimeout is how long we wait for a peer that has nothing we need to get
+// something. Peers send keep-alives more often than this.
+const idleTimeout = 3 * time.Minute
+
+// reannounceInterval is how often a stalled download asks for more peers
+const reannounceInterval = 15 * time.Second
+
 // Torrent holds data required to download a torrent from a list of peers
 type Torrent struct {
 	Peers       []peers.Peer
@@ -28,8 +45,111 @@ type Torrent struct {
 	PieceLength int
 	Length      int
 	Name        string
+	// Files lays out the data of a multi-file torrent. It is nil for a
+	// single-file torrent.
+	Files []File
+
+	// Port is the port we accept connections on, which is announced to
+	// peer sources
+	Port uint16
+
+	// Announce, if set, is called to get peers from the tracker when the
+	// download starts, periodically while it runs, and once every worker has
+	// disconnected
+	Announce func(ctx context.Context) ([]peers.Peer, error)
+	// Sources are asked for peers whenever Announce is, unless the torrent
+	// is private
+	Sources []PeerSource
+	// StallTimeout is how long Download keeps looking for peers after every
+	// worker has disconnected. Zero gives up as soon as a re-announce comes
+	// back empty and no peer is waiting out a backoff to be retried.
+	StallTimeout time.Duration
+
+	// OnEvent, if set, is called with progress events during Download. Calls
+	// are never concurrent, but they hold up the download, so it should
+	// return quickly.
+	OnEvent func(Event)
+	eventMu sync.Mutex
+	// Logger receives the download's log messages, tagged with the torrent's
+	// name and each message's peer. Nothing is logged if it is nil.
+	Logger logger.Logger
+	// ConnLimiter, if set, caps the number of connections this torrent opens,
+	// together with every other torrent sharing it
+	ConnLimiter *ConnLimiter
+	// MaxConns caps the number of peers this torrent is connected to at
+	// once, counting those that connected to us. It defaults to 50.
+	MaxConns int
+	// DownloadLimiters and UploadLimiters cap the rates at which data is
+	// received and sent, for example one shared by every torrent and one of
+	// this torrent's own. Every limiter applies, so the tightest one wins.
+	DownloadLimiters []*ratelimit.Limiter
+	UploadLimiters   []*ratelimit.Limiter
+	// LimitPayloadOnly counts only piece data against the limiters, leaving
+	// protocol overhead unlimited
+	LimitPayloadOnly bool
+	// PeerDownloadLimits and PeerUploadLimits, if set, give each peer
+	// connection limiters of its own on top of the others
+	PeerDownloadLimits *ratelimit.Pool
+	PeerUploadLimits   *ratelimit.Pool
+	// WebSeeds are URLs that serve the torrent's data over HTTP (BEP 19)
+	WebSeeds []string
+	// HTTPSeeds are URLs of scripts that serve the torrent's pieces (BEP 17)
+	HTTPSeeds []string
+	// HTTPClient is used to download from web seeds and HTTP seeds, and by
+	// announce functions that make HTTP requests. It defaults to
+	// http.DefaultClient.
+	HTTPClient *http.Client
+	// BanList holds peers that we won't connect to or accept connections
+	// from, including peers caught sending corrupt data. It can be shared by
+	// many torrents. A list of our own is made if it is nil.
+	BanList *BanList
+	// IPFilter, if set, blocks address ranges we won't connect to or accept
+	// connections from
+	IPFilter *ipfilter.Filter
+	// Private torrents only get peers from their tracker (BEP 27), so peers
+	// are not exchanged with PEX, which isn't even advertised, and Sources
+	// are not asked
+	Private bool
+	// Encryption decides whether connections we open use Message Stream
+	// Encryption
+	Encryption mse.Policy
+	// Transport decides whether connections we open use TCP, uTP or both
+	Transport client.TransportPolicy
+	// UTPSocket, if set, is the socket uTP connections are dialed from
+	UTPSocket *utp.Socket
+	// Dialer, if set, opens the connections to peers
+	Dialer client.Dialer
+
+	// connected counts peers we have completed a handshake with
+	connected int32
+
+	// Progress survives between calls to DownloadContext, so a cancelled
+	// download picks up where it left off
+	mu         sync.Mutex
+	buf        []byte
+	done       bitfield.Bitfield
+	numDone    int
+	downloaded int
+	// inbound hands connections accepted by AddClient to a running download.
+	// It is nil while no download is running.
+	inbound chan *client.Client
+	// exchanged hands peers learned over PEX to a running download. It is nil
+	// while no download is running.
+	exchanged chan []peers.Peer
+	// swarm holds the listen addresses of the peers we are connected to
+	swarm map[string]peers.Peer
+	// clients holds the connections of running download workers, and
+	// transferred the traffic of those that have closed
+	clients     map[*client.Client]bool
+	transferred client.Stats
+	// smartBan finds peers that send corrupt data
+	smartBan smartBan
 }
 
+// maxPendingInbound is how many accepted connections can wait to be picked
+// up by a download before AddClient turns more away
+const maxPendingInbound = 16
+
 type pieceWork struct {
 	index  int
 	hash   [20]byte
@@ -39,15 +159,32 @@ type pieceWork struct {
 type pieceResult struct {
 	index int
 	buf   []byte
+	peer  peers.Peer
 }
 
 type pieceProgress struct {
+	torrent    *Torrent
 	index      int
 	client     *client.Client
 	buf        []byte
 	downloaded int
 	requested  int
 	backlog    int
+	// rejected holds blocks the peer refused to send, to ask for again once
+	// it unchokes us or allows the piece to be downloaded while choked
+	rejected []block
+	// refused holds the pieces the peer rejected requests for since it last
+	// unchoked us. It is shared by every piece downloaded from the peer.
+	refused map[int]bool
+}
+
+// errPieceRefused is returned by attemptDownloadPiece when the peer rejects
+// requests for the piece, so it can go to another peer
+var errPieceRefused = fmt.Errorf("Peer refused to send the piece")
+
+type block struct {
+	begin  int
+	length int
 }
 
 func (state *pieceProgress) readMessage() error {
@@ -59,10 +196,16 @@ func (state *pieceProgress) readMessage() error {
 	if msg == nil { // keep-alive
 		return nil
 	}
+	// Everything we keep from a message is copied out of it
+	defer msg.Release()
 
 	switch msg.ID {
 	case message.MsgUnchoke:
 		state.client.Choked = false
+		// Requests rejected while choked are worth making again
+		for index := range state.refused {
+			delete(state.refused, index)
+		}
 	case message.MsgChoke:
 		state.client.Choked = true
 	case message.MsgHave:
@@ -78,15 +221,51 @@ func (state *pieceProgress) readMessage() error {
 		}
 		state.downloaded += n
 		state.backlog--
+	case message.MsgRejectRequest:
+		index, begin, length, err := message.ParseRequest(msg)
+		if err != nil {
+			return err
+		}
+		if index == state.index {
+			state.backlog--
+			state.rejected = append(state.rejected, block{begin, length})
+		}
+		if state.refused != nil {
+			state.refused[index] = true
+		}
+	case message.MsgAllowedFast:
+		index, err := message.ParseAllowedFast(msg)
+		if err != nil {
+			return err
+		}
+		state.client.AllowedFast[index] = true
+	case message.MsgRequest:
+		// We don't upload, but with the Fast Extension we have to say so
+		if state.client.SupportsFast() {
+			index, begin, length, err := message.ParseRequest(msg)
+			if err != nil {
+				return err
+			}
+			return state.client.SendRejectRequest(index, begin, length)
+		}
+	case message.MsgExtended:
+		return state.torrent.handleExtended(state.client, msg)
 	}
 	return nil
 }
 
-func attemptDownloadPiece(c *client.Client, pw *pieceWork) ([]byte, error) {
+// attemptDownloadPiece downloads a piece from a peer. Once the peer rejects
+// a request for the piece, no more are sent for it unless the peer allows it
+// to be downloaded while choked or unchokes us again, and if none are left
+// the attempt fails with errPieceRefused. The pieces the peer rejected are
+// recorded in refused.
+func (t *Torrent) attemptDownloadPiece(c *client.Client, pw *pieceWork, refused map[int]bool) ([]byte, error) {
 	state := pieceProgress{
-		index:  pw.index,
-		client: c,
-		buf:    make([]byte, pw.length),
+		torrent: t,
+		index:   pw.index,
+		client:  c,
+		buf:     make([]byte, pw.length),
+		refused: refused,
 	}
 
 	// Setting a deadline helps get unresponsive peers unstuck.
@@ -95,8 +274,24 @@ func attemptDownloadPiece(c *client.Client, pw *pieceWork) ([]byte, error) {
 	defer c.Conn.SetDeadline(time.Time{}) // Disable the deadline
 
 	for state.downloaded < pw.length {
-		// If unchoked, send requests until we have enough unfulfilled requests
-		if !state.client.Choked {
+		allowedFast := state.client.AllowedFast[pw.index]
+		if refused[pw.index] && !allowedFast {
+			// Asking again would only be rejected again
+			if state.backlog == 0 {
+				return nil, errPieceRefused
+			}
+		} else if !state.client.Choked || allowedFast {
+			// If unchoked, or allowed to ask for this piece while choked,
+			// send requests until we have enough unfulfilled requests
+			for state.backlog < MaxBacklog && len(state.rejected) > 0 {
+				b := state.rejected[0]
+				err := c.SendRequest(pw.index, b.begin, b.length)
+				if err != nil {
+					return nil, err
+				}
+				state.rejected = state.rejected[1:]
+				state.backlog++
+			}
 			for state.backlog < MaxBacklog && state.requested < pw.length {
 				blockSize := MaxBlockSize
 				// Last block might be shorter than the typical block
@@ -122,6 +317,16 @@ func attemptDownloadPiece(c *client.Client, pw *pieceWork) ([]byte, error) {
 	return state.buf, nil
 }
 
+// waitForPieces handles the next message from a peer that has none of the
+// pieces we need, or refused them, which is how we learn that it got some or
+// unchoked us
+func (t *Torrent) waitForPieces(c *client.Client, refused map[int]bool) error {
+	c.Conn.SetDeadline(time.Now().Add(idleTimeout))
+	defer c.Conn.SetDeadline(time.Time{}) // Disable the deadline
+	state := pieceProgress{torrent: t, index: -1, client: c, refused: refused}
+	return state.readMessage()
+}
+
 func checkIntegrity(pw *pieceWork, buf []byte) error {
 	hash := sha1.Sum(buf)
 	if !bytes.Equal(hash[:], pw.hash[:]) {
@@ -130,41 +335,163 @@ func checkIntegrity(pw *pieceWork, buf []byte) error {
 	return nil
 }
 
-func (t *Torrent) startDownloadWorker(peer peers.Peer, workQueue chan *pieceWork, results chan *pieceResult) {
-	c, err := client.New(peer, t.PeerID, t.InfoHash)
+// startDownloadWorker connects to a peer and downloads from it until it
+// disconnects. It returns how fast the peer sent us data.
+func (t *Torrent) startDownloadWorker(ctx context.Context, peer peers.Peer, workQueue chan *pieceWork, results chan *pieceResult) float64 {
+	if t.ConnLimiter.acquire(ctx) != nil {
+		return 0
+	}
+	defer t.ConnLimiter.release()
+
+	c, err := client.NewOptions(ctx, peer, t.PeerID, t.InfoHash, client.Options{
+		Encryption: t.Encryption,
+		Transport:  t.Transport,
+		UTPSocket:  t.UTPSocket,
+		Dialer:     t.Dialer,
+		Limits: client.Limits{
+			Download:    t.DownloadLimiters,
+			Upload:      t.UploadLimiters,
+			PayloadOnly: t.LimitPayloadOnly,
+		},
+		NumPieces: len(t.PieceHashes),
+		Private:   t.Private,
+	})
 	if err != nil {
-		log.Printf("Could not handshake with %s. Disconnecting\n", peer.IP)
-		return
+		if !t.banIfMalicious(peer.IP, err) {
+			t.log().With("peer", peer).Debugf("Could not handshake: %s", err)
+		}
+		return 0
 	}
+	return t.runDownloadWorker(ctx, c, workQueue, results)
+}
+
+// runDownloadWorker downloads from a connected peer until it disconnects,
+// and returns how fast the peer sent us data
+func (t *Torrent) runDownloadWorker(ctx context.Context, c *client.Client, workQueue chan *pieceWork, results chan *pieceResult) (rate float64) {
+	peer := c.Peer()
+	log := t.log().With("peer", peer)
 	defer c.Conn.Close()
-	log.Printf("Completed handshake with %s\n", peer.IP)
+	remote, _ := peerid.Parse(c.RemotePeerID())
+	if remote.Name != "" {
+		log = log.With("client", remote)
+	}
+	log.Debugf("Completed handshake")
+	var err error
+	t.emit(Event{Type: EventPeerConnected, Peer: peer, Client: remote, NumPeers: int(atomic.AddInt32(&t.connected, 1))})
+
+	down, up := t.PeerDownloadLimits.Get(), t.PeerUploadLimits.Get()
+	defer t.PeerDownloadLimits.Put(down)
+	defer t.PeerUploadLimits.Put(up)
+	c.SetLimits(client.Limits{
+		Download:    append([]*ratelimit.Limiter{down}, t.DownloadLimiters...),
+		Upload:      append([]*ratelimit.Limiter{up}, t.UploadLimiters...),
+		PayloadOnly: t.LimitPayloadOnly,
+	})
+	defer func() {
+		numPeers := atomic.AddInt32(&t.connected, -1)
+		t.emit(Event{Type: EventPeerDisconnected, Peer: peer, NumPeers: int(numPeers), Err: err})
+	}()
+
+	// Closing the connection unblocks any read or write in progress
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Conn.Close()
+		case <-stop:
+		}
+	}()
+
+	t.track(c)
+	defer t.untrack(c)
+	self := t.joinSwarm(c)
+	defer t.leaveSwarm(self)
+	start := time.Now()
+	defer func() {
+		rate = float64(c.Stats().PayloadDownloaded) / time.Since(start).Seconds()
+	}()
+	exchange := pex.NewState()
 
 	c.SendUnchoke()
 	c.SendInterested()
 
-	for pw := range workQueue {
-		if !c.Bitfield.HasPiece(pw.index) {
+	bans := t.bans()
+	misses := 0
+	refused := make(map[int]bool)
+	for {
+		if bans.Banned(peer.IP) {
+			err = fmt.Errorf("Peer is banned")
+			log.Debugf("Disconnecting: %s", err)
+			return
+		}
+		err = t.sendPEX(c, exchange, self)
+		if err != nil {
+			log.Debugf("Disconnecting: %s", err)
+			return
+		}
+
+		var pw *pieceWork
+		select {
+		case pw = <-workQueue:
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		}
+
+		if !c.Bitfield.HasPiece(pw.index) || refused[pw.index] && !c.AllowedFast[pw.index] {
 			workQueue <- pw // Put piece back on the queue
+			// Once the peer has turned down every piece in the queue, wait
+			// for it to tell us about new ones instead of spinning
+			misses++
+			if misses > len(workQueue) {
+				misses = 0
+				err = t.waitForPieces(c, refused)
+				if err != nil {
+					if !t.banIfMalicious(peer.IP, err) {
+						log.Debugf("Disconnecting: %s", err)
+					}
+					return
+				}
+			}
 			continue
 		}
+		misses = 0
 
 		// Download the piece
-		buf, err := attemptDownloadPiece(c, pw)
+		var buf []byte
+		buf, err = t.attemptDownloadPiece(c, pw, refused)
+		if err == errPieceRefused {
+			// Leave the piece to other peers, and keep the connection in
+			// case this one unchokes us or has other pieces to send
+			workQueue <- pw
+			continue
+		}
 		if err != nil {
-			log.Println("Exiting", err)
+			if !t.banIfMalicious(peer.IP, err) {
+				log.Debugf("Disconnecting: %s", err)
+			}
 			workQueue <- pw // Put piece back on the queue
 			return
 		}
 
-		err = checkIntegrity(pw, buf)
-		if err != nil {
-			log.Printf("Piece #%d failed integrity check\n", pw.index)
+		if integrityErr := checkIntegrity(pw, buf); integrityErr != nil {
+			log.Warnf("Piece #%d failed integrity check", pw.index)
+			t.emit(Event{Type: EventPieceFailed, Index: pw.index, Peer: peer, NumPeers: int(atomic.LoadInt32(&t.connected)), Err: integrityErr})
+			t.pieceFailed(pw.index, buf, blockSenders(len(buf), peer.IP))
 			workQueue <- pw // Put piece back on the queue
 			continue
 		}
+		t.piecePassed(pw.index, buf)
 
 		c.SendHave(pw.index)
-		results <- &pieceResult{pw.index, buf}
+		select {
+		case results <- &pieceResult{pw.index, buf, peer}:
+		case <-ctx.Done():
+			workQueue <- pw
+			err = ctx.Err()
+			return
+		}
 	}
 }
 
@@ -182,36 +509,378 @@ func (t *Torrent) calculatePieceSize(index int) int {
 	return end - begin
 }
 
+func (t *Torrent) log() logger.Logger {
+	if t.Logger == nil {
+		return logger.Discard
+	}
+	return t.Logger.With("torrent", t.Name)
+}
+
+// announce asks the tracker for more peers. It returns nothing if no
+// Announce function is configured.
+func (t *Torrent) announce(ctx context.Context) ([]peers.Peer, error) {
+	if t.Announce == nil {
+		return nil, nil
+	}
+	found, err := t.Announce(ctx)
+	t.emit(Event{Type: EventAnnounce, NumPeers: len(found), Err: err})
+	if err != nil {
+		t.log().Warnf("Could not get more peers: %s", err)
+		return nil, err
+	}
+	return found, nil
+}
+
+// AddClient hands a connection that a peer opened to us to the running
+// download, which takes ownership of it. It fails if no download is running
+// or too many connections are already waiting to be picked up.
+func (t *Torrent) AddClient(c *client.Client) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.inbound == nil {
+		return fmt.Errorf("%s is not downloading", t.Name)
+	}
+	select {
+	case t.inbound <- c:
+		return nil
+	default:
+		return fmt.Errorf("Too many pending connections for %s", t.Name)
+	}
+}
+
+// Progress returns the number of pieces and bytes downloaded so far
+func (t *Torrent) Progress() (donePieces, downloaded int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.numDone, t.downloaded
+}
+
+// Transferred returns how much payload and protocol overhead has been
+// exchanged with peers, counting open connections and closed ones
+func (t *Torrent) Transferred() client.Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	total := t.transferred
+	for c := range t.clients {
+		total = total.Add(c.Stats())
+	}
+	return total
+}
+
+func (t *Torrent) track(c *client.Client) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.clients == nil {
+		t.clients = make(map[*client.Client]bool)
+	}
+	t.clients[c] = true
+}
+
+func (t *Torrent) untrack(c *client.Client) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.clients, c)
+	t.transferred = t.transferred.Add(c.Stats())
+}
+
 // Download downloads the torrent. This stores the entire file in memory.
 func (t *Torrent) Download() ([]byte, error) {
-	log.Println("Starting download for", t.Name)
+	return t.DownloadContext(context.Background())
+}
+
+// DownloadContext downloads the torrent like Download, but stops early and
+// returns the context's error if ctx is done first. Every worker has exited
+// by the time it returns. Calling it again after it stopped early resumes the
+// download, skipping pieces that were already done. Only one call may run at
+// a time.
+func (t *Torrent) DownloadContext(ctx context.Context) ([]byte, error) {
+	t.log().Infof("Starting download")
+	t.mu.Lock()
+	if t.buf == nil {
+		t.buf = make([]byte, t.Length)
+		t.done = make(bitfield.Bitfield, (len(t.PieceHashes)+7)/8)
+	}
+	buf := t.buf
+	inbound := make(chan *client.Client, maxPendingInbound)
+	t.inbound = inbound
+	exchanged := make(chan []peers.Peer, maxPendingInbound)
+	t.exchanged = exchanged
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		t.inbound = nil
+		t.exchanged = nil
+		t.mu.Unlock()
+		close(inbound)
+		for c := range inbound {
+			c.Conn.Close()
+		}
+	}()
+
 	// Init queues for workers to retrieve work and send results
 	workQueue := make(chan *pieceWork, len(t.PieceHashes))
 	results := make(chan *pieceResult)
 	for index, hash := range t.PieceHashes {
+		if t.done.HasPiece(index) {
+			continue
+		}
 		length := t.calculatePieceSize(index)
 		workQueue <- &pieceWork{index, hash, length}
 	}
 
-	// Start workers
-	for _, peer := range t.Peers {
-		go t.startDownloadWorker(peer, workQueue, results)
+	// Workers report on exited when they disconnect, so we notice when there
+	// is nobody left to download from. Cancelling workerCtx shuts down the
+	// ones that are left once we return.
+	workerCtx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+	exited := make(chan workerResult)
+	numWorkers := 0
+	// peerWorkers counts the workers that have a peer, out of numWorkers
+	peerWorkers := 0
+	maxConns := t.MaxConns
+	if maxConns <= 0 {
+		maxConns = defaultMaxConns
+	}
+	// active holds the peers and web seeds we have a worker for, so a peer
+	// reported by several sources only gets one
+	active := make(map[string]bool)
+	// lookedUp is set once we have asked for peers since the last peer
+	// worker started
+	lookedUp := false
+	startWorker := func(key string, peer bool, work func() float64) {
+		numWorkers++
+		if peer {
+			peerWorkers++
+		}
+		active[key] = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rate := work()
+			select {
+			case exited <- workerResult{key, peer, rate}:
+			case <-workerCtx.Done():
+			}
+		}()
 	}
+	bans := t.bans()
+	// pool holds every peer we heard of, and fill connects to the best of
+	// them while there is room
+	pool := newPeerPool()
+	usable := func(peer peers.Peer) bool {
+		return !active[peer.String()] && !bans.Banned(peer.IP) && !t.IPFilter.Blocked(peer.IP)
+	}
+	fill := func() {
+		now := time.Now()
+		for peerWorkers < maxConns {
+			c := pool.next(now, usable)
+			if c == nil {
+				return
+			}
+			pool.connect(c)
+			lookedUp = false
+			peer := c.peer
+			startWorker(peer.String(), true, func() float64 {
+				return t.startDownloadWorker(workerCtx, peer, workQueue, results)
+			})
+		}
+	}
+	startWorkers := func(found []peers.Peer) {
+		pool.add(found)
+		fill()
+	}
+	// Web seeds and HTTP seeds are used a few at a time. When one gives up,
+	// the next one in the list takes its place, and those that failed are
+	// tried again along with lookups.
+	seeds := t.seeds()
+	seedWorkers := 0
+	failedSeeds := make(map[string]bool)
+	startSeeds := func() {
+		for _, s := range seeds {
+			if seedWorkers >= maxSeedWorkers {
+				return
+			}
+			if active[s.url] || failedSeeds[s.url] {
+				continue
+			}
+			s := s
+			seedWorkers++
+			startWorker(s.url, false, func() float64 {
+				s.run(workerCtx, s.url, workQueue, results)
+				return 0
+			})
+		}
+	}
+
+	// Lookups ask the tracker and peer sources for peers in the background
+	discovered := make(chan lookupResult)
+	pendingLookups := 0
+	var lookupErr error
+	lookup := func() {
+		failedSeeds = make(map[string]bool)
+		startSeeds()
+		for _, find := range t.lookups() {
+			find := find
+			pendingLookups++
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				found, err := find(workerCtx)
+				select {
+				case discovered <- lookupResult{found, err}:
+				case <-workerCtx.Done():
+				}
+			}()
+		}
+	}
+	startWorkers(t.Peers)
+	lookup()
+	lookedUp = true
+	lookupTicker := time.NewTicker(lookupInterval)
+	defer lookupTicker.Stop()
+
+	rateTicker := time.NewTicker(rateInterval)
+	defer rateTicker.Stop()
+	// Peers come off their backoff at any time, so we check for them often
+	fillTicker := time.NewTicker(fillInterval)
+	defer fillTicker.Stop()
+	lastSample := time.Now()
 
 	// Collect results into a buffer until full
-	buf := make([]byte, t.Length)
-	donePieces := 0
+	t.mu.Lock()
+	donePieces, downloaded := t.numDone, t.downloaded
+	t.mu.Unlock()
+	sampled := downloaded
+	var stalledSince time.Time
+	var retry <-chan time.Time
 	for donePieces < len(t.PieceHashes) {
-		res := <-results
-		begin, end := t.calculateBoundsForPiece(res.index)
-		copy(buf[begin:end], res.buf)
-		donePieces++
+		if numWorkers == 0 && pendingLookups == 0 && retry == nil {
+			if stalledSince.IsZero() {
+				stalledSince = time.Now()
+			}
+			if !lookedUp {
+				lookedUp = true
+				lookup()
+				if pendingLookups > 0 || numWorkers > 0 {
+					continue
+				}
+			}
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			// Peers waiting out a backoff are worth waiting for, however
+			// short StallTimeout is
+			waited := time.Since(stalledSince)
+			next := pool.nextRetry(time.Now())
+			if waited >= t.StallTimeout && next.IsZero() {
+				err := fmt.Errorf("Download of %s stalled with no peers after %s (%d/%d pieces done)",
+					t.Name, waited.Round(time.Second), donePieces, len(t.PieceHashes))
+				if lookupErr != nil {
+					err = fmt.Errorf("%s: %s", err, lookupErr)
+				}
+				return nil, err
+			}
+			wait := reannounceInterval
+			if remaining := t.StallTimeout - waited; remaining > 0 && remaining < wait {
+				wait = remaining
+			}
+			if !next.IsZero() && time.Until(next) < wait {
+				wait = time.Until(next)
+			}
+			retry = time.After(wait)
+			continue
+		}
 
-		percent := float64(donePieces) / float64(len(t.PieceHashes)) * 100
-		numWorkers := runtime.NumGoroutine() - 1 // subtract 1 for main thread
-		log.Printf("(%0.2f%%) Downloaded piece #%d from %d peers\n", percent, res.index, numWorkers)
+		select {
+		case res := <-results:
+			begin, end := t.calculateBoundsForPiece(res.index)
+			copy(buf[begin:end], res.buf)
+			donePieces++
+			downloaded += len(res.buf)
+			stalledSince = time.Time{}
+			t.mu.Lock()
+			t.done.SetPiece(res.index)
+			t.numDone, t.downloaded = donePieces, downloaded
+			t.mu.Unlock()
+			t.emit(Event{
+				Type:        EventPieceDone,
+				Index:       res.index,
+				Peer:        res.peer,
+				NumPeers:    int(atomic.LoadInt32(&t.connected)),
+				DonePieces:  donePieces,
+				TotalPieces: len(t.PieceHashes),
+				Downloaded:  downloaded,
+			})
+		case res := <-discovered:
+			pendingLookups--
+			if res.err != nil {
+				lookupErr = res.err
+			}
+			startWorkers(res.found)
+			if numWorkers > 0 {
+				stalledSince = time.Time{}
+			}
+		case found := <-exchanged:
+			startWorkers(found)
+			if numWorkers > 0 {
+				stalledSince = time.Time{}
+			}
+		case c := <-inbound:
+			if !usable(c.Peer()) || peerWorkers >= maxConns || !t.ConnLimiter.tryAcquire() {
+				c.Conn.Close()
+				continue
+			}
+			stalledSince = time.Time{}
+			lookedUp = false
+			startWorker(c.Peer().String(), true, func() float64 {
+				defer t.ConnLimiter.release()
+				return t.runDownloadWorker(workerCtx, c, workQueue, results)
+			})
+		case now := <-rateTicker.C:
+			t.emit(Event{
+				Type:        EventRate,
+				NumPeers:    int(atomic.LoadInt32(&t.connected)),
+				DonePieces:  donePieces,
+				TotalPieces: len(t.PieceHashes),
+				Downloaded:  downloaded,
+				Rate:        float64(downloaded-sampled) / now.Sub(lastSample).Seconds(),
+			})
+			sampled, lastSample = downloaded, now
+		case <-lookupTicker.C:
+			if pendingLookups == 0 {
+				lookup()
+			}
+		case res := <-exited:
+			numWorkers--
+			delete(active, res.key)
+			if res.peer {
+				peerWorkers--
+				pool.done(res.key, res, time.Now())
+				fill()
+			} else {
+				seedWorkers--
+				failedSeeds[res.key] = true
+				startSeeds()
+			}
+		case <-fillTicker.C:
+			fill()
+		case <-retry:
+			retry = nil
+			lookedUp = false
+			fill()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
-	close(workQueue)
+	t.emit(Event{
+		Type:        EventComplete,
+		NumPeers:    int(atomic.LoadInt32(&t.connected)),
+		DonePieces:  donePieces,
+		TotalPieces: len(t.PieceHashes),
+		Downloaded:  downloaded,
+	})
 
 	return buf, nil
 }
@@ -0,0 +1,401 @@
+package p2p
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/torrent-client/handshake"
+	"github.com/veggiedefender/torrent-client/message"
+	"github.com/veggiedefender/torrent-client/peers"
+)
+
+// deadPeer returns the address of a port that nobody is listening on
+func deadPeer(t *testing.T) peers.Peer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	addr := ln.Addr().(*net.TCPAddr)
+	ln.Close()
+	return peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func TestDownloadStallsWithoutPeers(t *testing.T) {
+	// The dead peer is retried a few times before the download gives up
+	defer func(b time.Duration) { retryBackoff = b }(retryBackoff)
+	retryBackoff = 10 * time.Millisecond
+	announced := 0
+	torrent := Torrent{
+		Peers:       []peers.Peer{deadPeer(t)},
+		PieceHashes: [][20]byte{{}},
+		PieceLength: 10,
+		Length:      10,
+		Name:        "test",
+		Announce: func(ctx context.Context) ([]peers.Peer, error) {
+			announced++
+			return nil, nil
+		},
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := torrent.Download()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		assert.NotNil(t, err)
+		// Once at the start, and again after each retry of the peer
+		assert.Equal(t, maxStallRetries, announced)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Download hung with no peers")
+	}
+}
+
+func TestDownloadContextCancel(t *testing.T) {
+	// A peer that accepts connections but never answers the handshake
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+
+	torrent := Torrent{
+		Peers:       []peers.Peer{{IP: addr.IP, Port: uint16(addr.Port)}},
+		PieceHashes: [][20]byte{{}},
+		PieceLength: 10,
+		Length:      10,
+		Name:        "test",
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := torrent.DownloadContext(ctx)
+		done <- err
+	}()
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("DownloadContext ignored cancellation")
+	}
+}
+
+// startSeeder runs a peer on loopback that has every piece of data and
+// serves any request it receives
+func startSeeder(t *testing.T, infoHash [20]byte, data []byte, pieceLength int) (peers.Peer, net.Listener) {
+	return startSeederWith(t, "127.0.0.1", infoHash, data, pieceLength, nil)
+}
+
+// startSeederWith is like startSeeder, but listens on ip and passes every
+// block it sends through mutate first, unless it is nil
+func startSeederWith(t *testing.T, ip string, infoHash [20]byte, data []byte, pieceLength int,
+	mutate func(index, begin int, block []byte)) (peers.Peer, net.Listener) {
+	ln, err := net.Listen("tcp", ip+":0")
+	require.Nil(t, err)
+
+	numPieces := (len(data) + pieceLength - 1) / pieceLength
+	bf := make([]byte, (numPieces+7)/8)
+	for i := 0; i < numPieces; i++ {
+		bf[i/8] |= 1 << uint(7-i%8)
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				if _, err := handshake.Read(conn); err != nil {
+					return
+				}
+				conn.Write(handshake.New(infoHash, [20]byte{}).Serialize())
+				conn.Write(message.FormatBitfield(bf).Serialize())
+				conn.Write((&message.Message{ID: message.MsgUnchoke}).Serialize())
+				serveRequests(conn, data, pieceLength, mutate)
+			}(conn)
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}, ln
+}
+
+// serveRequests answers every request read from conn with data until the
+// connection fails. If mutate isn't nil, it can change each block before it
+// is sent.
+func serveRequests(conn net.Conn, data []byte, pieceLength int, mutate func(index, begin int, block []byte)) {
+	for {
+		msg, err := message.Read(conn)
+		if err != nil {
+			return
+		}
+		body, err := message.Decode(msg)
+		req, ok := body.(message.Request)
+		if err != nil || !ok {
+			continue
+		}
+		offset := req.Index*pieceLength + req.Begin
+		block := data[offset : offset+req.Length]
+		if mutate != nil {
+			block = append([]byte{}, block...)
+			mutate(req.Index, req.Begin, block)
+		}
+		conn.Write(message.FormatPiece(req.Index, req.Begin, block).Serialize())
+	}
+}
+
+// testTorrent builds a torrent for random data split into pieces
+func testTorrent(t *testing.T, length, pieceLength int) (*Torrent, []byte) {
+	data := make([]byte, length)
+	_, err := rand.Read(data)
+	require.Nil(t, err)
+	var hashes [][20]byte
+	for begin := 0; begin < length; begin += pieceLength {
+		end := begin + pieceLength
+		if end > length {
+			end = length
+		}
+		hashes = append(hashes, sha1.Sum(data[begin:end]))
+	}
+	return &Torrent{
+		InfoHash:    [20]byte{1, 2, 3},
+		PieceHashes: hashes,
+		PieceLength: pieceLength,
+		Length:      length,
+		Name:        "test",
+	}, data
+}
+
+func TestDownloadEvents(t *testing.T) {
+	torrent, data := testTorrent(t, 100000, 32768)
+	seeder, ln := startSeeder(t, torrent.InfoHash, data, torrent.PieceLength)
+	defer ln.Close()
+	torrent.Peers = []peers.Peer{seeder}
+	var events []Event
+	torrent.OnEvent = func(e Event) {
+		events = append(events, e)
+	}
+
+	buf, err := torrent.Download()
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+
+	counts := make(map[EventType]int)
+	for _, e := range events {
+		counts[e.Type]++
+	}
+	assert.Equal(t, 1, counts[EventPeerConnected])
+	assert.Equal(t, len(torrent.PieceHashes), counts[EventPieceDone])
+	assert.Equal(t, 1, counts[EventComplete])
+	for _, e := range events {
+		if e.Type == EventComplete {
+			assert.Equal(t, len(data), e.Downloaded)
+		}
+	}
+}
+
+type staticSource []peers.Peer
+
+func (s staticSource) FindPeers(ctx context.Context, infoHash [20]byte, port uint16) ([]peers.Peer, error) {
+	return s, nil
+}
+
+func TestDownloadFromSource(t *testing.T) {
+	torrent, data := testTorrent(t, 100000, 32768)
+	seeder, ln := startSeeder(t, torrent.InfoHash, data, torrent.PieceLength)
+	defer ln.Close()
+	// The same peer from two sources only gets one connection
+	torrent.Sources = []PeerSource{staticSource{seeder}, staticSource{seeder}}
+	connected := 0
+	torrent.OnEvent = func(e Event) {
+		if e.Type == EventPeerConnected {
+			connected++
+		}
+	}
+
+	buf, err := torrent.Download()
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+	assert.Equal(t, 1, connected)
+}
+
+// countingSource counts how many times it is asked for peers
+type countingSource struct {
+	calls int32
+}
+
+func (s *countingSource) FindPeers(ctx context.Context, infoHash [20]byte, port uint16) ([]peers.Peer, error) {
+	atomic.AddInt32(&s.calls, 1)
+	return nil, nil
+}
+
+func TestPrivateSkipsSources(t *testing.T) {
+	torrent, data := testTorrent(t, 100000, 32768)
+	seeder, ln := startSeeder(t, torrent.InfoHash, data, torrent.PieceLength)
+	defer ln.Close()
+	torrent.Private = true
+	torrent.Announce = func(ctx context.Context) ([]peers.Peer, error) {
+		return []peers.Peer{seeder}, nil
+	}
+	src := &countingSource{}
+	torrent.Sources = []PeerSource{src}
+
+	buf, err := torrent.Download()
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&src.calls))
+}
+
+func TestDownloadWithRejectedRequests(t *testing.T) {
+	torrent, data := testTorrent(t, 100000, 32768)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	// A peer with the Fast Extension that has every piece, but turns down
+	// the first request for each one and then unchokes us again
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := handshake.Read(conn); err != nil {
+			return
+		}
+		hs := handshake.New(torrent.InfoHash, [20]byte{})
+		hs.SetExtension(handshake.ExtensionFast)
+		conn.Write(hs.Serialize())
+		conn.Write((&message.Message{ID: message.MsgHaveAll}).Serialize())
+		conn.Write((&message.Message{ID: message.MsgUnchoke}).Serialize())
+		rejected := make(map[int]bool)
+		for {
+			msg, err := message.Read(conn)
+			if err != nil {
+				return
+			}
+			if msg == nil || msg.ID != message.MsgRequest {
+				continue
+			}
+			index, begin, length, err := message.ParseRequest(msg)
+			require.Nil(t, err)
+			if !rejected[index] {
+				rejected[index] = true
+				conn.Write(message.FormatRejectRequest(index, begin, length).Serialize())
+				conn.Write((&message.Message{ID: message.MsgUnchoke}).Serialize())
+				continue
+			}
+			offset := index*torrent.PieceLength + begin
+			conn.Write(message.FormatPiece(index, begin, data[offset:offset+length]).Serialize())
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	torrent.Peers = []peers.Peer{{IP: addr.IP, Port: uint16(addr.Port)}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	buf, err := torrent.DownloadContext(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+}
+
+func TestRejectedPiecesGoToOtherPeers(t *testing.T) {
+	torrent, data := testTorrent(t, 100000, 32768)
+	good, goodLn := startSeeder(t, torrent.InfoHash, data, torrent.PieceLength)
+	defer goodLn.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	// A peer that unchokes us but rejects every request
+	var requests int32
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := handshake.Read(conn); err != nil {
+			return
+		}
+		hs := handshake.New(torrent.InfoHash, [20]byte{})
+		hs.SetExtension(handshake.ExtensionFast)
+		conn.Write(hs.Serialize())
+		conn.Write((&message.Message{ID: message.MsgHaveAll}).Serialize())
+		conn.Write((&message.Message{ID: message.MsgUnchoke}).Serialize())
+		for {
+			msg, err := message.Read(conn)
+			if err != nil {
+				return
+			}
+			if msg == nil || msg.ID != message.MsgRequest {
+				continue
+			}
+			atomic.AddInt32(&requests, 1)
+			index, begin, length, err := message.ParseRequest(msg)
+			require.Nil(t, err)
+			conn.Write(message.FormatRejectRequest(index, begin, length).Serialize())
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	torrent.Peers = []peers.Peer{{IP: addr.IP, Port: uint16(addr.Port)}, good}
+
+	buf, err := torrent.Download()
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+	// Each piece is asked for at most once before it is left to the other
+	// peer
+	assert.True(t, atomic.LoadInt32(&requests) <= int32(len(torrent.PieceHashes)*MaxBacklog))
+}
+
+func TestDownloadFromPeerWithoutBitfield(t *testing.T) {
+	torrent, data := testTorrent(t, 100000, 32768)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	// A peer that starts out with nothing, so it sends no bitfield, and
+	// announces each piece with HAVE as it gets it
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := handshake.Read(conn); err != nil {
+			return
+		}
+		conn.Write(handshake.New(torrent.InfoHash, [20]byte{}).Serialize())
+		conn.Write((&message.Message{ID: message.MsgUnchoke}).Serialize())
+		time.Sleep(100 * time.Millisecond)
+		for i := range torrent.PieceHashes {
+			conn.Write(message.FormatHave(i).Serialize())
+		}
+		serveRequests(conn, data, torrent.PieceLength, nil)
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	torrent.Peers = []peers.Peer{{IP: addr.IP, Port: uint16(addr.Port)}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	buf, err := torrent.DownloadContext(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+}
@@ -0,0 +1,107 @@
+package p2p
+
+import (
+	"time"
+
+	"github.com/veggiedefender/torrent-client/client"
+	"github.com/veggiedefender/torrent-client/message"
+	"github.com/veggiedefender/torrent-client/peers"
+	"github.com/veggiedefender/torrent-client/pex"
+)
+
+// joinSwarm records that we are connected to a peer, so it can be passed on
+// to other peers over PEX. It returns the key to leave the swarm with, or ""
+// if we don't know where the peer accepts connections.
+func (t *Torrent) joinSwarm(c *client.Client) string {
+	addr, ok := c.ListenAddr()
+	if !ok {
+		return ""
+	}
+	key := addr.String()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.swarm == nil {
+		t.swarm = make(map[string]peers.Peer)
+	}
+	t.swarm[key] = addr
+	return key
+}
+
+func (t *Torrent) leaveSwarm(key string) {
+	if key == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.swarm, key)
+}
+
+// swarmPeers returns the peers we are connected to, leaving out except
+func (t *Torrent) swarmPeers(except string) []peers.Peer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	found := make([]peers.Peer, 0, len(t.swarm))
+	for key, p := range t.swarm {
+		if key != except {
+			found = append(found, p)
+		}
+	}
+	return found
+}
+
+// sendPEX tells a peer about changes to the swarm if a message is due. PEX is
+// never used for private torrents.
+func (t *Torrent) sendPEX(c *client.Client, state *pex.State, self string) error {
+	if t.Private || !c.SupportsExtension(pex.ExtensionName) {
+		return nil
+	}
+	now := time.Now()
+	if !state.Due(now) {
+		return nil
+	}
+	m := state.Next(t.swarmPeers(self), now)
+	if m == nil {
+		return nil
+	}
+	payload, err := m.Serialize()
+	if err != nil {
+		return err
+	}
+	return c.SendExtended(pex.ExtensionName, payload)
+}
+
+// handleExtended handles an extension message, passing peers learned over PEX
+// to the running download
+func (t *Torrent) handleExtended(c *client.Client, msg *message.Message) error {
+	name, payload, err := c.HandleExtended(msg)
+	if err != nil {
+		return err
+	}
+	if name != pex.ExtensionName || t.Private {
+		return nil
+	}
+	m, err := pex.Parse(payload)
+	if err != nil {
+		return err
+	}
+	if len(m.Added) == 0 {
+		return nil
+	}
+	found := make([]peers.Peer, len(m.Added))
+	for i, p := range m.Added {
+		found[i] = p.Peer
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.exchanged == nil {
+		return nil
+	}
+	// Drop the peers if the download is busy rather than hold up the worker;
+	// more will come with the next message
+	select {
+	case t.exchanged <- found:
+	default:
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package p2p
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/torrent-client/handshake"
+	"github.com/veggiedefender/torrent-client/message"
+	"github.com/veggiedefender/torrent-client/peers"
+	"github.com/veggiedefender/torrent-client/pex"
+)
+
+// startPEXPeer runs a peer on loopback that only has the first piece of data,
+// and tells everyone who connects about others over PEX
+func startPEXPeer(t *testing.T, infoHash [20]byte, data []byte, pieceLength int, others []peers.Peer) (peers.Peer, net.Listener) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	numPieces := (len(data) + pieceLength - 1) / pieceLength
+	bf := make([]byte, (numPieces+7)/8)
+	bf[0] = 0x80
+
+	m := pex.Message{}
+	for _, p := range others {
+		m.Added = append(m.Added, pex.Peer{Peer: p})
+	}
+	payload, err := m.Serialize()
+	require.Nil(t, err)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				if _, err := handshake.Read(conn); err != nil {
+					return
+				}
+				hs := handshake.New(infoHash, [20]byte{})
+				hs.SetExtension(handshake.ExtensionProtocol)
+				conn.Write(hs.Serialize())
+				conn.Write(message.FormatExtended(0, []byte("d1:md6:ut_pexi3eee")).Serialize())
+				conn.Write(message.FormatBitfield(bf).Serialize())
+				conn.Write((&message.Message{ID: message.MsgUnchoke}).Serialize())
+				// We told the client ut_pex messages come with ID 3, but it
+				// said it wants them with its own ID
+				conn.Write(message.FormatExtended(1, payload).Serialize())
+				serveRequests(conn, data, pieceLength, nil)
+			}(conn)
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}, ln
+}
+
+func TestDownloadFromExchangedPeer(t *testing.T) {
+	torrent, data := testTorrent(t, 100000, 32768)
+	seeder, ln := startSeeder(t, torrent.InfoHash, data, torrent.PieceLength)
+	defer ln.Close()
+	pexPeer, pexLn := startPEXPeer(t, torrent.InfoHash, data, torrent.PieceLength, []peers.Peer{seeder})
+	defer pexLn.Close()
+	torrent.Peers = []peers.Peer{pexPeer}
+
+	// Only the seeder has the other pieces, so we can only finish if the
+	// first peer told us about it
+	buf, err := torrent.Download()
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+}
+
+func TestPrivateIgnoresExchangedPeers(t *testing.T) {
+	torrent, data := testTorrent(t, 100000, 32768)
+	seeder, ln := startSeeder(t, torrent.InfoHash, data, torrent.PieceLength)
+	defer ln.Close()
+	pexPeer, pexLn := startPEXPeer(t, torrent.InfoHash, data, torrent.PieceLength, []peers.Peer{seeder})
+	defer pexLn.Close()
+	torrent.Peers = []peers.Peer{pexPeer}
+	torrent.Private = true
+	connected := 0
+	torrent.OnEvent = func(e Event) {
+		if e.Type == EventPeerConnected {
+			connected++
+		}
+	}
+
+	// The first peer doesn't have every piece, so the download can't finish
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	_, err := torrent.DownloadContext(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 1, connected)
+}
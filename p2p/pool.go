@@ -0,0 +1,187 @@
+package p2p
+
+import (
+	"time"
+
+	"github.com/veggiedefender/torrent-client/peers"
+)
+
+// defaultMaxConns is how many peers a torrent connects to at once unless
+// MaxConns says otherwise
+const defaultMaxConns = 50
+
+// retryBackoff is how long we wait before connecting to a peer again after
+// its first failure. Each failure in a row doubles the wait, up to
+// maxRetryBackoff. It is a variable so tests can shorten it.
+var retryBackoff = 15 * time.Second
+
+const maxRetryBackoff = 10 * time.Minute
+
+// maxStallRetries is how many times in a row a peer can fail before a stalled
+// download stops waiting for it to come off its backoff
+const maxStallRetries = 3
+
+// maxCandidates caps the number of peers a pool remembers, so sources that
+// keep finding new peers can't grow it without bound
+const maxCandidates = 1000
+
+// fillInterval is how often a download checks for peers that are done
+// waiting out their backoff
+const fillInterval = time.Second
+
+// A candidate is a peer we could connect to, and what we know about it from
+// earlier connections
+type candidate struct {
+	peer peers.Peer
+	// seq orders candidates by when they were found
+	seq int
+	// connected is set while a worker has the peer
+	connected bool
+	// failures counts connections in a row that failed or got us nothing
+	failures int
+	// retryAt is when we may connect again
+	retryAt time.Time
+	// rate is how fast the peer sent us data the last time it sent any, in
+	// bytes per second
+	rate float64
+}
+
+// peerPool holds the peers a download has heard of from every source, and
+// picks which ones to connect to. It is only used by the download's main
+// loop, so it needs no locking.
+type peerPool struct {
+	candidates map[string]*candidate
+	seq        int
+}
+
+func newPeerPool() *peerPool {
+	return &peerPool{candidates: make(map[string]*candidate)}
+}
+
+// add adds peers that aren't in the pool yet. Peers already in it keep what
+// we know about them, so a source reporting a failing peer again doesn't
+// cut its backoff short. Once the pool is full, a new peer takes the place of
+// the one that failed most, and is dropped if none has failed.
+func (p *peerPool) add(found []peers.Peer) {
+	for _, peer := range found {
+		key := peer.String()
+		if _, ok := p.candidates[key]; ok {
+			continue
+		}
+		if len(p.candidates) >= maxCandidates && !p.evict() {
+			continue
+		}
+		p.seq++
+		p.candidates[key] = &candidate{peer: peer, seq: p.seq}
+	}
+}
+
+// evict removes the peer that failed most in a row and isn't connected,
+// preferring the oldest among equals. It tells if a peer was removed.
+func (p *peerPool) evict() bool {
+	var worst *candidate
+	var worstKey string
+	for key, c := range p.candidates {
+		if c.connected || c.failures == 0 {
+			continue
+		}
+		if worst == nil || c.failures > worst.failures || (c.failures == worst.failures && c.seq < worst.seq) {
+			worst, worstKey = c, key
+		}
+	}
+	if worst == nil {
+		return false
+	}
+	delete(p.candidates, worstKey)
+	return true
+}
+
+// next returns the best peer to connect to now, or nil if there is none.
+// Peers that sent data fastest come first, then peers that failed least,
+// then peers in the order they were found. usable can rule out peers for
+// other reasons, such as being banned.
+func (p *peerPool) next(now time.Time, usable func(peers.Peer) bool) *candidate {
+	var best *candidate
+	for _, c := range p.candidates {
+		if c.connected || now.Before(c.retryAt) || !usable(c.peer) {
+			continue
+		}
+		if best == nil || better(c, best) {
+			best = c
+		}
+	}
+	return best
+}
+
+func better(a, b *candidate) bool {
+	if a.rate != b.rate {
+		return a.rate > b.rate
+	}
+	if a.failures != b.failures {
+		return a.failures < b.failures
+	}
+	return a.seq < b.seq
+}
+
+// connect marks a peer as taken by a worker
+func (p *peerPool) connect(c *candidate) {
+	c.connected = true
+}
+
+// done records how a connection to a peer went once its worker exits. A
+// peer that sent data has its rate remembered and its failures forgiven.
+// Any other outcome counts as a failure. Either way, the peer waits out a
+// backoff before we connect again.
+func (p *peerPool) done(key string, res workerResult, now time.Time) {
+	c, ok := p.candidates[key]
+	if !ok {
+		return
+	}
+	c.connected = false
+	if res.rate > 0 {
+		c.rate = res.rate
+		c.failures = 0
+	} else {
+		c.failures++
+	}
+	c.retryAt = now.Add(backoff(c.failures))
+}
+
+// nextRetry returns when the soonest peer that is waiting out a backoff can
+// be tried again, or the zero time if no peer is waiting. Peers that failed
+// maxStallRetries times in a row are left out, so a stalled download that
+// waits on this gives up on peers that keep failing.
+func (p *peerPool) nextRetry(now time.Time) time.Time {
+	var soonest time.Time
+	for _, c := range p.candidates {
+		if c.connected || !now.Before(c.retryAt) || c.failures >= maxStallRetries {
+			continue
+		}
+		if soonest.IsZero() || c.retryAt.Before(soonest) {
+			soonest = c.retryAt
+		}
+	}
+	return soonest
+}
+
+// backoff returns how long to wait after failures failures in a row
+func backoff(failures int) time.Duration {
+	wait := retryBackoff
+	for i := 1; i < failures && wait < maxRetryBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxRetryBackoff {
+		wait = maxRetryBackoff
+	}
+	return wait
+}
+
+// workerResult is what a worker reports when it exits
+type workerResult struct {
+	key string
+	// peer is set for peer workers, and unset for web seeds and HTTP seeds
+	peer bool
+	// rate is how fast a peer sent us piece data, in bytes per second. It is
+	// zero if we never connected or got nothing.
+	rate float64
+}
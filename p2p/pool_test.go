@@ -0,0 +1,244 @@
+package p2p
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/torrent-client/handshake"
+	"github.com/veggiedefender/torrent-client/ipfilter"
+	"github.com/veggiedefender/torrent-client/message"
+	"github.com/veggiedefender/torrent-client/peers"
+)
+
+func testPeer(port uint16) peers.Peer {
+	return peers.Peer{IP: net.IP{127, 0, 0, 1}, Port: port}
+}
+
+func anyPeer(peers.Peer) bool { return true }
+
+func TestPeerPoolDedupes(t *testing.T) {
+	pool := newPeerPool()
+	pool.add([]peers.Peer{testPeer(1), testPeer(2)})
+	pool.add([]peers.Peer{testPeer(2), testPeer(3), testPeer(1)})
+	assert.Len(t, pool.candidates, 3)
+
+	now := time.Now()
+	var order []uint16
+	for c := pool.next(now, anyPeer); c != nil; c = pool.next(now, anyPeer) {
+		pool.connect(c)
+		order = append(order, c.peer.Port)
+	}
+	// With nothing else to go on, peers are tried in the order found
+	assert.Equal(t, []uint16{1, 2, 3}, order)
+}
+
+func TestPeerPoolPrefersFastPeers(t *testing.T) {
+	pool := newPeerPool()
+	pool.add([]peers.Peer{testPeer(1), testPeer(2), testPeer(3)})
+	now := time.Now()
+	pool.done(testPeer(2).String(), workerResult{rate: 100}, now)
+	pool.done(testPeer(3).String(), workerResult{rate: 5000}, now)
+
+	later := now.Add(time.Hour)
+	c := pool.next(later, anyPeer)
+	require.NotNil(t, c)
+	assert.Equal(t, uint16(3), c.peer.Port)
+	pool.connect(c)
+	assert.Equal(t, uint16(2), pool.next(later, anyPeer).peer.Port)
+
+	// Peers can be ruled out, for example when banned
+	c = pool.next(later, func(p peers.Peer) bool { return p.Port == 1 })
+	assert.Equal(t, uint16(1), c.peer.Port)
+}
+
+func TestPeerPoolBackoff(t *testing.T) {
+	pool := newPeerPool()
+	peer := testPeer(1)
+	pool.add([]peers.Peer{peer})
+	now := time.Now()
+
+	c := pool.next(now, anyPeer)
+	require.NotNil(t, c)
+	pool.connect(c)
+	assert.Nil(t, pool.next(now, anyPeer))
+
+	// Each failure in a row doubles the wait
+	pool.done(peer.String(), workerResult{}, now)
+	assert.Nil(t, pool.next(now, anyPeer))
+	assert.Equal(t, now.Add(retryBackoff), pool.nextRetry(now))
+	pool.done(peer.String(), workerResult{}, now)
+	assert.Equal(t, now.Add(2*retryBackoff), pool.nextRetry(now))
+
+	// Rediscovering the peer doesn't reset its backoff
+	pool.add([]peers.Peer{peer})
+	assert.Nil(t, pool.next(now, anyPeer))
+	assert.NotNil(t, pool.next(now.Add(2*retryBackoff), anyPeer))
+
+	// Sending data forgives the failures
+	pool.done(peer.String(), workerResult{rate: 1}, now)
+	assert.Equal(t, 0, c.failures)
+	assert.Equal(t, now.Add(retryBackoff), pool.nextRetry(now))
+
+	// A peer that keeps failing isn't worth waiting for, though it is still
+	// tried when it comes up
+	c.failures = maxStallRetries - 1
+	pool.done(peer.String(), workerResult{}, now)
+	assert.True(t, pool.nextRetry(now).IsZero())
+	assert.NotNil(t, pool.next(now.Add(maxRetryBackoff), anyPeer))
+}
+
+func TestPeerPoolIsCapped(t *testing.T) {
+	pool := newPeerPool()
+	var found []peers.Peer
+	for i := 0; i < maxCandidates; i++ {
+		found = append(found, testPeer(uint16(i+1)))
+	}
+	pool.add(found)
+	require.Len(t, pool.candidates, maxCandidates)
+
+	// Nobody has failed, so there is no room for more
+	pool.add([]peers.Peer{testPeer(60000)})
+	assert.Len(t, pool.candidates, maxCandidates)
+	assert.NotContains(t, pool.candidates, testPeer(60000).String())
+
+	// New peers take the places of those that failed most
+	now := time.Now()
+	for _, port := range []uint16{1, 2, 2, 3} {
+		c := pool.candidates[testPeer(port).String()]
+		pool.connect(c)
+		pool.done(testPeer(port).String(), workerResult{peer: true}, now)
+	}
+	pool.add([]peers.Peer{testPeer(60001), testPeer(60002)})
+	assert.Len(t, pool.candidates, maxCandidates)
+	assert.Contains(t, pool.candidates, testPeer(60001).String())
+	assert.Contains(t, pool.candidates, testPeer(60002).String())
+	assert.NotContains(t, pool.candidates, testPeer(1).String())
+	assert.NotContains(t, pool.candidates, testPeer(2).String())
+	assert.Contains(t, pool.candidates, testPeer(3).String())
+}
+
+func TestBackoff(t *testing.T) {
+	assert.Equal(t, retryBackoff, backoff(0))
+	assert.Equal(t, retryBackoff, backoff(1))
+	assert.Equal(t, 4*retryBackoff, backoff(3))
+	assert.Equal(t, maxRetryBackoff, backoff(100))
+}
+
+func TestDownloadRetriesFailedPeer(t *testing.T) {
+	testRetriesFailedPeer(t, 5*time.Second)
+}
+
+func TestDownloadRetriesFailedPeerWithoutStallTimeout(t *testing.T) {
+	// The download waits for the peer's backoff instead of giving up as soon
+	// as the tracker has nobody new
+	testRetriesFailedPeer(t, 0)
+}
+
+// testRetriesFailedPeer downloads from a peer that hangs up on the first
+// connection, which the tracker keeps returning
+func testRetriesFailedPeer(t *testing.T, stallTimeout time.Duration) {
+	defer func(b time.Duration) { retryBackoff = b }(retryBackoff)
+	retryBackoff = 50 * time.Millisecond
+
+	torrent, data := testTorrent(t, 100000, 32768)
+	numPieces := len(torrent.PieceHashes)
+	bf := make([]byte, (numPieces+7)/8)
+	for i := 0; i < numPieces; i++ {
+		bf[i/8] |= 1 << uint(7-i%8)
+	}
+
+	// The peer hangs up on its first connection
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	var accepted int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if atomic.AddInt32(&accepted, 1) == 1 {
+				conn.Close()
+				continue
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				if _, err := handshake.Read(conn); err != nil {
+					return
+				}
+				conn.Write(handshake.New(torrent.InfoHash, [20]byte{}).Serialize())
+				conn.Write(message.FormatBitfield(bf).Serialize())
+				conn.Write((&message.Message{ID: message.MsgUnchoke}).Serialize())
+				serveRequests(conn, data, torrent.PieceLength, nil)
+			}(conn)
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	peer := peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	torrent.Peers = []peers.Peer{peer}
+	torrent.Announce = func(ctx context.Context) ([]peers.Peer, error) {
+		return []peers.Peer{peer}, nil
+	}
+	torrent.StallTimeout = stallTimeout
+
+	buf, err := torrent.Download()
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&accepted))
+}
+
+func TestMaxConns(t *testing.T) {
+	torrent, data := testTorrent(t, 100000, 32768)
+	torrent.MaxConns = 1
+	for i := 0; i < 3; i++ {
+		peer, ln := startSeeder(t, torrent.InfoHash, data, torrent.PieceLength)
+		defer ln.Close()
+		torrent.Peers = append(torrent.Peers, peer)
+	}
+
+	maxPeers := 0
+	torrent.OnEvent = func(e Event) {
+		if e.NumPeers > maxPeers {
+			maxPeers = e.NumPeers
+		}
+	}
+	buf, err := torrent.Download()
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+	assert.Equal(t, 1, maxPeers)
+}
+
+func TestIPFilterSkipsPeers(t *testing.T) {
+	torrent, data := testTorrent(t, 100000, 32768)
+	good, goodLn := startSeeder(t, torrent.InfoHash, data, torrent.PieceLength)
+	defer goodLn.Close()
+	blockedLn, err := net.Listen("tcp", "127.0.0.2:0")
+	require.Nil(t, err)
+	defer blockedLn.Close()
+	var accepted int32
+	go func() {
+		for {
+			conn, err := blockedLn.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			conn.Close()
+		}
+	}()
+	addr := blockedLn.Addr().(*net.TCPAddr)
+	torrent.Peers = []peers.Peer{{IP: addr.IP, Port: uint16(addr.Port)}, good}
+	torrent.IPFilter = ipfilter.New()
+	require.Nil(t, torrent.IPFilter.Deny("127.0.0.2"))
+
+	buf, err := torrent.Download()
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&accepted))
+}
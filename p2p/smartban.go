@@ -0,0 +1,120 @@
+package p2p
+
+import (
+	"crypto/sha1"
+	"net"
+	"sync"
+)
+
+// maxHashFailures is how many pieces a peer can send that fail their hash
+// check before it is banned, even if we never find out which blocks were bad
+const maxHashFailures = 3
+
+// A smartBan finds the peers behind pieces that fail their hash check. It
+// keeps a hash of every block of a failed piece along with the peer that
+// sent it. Once the piece is downloaded again and passes, the blocks that
+// don't match the good copy point to the peers that sent bad data, so a
+// peer that only contributed good blocks to a failed piece isn't blamed.
+// Peers that keep contributing to failed pieces are banned regardless.
+type smartBan struct {
+	mu sync.Mutex
+	// failed maps piece indexes to the blocks of failed attempts at them
+	failed map[int][]blockRecord
+	// strikes counts the failed pieces of each peer
+	strikes map[string]int
+}
+
+// blockRecord is a block of a piece that failed its hash check
+type blockRecord struct {
+	peer   net.IP
+	begin  int
+	length int
+	hash   [20]byte
+}
+
+// pieceFailed remembers the blocks of a piece that failed its hash check.
+// senders holds the peer that sent each block, in order. It returns the
+// senders that have had a hand in too many failed pieces to be trusted.
+func (b *smartBan) pieceFailed(index int, buf []byte, senders []net.IP) []net.IP {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failed == nil {
+		b.failed = make(map[int][]blockRecord)
+		b.strikes = make(map[string]int)
+	}
+	struck := make(map[string]bool)
+	var banned []net.IP
+	for i, begin := 0, 0; begin < len(buf) && i < len(senders); i, begin = i+1, begin+MaxBlockSize {
+		end := begin + MaxBlockSize
+		if end > len(buf) {
+			end = len(buf)
+		}
+		peer := senders[i]
+		b.failed[index] = append(b.failed[index], blockRecord{
+			peer:   peer,
+			begin:  begin,
+			length: end - begin,
+			hash:   sha1.Sum(buf[begin:end]),
+		})
+		if struck[peer.String()] {
+			continue
+		}
+		struck[peer.String()] = true
+		b.strikes[peer.String()]++
+		if b.strikes[peer.String()] >= maxHashFailures {
+			banned = append(banned, peer)
+		}
+	}
+	return banned
+}
+
+// piecePassed compares the blocks of earlier failed attempts at a piece with
+// buf, the piece's data once it passed its hash check, and returns the peers
+// that sent blocks that don't match
+func (b *smartBan) piecePassed(index int, buf []byte) []net.IP {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	records := b.failed[index]
+	delete(b.failed, index)
+
+	var bad []net.IP
+	seen := make(map[string]bool)
+	for _, r := range records {
+		if r.begin+r.length > len(buf) || seen[r.peer.String()] {
+			continue
+		}
+		if sha1.Sum(buf[r.begin:r.begin+r.length]) != r.hash {
+			seen[r.peer.String()] = true
+			bad = append(bad, r.peer)
+		}
+	}
+	return bad
+}
+
+// blockSenders returns the senders of every block of a piece of length
+// bytes that came whole from peer
+func blockSenders(length int, peer net.IP) []net.IP {
+	senders := make([]net.IP, (length+MaxBlockSize-1)/MaxBlockSize)
+	for i := range senders {
+		senders[i] = peer
+	}
+	return senders
+}
+
+// pieceFailed records a piece that failed its hash check, whose blocks were
+// sent by senders, and bans those that have sent too many
+func (t *Torrent) pieceFailed(index int, buf []byte, senders []net.IP) {
+	for _, ip := range t.smartBan.pieceFailed(index, buf, senders) {
+		t.bans().Ban(ip)
+		t.log().With("peer", ip).Warnf("Banned after %d pieces failed their hash check", maxHashFailures)
+	}
+}
+
+// piecePassed bans the peers whose earlier attempts at a piece turn out to
+// have had bad blocks in them
+func (t *Torrent) piecePassed(index int, buf []byte) {
+	for _, ip := range t.smartBan.piecePassed(index, buf) {
+		t.bans().Ban(ip)
+		t.log().With("peer", ip).Warnf("Banned for sending corrupt data in piece #%d", index)
+	}
+}
@@ -0,0 +1,89 @@
+package p2p
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/torrent-client/peers"
+)
+
+func TestSmartBanFindsBadBlock(t *testing.T) {
+	var b smartBan
+	good := make([]byte, 3*MaxBlockSize)
+	for i := range good {
+		good[i] = byte(i)
+	}
+	// The piece was put together from blocks of two peers, and only the
+	// middle one, which badPeer sent, was corrupt
+	bad := append([]byte{}, good...)
+	bad[MaxBlockSize+10] ^= 0xff
+	goodPeer, badPeer := net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}
+	assert.Empty(t, b.pieceFailed(4, bad, []net.IP{goodPeer, badPeer, goodPeer}))
+
+	assert.Equal(t, []net.IP{badPeer}, b.piecePassed(4, good))
+	// The records are gone once the piece passed
+	assert.Empty(t, b.piecePassed(4, good))
+}
+
+func TestSmartBanSparesIntactAttempts(t *testing.T) {
+	var b smartBan
+	good := make([]byte, 2*MaxBlockSize)
+	// A peer whose blocks match the good copy isn't blamed, even when the
+	// piece failed as a whole
+	peer := net.IP{10, 0, 0, 1}
+	assert.Empty(t, b.pieceFailed(2, good, blockSenders(len(good), peer)))
+	assert.Empty(t, b.piecePassed(2, good))
+}
+
+func TestSmartBanStrikes(t *testing.T) {
+	var b smartBan
+	peer, other := net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}
+	buf := make([]byte, 2*MaxBlockSize)
+	for i := 1; i < maxHashFailures; i++ {
+		assert.Empty(t, b.pieceFailed(i, buf, blockSenders(len(buf), peer)))
+	}
+	// A piece counts once against each peer that sent part of it
+	assert.Equal(t, []net.IP{peer}, b.pieceFailed(0, buf, []net.IP{peer, other}))
+}
+
+func TestDownloadBansCorruptPeer(t *testing.T) {
+	torrent, data := testTorrent(t, 8*2*MaxBlockSize, 2*MaxBlockSize)
+	// The peers need addresses of their own, since bans go by IP
+	bad, badLn := startSeederWith(t, "127.0.0.2", torrent.InfoHash, data, torrent.PieceLength,
+		func(index, begin int, block []byte) {
+			// Corrupt the second block of every piece
+			if begin == MaxBlockSize {
+				block[0] ^= 0xff
+			}
+		})
+	defer badLn.Close()
+	good, goodLn := startSeeder(t, torrent.InfoHash, data, torrent.PieceLength)
+	defer goodLn.Close()
+	torrent.Peers = []peers.Peer{bad}
+	torrent.StallTimeout = 5 * time.Second
+	// The good peer only turns up once the bad one has had a go
+	torrent.Announce = func(ctx context.Context) ([]peers.Peer, error) {
+		select {
+		case <-time.After(200 * time.Millisecond):
+		case <-ctx.Done():
+		}
+		return []peers.Peer{good}, nil
+	}
+
+	failed := 0
+	torrent.OnEvent = func(e Event) {
+		if e.Type == EventPieceFailed {
+			failed++
+		}
+	}
+	buf, err := torrent.Download()
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+	assert.True(t, failed > 0)
+	assert.True(t, torrent.BanList.Banned(bad.IP))
+	assert.False(t, torrent.BanList.Banned(good.IP))
+}
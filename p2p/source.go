@@ -0,0 +1,50 @@
+package p2p
+
+import (
+	"context"
+	"time"
+
+	"github.com/veggiedefender/torrent-client/peers"
+)
+
+// lookupInterval is how often a download asks its tracker and peer sources
+// for more peers while it is running
+const lookupInterval = 15 * time.Minute
+
+// A PeerSource finds peers for torrents beyond what the tracker returns, such
+// as the DHT or local peer discovery. Sources that need to announce more often
+// than lookupInterval, like local peer discovery, do so on their own.
+type PeerSource interface {
+	// FindPeers returns peers for infoHash and lets the source know that we
+	// accept connections for it on port
+	FindPeers(ctx context.Context, infoHash [20]byte, port uint16) ([]peers.Peer, error)
+}
+
+type lookupResult struct {
+	found []peers.Peer
+	err   error
+}
+
+// lookups returns a function for each place the torrent can get peers from.
+// Private torrents are never looked up in Sources, which would tell others
+// their infohash.
+func (t *Torrent) lookups() []func(ctx context.Context) ([]peers.Peer, error) {
+	var lookups []func(ctx context.Context) ([]peers.Peer, error)
+	if t.Announce != nil {
+		lookups = append(lookups, t.announce)
+	}
+	if t.Private {
+		return lookups
+	}
+	for _, src := range t.Sources {
+		src := src
+		lookups = append(lookups, func(ctx context.Context) ([]peers.Peer, error) {
+			found, err := src.FindPeers(ctx, t.InfoHash, t.Port)
+			if err != nil {
+				t.log().Debugf("Peer source %T failed: %s", src, err)
+			}
+			return found, err
+		})
+	}
+	return lookups
+}
@@ -0,0 +1,230 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/veggiedefender/torrent-client/logger"
+	"github.com/veggiedefender/torrent-client/peers"
+	"github.com/veggiedefender/torrent-client/ratelimit"
+)
+
+// webSeedTimeout bounds each HTTP request to a web seed
+const webSeedTimeout = time.Minute
+
+// maxSeedWorkers is how many web seeds and HTTP seeds a download uses at
+// once. Torrents can list hundreds of mirrors, and a few of them are plenty.
+const maxSeedWorkers = 4
+
+// A seed is a web seed or HTTP seed, along with the worker that downloads
+// from it
+type seed struct {
+	url string
+	run func(ctx context.Context, base string, workQueue chan *pieceWork, results chan *pieceResult)
+}
+
+// seeds lists the torrent's web seeds and HTTP seeds
+func (t *Torrent) seeds() []seed {
+	var seeds []seed
+	for _, url := range t.WebSeeds {
+		seeds = append(seeds, seed{url, t.startWebSeedWorker})
+	}
+	for _, url := range t.HTTPSeeds {
+		seeds = append(seeds, seed{url, t.startHTTPSeedWorker})
+	}
+	return seeds
+}
+
+// A fileRange is a span of bytes to fetch from a file on a web seed
+type fileRange struct {
+	url   string
+	begin int
+	end   int
+}
+
+// webSeedRanges maps the bytes from begin to end of the torrent's data onto
+// the files that a web seed at base serves them from (BEP 19)
+func (t *Torrent) webSeedRanges(base string, begin, end int) []fileRange {
+	if t.Files == nil {
+		u := base
+		if strings.HasSuffix(u, "/") {
+			u += url.PathEscape(t.Name)
+		}
+		return []fileRange{{u, begin, end}}
+	}
+
+	root := base
+	if !strings.HasSuffix(root, "/") {
+		root += "/"
+	}
+	root += url.PathEscape(t.Name) + "/"
+	var ranges []fileRange
+	offset := 0
+	for _, f := range t.Files {
+		fileBegin, fileEnd := offset, offset+f.Length
+		offset = fileEnd
+		if f.Length == 0 || fileEnd <= begin || fileBegin >= end {
+			continue
+		}
+		elems := make([]string, len(f.Path))
+		for i, elem := range f.Path {
+			elems[i] = url.PathEscape(elem)
+		}
+		r := fileRange{url: root + strings.Join(elems, "/"), begin: 0, end: f.Length}
+		if begin > fileBegin {
+			r.begin = begin - fileBegin
+		}
+		if end < fileEnd {
+			r.end = end - fileBegin
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges
+}
+
+func (t *Torrent) httpClient() *http.Client {
+	if t.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return t.HTTPClient
+}
+
+// fetchRange reads r from a web seed into buf, which must be exactly as long
+// as r
+func (t *Torrent) fetchRange(ctx context.Context, r fileRange, buf []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, webSeedTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", r.begin, r.end-1))
+	resp, err := t.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server ignored the range and sent the whole file
+		_, err = io.CopyN(ioutil.Discard, resp.Body, int64(r.begin))
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Web seed %s returned %s", r.url, resp.Status)
+	}
+	_, err = io.ReadFull(resp.Body, buf)
+	return err
+}
+
+// downloadFromWebSeed fetches a piece from the web seed at base, piecing it
+// together from every file it spans
+func (t *Torrent) downloadFromWebSeed(ctx context.Context, base string, pw *pieceWork) ([]byte, error) {
+	begin, end := t.calculateBoundsForPiece(pw.index)
+	buf := make([]byte, pw.length)
+	offset := 0
+	for _, r := range t.webSeedRanges(base, begin, end) {
+		n := r.end - r.begin
+		err := t.fetchRange(ctx, r, buf[offset:offset+n])
+		if err != nil {
+			return nil, err
+		}
+		offset += n
+	}
+	if offset != len(buf) {
+		return nil, fmt.Errorf("Files only cover %d of %d bytes of piece #%d", offset, len(buf), pw.index)
+	}
+	return buf, nil
+}
+
+// A retryAfterError tells a seed worker that the seed is busy and to ask
+// again after a while
+type retryAfterError struct {
+	wait time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return fmt.Sprintf("Seed is busy, retry after %s", e.wait)
+}
+
+// startWebSeedWorker downloads pieces over HTTP from the web seed at base
+func (t *Torrent) startWebSeedWorker(ctx context.Context, base string, workQueue chan *pieceWork, results chan *pieceResult) {
+	fetch := func(ctx context.Context, pw *pieceWork) ([]byte, error) {
+		return t.downloadFromWebSeed(ctx, base, pw)
+	}
+	t.runSeedWorker(ctx, t.log().With("webseed", base), fetch, workQueue, results)
+}
+
+// runSeedWorker downloads pieces with fetch from a seed that has all of them.
+// It gives up on the seed at the first error other than a retryAfterError, or
+// at the first piece that fails its integrity check, since asking again will
+// give the same answer.
+func (t *Torrent) runSeedWorker(ctx context.Context, log logger.Logger, fetch func(context.Context, *pieceWork) ([]byte, error), workQueue chan *pieceWork, results chan *pieceResult) {
+	for {
+		var pw *pieceWork
+		select {
+		case pw = <-workQueue:
+		case <-ctx.Done():
+			return
+		}
+
+		buf, err := fetch(ctx, pw)
+		if retry, ok := err.(*retryAfterError); ok {
+			log.Debugf("%s", err)
+			workQueue <- pw // Put piece back on the queue
+			select {
+			case <-time.After(retry.wait):
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err != nil {
+			log.Debugf("Giving up on seed: %s", err)
+			workQueue <- pw // Put piece back on the queue
+			return
+		}
+
+		if err := checkIntegrity(pw, buf); err != nil {
+			log.Warnf("Piece #%d failed integrity check", pw.index)
+			t.emit(Event{Type: EventPieceFailed, Index: pw.index, NumPeers: int(atomic.LoadInt32(&t.connected)), Err: err})
+			workQueue <- pw
+			return
+		}
+		t.piecePassed(pw.index, buf)
+
+		err = waitLimiters(ctx, t.DownloadLimiters, len(buf))
+		if err != nil {
+			workQueue <- pw
+			return
+		}
+
+		select {
+		case results <- &pieceResult{pw.index, buf, peers.Peer{}}:
+		case <-ctx.Done():
+			workQueue <- pw
+			return
+		}
+	}
+}
+
+// waitLimiters blocks until every limiter lets n bytes through
+func waitLimiters(ctx context.Context, limiters []*ratelimit.Limiter, n int) error {
+	for _, l := range limiters {
+		err := l.WaitN(ctx, n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebSeedRanges(t *testing.T) {
+	torrent := Torrent{Name: "my torrent"}
+	assert.Equal(t, []fileRange{{"http://a/file", 10, 20}}, torrent.webSeedRanges("http://a/file", 10, 20))
+	assert.Equal(t, []fileRange{{"http://a/my%20torrent", 10, 20}}, torrent.webSeedRanges("http://a/", 10, 20))
+
+	torrent.Files = []File{
+		{Path: []string{"a"}, Length: 10},
+		{Path: []string{"empty"}, Length: 0},
+		{Path: []string{"dir", "b"}, Length: 10},
+		{Path: []string{"c"}, Length: 10},
+	}
+	assert.Equal(t, []fileRange{
+		{"http://a/my%20torrent/a", 5, 10},
+		{"http://a/my%20torrent/dir/b", 0, 10},
+		{"http://a/my%20torrent/c", 0, 2},
+	}, torrent.webSeedRanges("http://a", 5, 22))
+}
+
+// serveFiles serves each file in files with support for range requests
+func serveFiles(files map[string][]byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(data))
+	}))
+}
+
+func TestDownloadFromWebSeed(t *testing.T) {
+	torrent, data := testTorrent(t, 100000, 32768)
+	server := serveFiles(map[string][]byte{"/test": data})
+	defer server.Close()
+	torrent.WebSeeds = []string{server.URL + "/"}
+
+	buf, err := torrent.Download()
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+}
+
+func TestDownloadFromMultiFileWebSeed(t *testing.T) {
+	torrent, data := testTorrent(t, 100000, 32768)
+	torrent.Files = []File{
+		{Path: []string{"one"}, Length: 40000},
+		{Path: []string{"sub", "two"}, Length: 60000},
+	}
+	server := serveFiles(map[string][]byte{
+		"/files/test/one":     data[:40000],
+		"/files/test/sub/two": data[40000:],
+	})
+	defer server.Close()
+	torrent.WebSeeds = []string{server.URL + "/files"}
+
+	buf, err := torrent.Download()
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+}
+
+func TestBadWebSeed(t *testing.T) {
+	torrent, data := testTorrent(t, 100000, 32768)
+	corrupt := append([]byte{}, data...)
+	corrupt[0]++
+	server := serveFiles(map[string][]byte{"/test": corrupt})
+	defer server.Close()
+	torrent.WebSeeds = []string{server.URL + "/test"}
+	failed := 0
+	torrent.OnEvent = func(e Event) {
+		if e.Type == EventPieceFailed {
+			failed++
+		}
+	}
+
+	// The web seed is dropped at the first bad piece, leaving nobody to
+	// download from
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := torrent.DownloadContext(ctx)
+	assert.NotNil(t, err)
+	assert.NotEqual(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 1, failed)
+}
+
+func TestWebSeedsUsedAFewAtATime(t *testing.T) {
+	torrent, data := testTorrent(t, 40*16384, 16384)
+	var mu sync.Mutex
+	used := make(map[string]bool)
+	files := serveFiles(map[string][]byte{"/good": data})
+	defer files.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		used[r.URL.Path] = true
+		mu.Unlock()
+		if strings.HasPrefix(r.URL.Path, "/missing") {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, files.URL+"/good", http.StatusFound)
+	}))
+	defer server.Close()
+	// The first seeds are gone, so others take their places
+	for i := 0; i < 2; i++ {
+		torrent.WebSeeds = append(torrent.WebSeeds, fmt.Sprintf("%s/missing%d", server.URL, i))
+	}
+	for i := 0; i < 20; i++ {
+		torrent.WebSeeds = append(torrent.WebSeeds, fmt.Sprintf("%s/seed%d", server.URL, i))
+	}
+
+	buf, err := torrent.Download()
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+	good := 0
+	for path := range used {
+		if strings.HasPrefix(path, "/seed") {
+			good++
+		}
+	}
+	assert.True(t, good > 0 && good <= maxSeedWorkers)
+	assert.True(t, used["/missing0"] && used["/missing1"])
+}
@@ -0,0 +1,146 @@
+// Package peerid generates the peer ID we identify ourselves with, and tells
+// which client a peer runs from its peer ID (BEP 20)
+package peerid
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DefaultPrefix marks peer IDs as ours, in the Azureus style of a client
+// code and four version digits between dashes
+const DefaultPrefix = "-GT0001-"
+
+// idChars are the characters the random part of a peer ID is made of. They
+// keep the ID readable in tracker logs and need no escaping in URLs.
+const idChars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// New generates a peer ID that starts with prefix and is random after it.
+// The prefix defaults to DefaultPrefix.
+func New(prefix string) ([20]byte, error) {
+	var id [20]byte
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+	if len(prefix) > len(id) {
+		return id, fmt.Errorf("Peer ID prefix %q is longer than %d bytes", prefix, len(id))
+	}
+	n := copy(id[:], prefix)
+	_, err := rand.Read(id[n:])
+	if err != nil {
+		return id, err
+	}
+	for i := n; i < len(id); i++ {
+		id[i] = idChars[int(id[i])%len(idChars)]
+	}
+	return id, nil
+}
+
+// A Client is the software a peer runs
+type Client struct {
+	Name    string
+	Version string
+}
+
+func (c Client) String() string {
+	if c.Version == "" {
+		return c.Name
+	}
+	return c.Name + " " + c.Version
+}
+
+// azureusClients maps the client codes of Azureus-style peer IDs, like
+// "-qB4250-", to client names
+var azureusClients = map[string]string{
+	"AZ": "Vuze",
+	"BC": "BitComet",
+	"BI": "BiglyBT",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"FD": "Free Download Manager",
+	"GT": "torrent-client",
+	"KT": "KTorrent",
+	"LT": "libtorrent (Rasterbar)",
+	"lt": "libTorrent (Rakshasa)",
+	"qB": "qBittorrent",
+	"SD": "Thunder",
+	"TR": "Transmission",
+	"UM": "µTorrent Mac",
+	"UT": "µTorrent",
+	"WW": "WebTorrent",
+	"XL": "Xunlei",
+}
+
+// shadowClients maps the first character of Shadow-style peer IDs, like
+// "S58B-----", to client names
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+// Parse tells which client a peer runs from its peer ID. It understands
+// Azureus-style and Shadow-style IDs, and those of the mainline client, and
+// reports false for anything else. Azureus-style IDs with a client code it
+// doesn't know are named by their code.
+func Parse(id [20]byte) (Client, bool) {
+	switch {
+	case id[0] == '-' && id[7] == '-' && isAlnum(id[1]) && isAlnum(id[2]):
+		code := string(id[1:3])
+		name, ok := azureusClients[code]
+		if !ok {
+			name = code
+		}
+		return Client{Name: name, Version: version(id[3:7])}, true
+	case id[0] == 'M' && isDigit(id[1]) && id[7] == '-':
+		// Mainline: M followed by dash-separated numbers, like "M4-3-6--"
+		parts := strings.Split(strings.TrimRight(string(id[1:8]), "-"), "-")
+		for _, part := range parts {
+			if _, err := strconv.Atoi(part); err != nil {
+				return Client{}, false
+			}
+		}
+		return Client{Name: "Mainline", Version: strings.Join(parts, ".")}, true
+	case shadowClients[id[0]] != "" && isAlnum(id[1]) && id[5] == '-':
+		// Shadow: a letter followed by version digits padded with dashes
+		v := strings.TrimRight(string(id[1:6]), "-")
+		return Client{Name: shadowClients[id[0]], Version: version([]byte(v))}, true
+	}
+	return Client{}, false
+}
+
+// version turns version characters into a dotted version. Letters count
+// from 10, so "A" is 10, and trailing zeros are left out.
+func version(chars []byte) string {
+	var parts []string
+	for _, ch := range chars {
+		switch {
+		case isDigit(ch):
+			parts = append(parts, strconv.Itoa(int(ch-'0')))
+		case ch >= 'A' && ch <= 'Z':
+			parts = append(parts, strconv.Itoa(int(ch-'A')+10))
+		case ch >= 'a' && ch <= 'z':
+			parts = append(parts, strconv.Itoa(int(ch-'a')+36))
+		default:
+			parts = append(parts, "0")
+		}
+	}
+	for len(parts) > 2 && parts[len(parts)-1] == "0" {
+		parts = parts[:len(parts)-1]
+	}
+	return strings.Join(parts, ".")
+}
+
+func isDigit(ch byte) bool {
+	return ch >= '0' && ch <= '9'
+}
+
+func isAlnum(ch byte) bool {
+	return isDigit(ch) || ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z'
+}
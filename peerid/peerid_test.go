@@ -0,0 +1,98 @@
+package peerid
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func id(s string) [20]byte {
+	var id [20]byte
+	copy(id[:], s)
+	return id
+}
+
+func TestNew(t *testing.T) {
+	a, err := New("")
+	require.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(a[:]), DefaultPrefix))
+	for _, ch := range a[len(DefaultPrefix):] {
+		assert.Contains(t, idChars, string(ch))
+	}
+	b, err := New("")
+	require.Nil(t, err)
+	assert.NotEqual(t, a, b)
+
+	c, err := New("-XX1234-")
+	require.Nil(t, err)
+	assert.Equal(t, "-XX1234-", string(c[:8]))
+
+	_, err = New(strings.Repeat("x", 21))
+	assert.NotNil(t, err)
+}
+
+func TestParse(t *testing.T) {
+	tests := map[string]struct {
+		input  [20]byte
+		output Client
+		ok     bool
+	}{
+		"azureus": {
+			input:  id("-qB4250-abcdefghijkl"),
+			output: Client{Name: "qBittorrent", Version: "4.2.5"},
+			ok:     true,
+		},
+		"ours": {
+			input:  id("-GT0001-abcdefghijkl"),
+			output: Client{Name: "torrent-client", Version: "0.0.0.1"},
+			ok:     true,
+		},
+		"keeps two version parts": {
+			input:  id("-TR3000-abcdefghijkl"),
+			output: Client{Name: "Transmission", Version: "3.0"},
+			ok:     true,
+		},
+		"letter versions": {
+			input:  id("-UT355W-abcdefghijkl"),
+			output: Client{Name: "µTorrent", Version: "3.5.5.32"},
+			ok:     true,
+		},
+		"unknown code": {
+			input:  id("-ZZ1000-abcdefghijkl"),
+			output: Client{Name: "ZZ", Version: "1.0"},
+			ok:     true,
+		},
+		"mainline": {
+			input:  id("M4-3-6--abcdefghijkl"),
+			output: Client{Name: "Mainline", Version: "4.3.6"},
+			ok:     true,
+		},
+		"mainline with two digits": {
+			input:  id("M4-20-8-abcdefghijkl"),
+			output: Client{Name: "Mainline", Version: "4.20.8"},
+			ok:     true,
+		},
+		"shadow": {
+			input:  id("S58B-----abcdefghijk"),
+			output: Client{Name: "Shadow", Version: "5.8.11"},
+			ok:     true,
+		},
+		"random": {
+			input: [20]byte{0x8f, 0x01, 0x02},
+			ok:    false,
+		},
+	}
+
+	for name, test := range tests {
+		client, ok := Parse(test.input)
+		assert.Equal(t, test.ok, ok, name)
+		assert.Equal(t, test.output, client, name)
+	}
+}
+
+func TestClientString(t *testing.T) {
+	assert.Equal(t, "qBittorrent 4.2.5", Client{Name: "qBittorrent", Version: "4.2.5"}.String())
+	assert.Equal(t, "Mystery", Client{Name: "Mystery"}.String())
+}
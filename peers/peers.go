@@ -30,6 +30,39 @@ func Unmarshal(peersBin []byte) ([]Peer, error) {
 	return peers, nil
 }
 
+// Unmarshal6 parses IPv6 peer addresses and ports from a buffer in the
+// 18-byte compact format
+func Unmarshal6(peersBin []byte) ([]Peer, error) {
+	const peerSize = 18 // 16 for IP, 2 for port
+	numPeers := len(peersBin) / peerSize
+	if len(peersBin)%peerSize != 0 {
+		err := fmt.Errorf("Received malformed peers")
+		return nil, err
+	}
+	peers := make([]Peer, numPeers)
+	for i := 0; i < numPeers; i++ {
+		offset := i * peerSize
+		peers[i].IP = net.IP(peersBin[offset : offset+16])
+		peers[i].Port = binary.BigEndian.Uint16(peersBin[offset+16 : offset+18])
+	}
+	return peers, nil
+}
+
+// Marshal packs peers into the compact format, IPv4 peers into v4 and IPv6
+// peers into v6
+func Marshal(peers []Peer) (v4, v6 []byte) {
+	for _, p := range peers {
+		port := make([]byte, 2)
+		binary.BigEndian.PutUint16(port, p.Port)
+		if ip := p.IP.To4(); ip != nil {
+			v4 = append(append(v4, ip...), port...)
+		} else if ip := p.IP.To16(); ip != nil {
+			v6 = append(append(v6, ip...), port...)
+		}
+	}
+	return v4, v6
+}
+
 func (p Peer) String() string {
 	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
 }
@@ -53,3 +53,24 @@ func TestString(t *testing.T) {
 		assert.Equal(t, test.output, s)
 	}
 }
+
+func TestUnmarshal6(t *testing.T) {
+	input := []byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1a, 0xe1}
+	p, err := Unmarshal6(input)
+	assert.Nil(t, err)
+	assert.Equal(t, []Peer{{IP: net.ParseIP("2001:db8::1"), Port: 6881}}, p)
+
+	_, err = Unmarshal6(input[:17])
+	assert.NotNil(t, err)
+}
+
+func TestMarshal(t *testing.T) {
+	input := []Peer{
+		{IP: net.IP{127, 0, 0, 1}, Port: 80},
+		{IP: net.ParseIP("2001:db8::1"), Port: 6881},
+		{IP: net.ParseIP("1.1.1.1"), Port: 443},
+	}
+	v4, v6 := Marshal(input)
+	assert.Equal(t, []byte{127, 0, 0, 1, 0x00, 0x50, 1, 1, 1, 1, 0x01, 0xbb}, v4)
+	assert.Equal(t, []byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1a, 0xe1}, v6)
+}
@@ -0,0 +1,179 @@
+package pex
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/veggiedefender/torrent-client/peers"
+)
+
+// ExtensionName is the name ut_pex is registered under in the extension
+// handshake
+const ExtensionName = "ut_pex"
+
+// Interval is the least time allowed between two PEX messages to one peer
+const Interval = time.Minute
+
+// MaxPeers is the most peers a PEX message may add, and separately the most
+// it may drop
+const MaxPeers = 50
+
+// Flags describe an added peer
+type Flags byte
+
+const (
+	// FlagEncryption means the peer prefers encrypted connections
+	FlagEncryption Flags = 0x01
+	// FlagSeed means the peer is a seed or only uploads
+	FlagSeed Flags = 0x02
+	// FlagUTP means the peer supports uTP
+	FlagUTP Flags = 0x04
+	// FlagHolepunch means the peer supports the ut_holepunch extension
+	FlagHolepunch Flags = 0x08
+	// FlagReachable means the sender connected to the peer itself, so it
+	// accepts connections
+	FlagReachable Flags = 0x10
+)
+
+// Peer is a peer added by a PEX message
+type Peer struct {
+	peers.Peer
+	Flags Flags
+}
+
+// A Message lists the peers a sender connected to and disconnected from
+// since its last PEX message
+type Message struct {
+	Added   []Peer
+	Dropped []peers.Peer
+}
+
+type bencodeMessage struct {
+	Added    string `bencode:"added"`
+	AddedF   string `bencode:"added.f"`
+	Added6   string `bencode:"added6"`
+	Added6F  string `bencode:"added6.f"`
+	Dropped  string `bencode:"dropped"`
+	Dropped6 string `bencode:"dropped6"`
+}
+
+// withFlags pairs parsed peers with their flags. Missing flags are left zero.
+func withFlags(parsed []peers.Peer, flags string) []Peer {
+	added := make([]Peer, len(parsed))
+	for i, p := range parsed {
+		added[i].Peer = p
+		if i < len(flags) {
+			added[i].Flags = Flags(flags[i])
+		}
+	}
+	return added
+}
+
+// Parse parses the bencoded payload of a ut_pex message
+func Parse(payload []byte) (*Message, error) {
+	bm := bencodeMessage{}
+	err := bencode.Unmarshal(bytes.NewReader(payload), &bm)
+	if err != nil {
+		return nil, err
+	}
+
+	added, err := peers.Unmarshal([]byte(bm.Added))
+	if err != nil {
+		return nil, fmt.Errorf("Malformed added peers: %s", err)
+	}
+	added6, err := peers.Unmarshal6([]byte(bm.Added6))
+	if err != nil {
+		return nil, fmt.Errorf("Malformed added6 peers: %s", err)
+	}
+	dropped, err := peers.Unmarshal([]byte(bm.Dropped))
+	if err != nil {
+		return nil, fmt.Errorf("Malformed dropped peers: %s", err)
+	}
+	dropped6, err := peers.Unmarshal6([]byte(bm.Dropped6))
+	if err != nil {
+		return nil, fmt.Errorf("Malformed dropped6 peers: %s", err)
+	}
+
+	m := &Message{
+		Added:   append(withFlags(added, bm.AddedF), withFlags(added6, bm.Added6F)...),
+		Dropped: append(dropped, dropped6...),
+	}
+	return m, nil
+}
+
+// Serialize encodes the message as the payload of a ut_pex message. It fails
+// if the message adds or drops more than MaxPeers peers.
+func (m *Message) Serialize() ([]byte, error) {
+	if len(m.Added) > MaxPeers || len(m.Dropped) > MaxPeers {
+		return nil, fmt.Errorf("PEX message has too many peers: %d added, %d dropped", len(m.Added), len(m.Dropped))
+	}
+
+	bm := bencodeMessage{}
+	var flags, flags6 []byte
+	for _, p := range m.Added {
+		v4, v6 := peers.Marshal([]peers.Peer{p.Peer})
+		if v4 != nil {
+			bm.Added += string(v4)
+			flags = append(flags, byte(p.Flags))
+		} else if v6 != nil {
+			bm.Added6 += string(v6)
+			flags6 = append(flags6, byte(p.Flags))
+		}
+	}
+	bm.AddedF, bm.Added6F = string(flags), string(flags6)
+	dropped, dropped6 := peers.Marshal(m.Dropped)
+	bm.Dropped, bm.Dropped6 = string(dropped), string(dropped6)
+
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, bm)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// A State tracks what we last told one peer about the swarm, so the next
+// message only carries the difference
+type State struct {
+	sent     map[string]peers.Peer
+	lastSent time.Time
+}
+
+// NewState returns a State for a peer we haven't sent any PEX messages to
+func NewState() *State {
+	return &State{sent: make(map[string]peers.Peer)}
+}
+
+// Due tells if enough time has passed to send the peer another message
+func (s *State) Due(now time.Time) bool {
+	return s.lastSent.IsZero() || now.Sub(s.lastSent) >= Interval
+}
+
+// Next builds the message that brings the peer up to date with connected,
+// the peers we are connected to now, and records it as sent. Changes beyond
+// MaxPeers are left for later messages. It returns nil if nothing changed.
+func (s *State) Next(connected []peers.Peer, now time.Time) *Message {
+	m := &Message{}
+	current := make(map[string]bool, len(connected))
+	for _, p := range connected {
+		key := p.String()
+		current[key] = true
+		if _, ok := s.sent[key]; !ok && len(m.Added) < MaxPeers {
+			m.Added = append(m.Added, Peer{Peer: p, Flags: FlagReachable})
+			s.sent[key] = p
+		}
+	}
+	for key, p := range s.sent {
+		if !current[key] && len(m.Dropped) < MaxPeers {
+			m.Dropped = append(m.Dropped, p)
+			delete(s.sent, key)
+		}
+	}
+	if len(m.Added) == 0 && len(m.Dropped) == 0 {
+		return nil
+	}
+	s.lastSent = now
+	return m
+}
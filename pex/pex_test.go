@@ -0,0 +1,94 @@
+package pex
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/torrent-client/peers"
+)
+
+func TestParse(t *testing.T) {
+	payload := "d" +
+		"5:added" + "12:" + string([]byte{192, 0, 2, 1, 0x1a, 0xe1, 192, 0, 2, 2, 0x1a, 0xe2}) +
+		"7:added.f" + "2:" + string([]byte{0x12, 0x01}) +
+		"6:added6" + "18:" + string([]byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1a, 0xe1}) +
+		"8:added6.f" + "1:" + string([]byte{0x04}) +
+		"7:dropped" + "6:" + string([]byte{192, 0, 2, 3, 0x1a, 0xe3}) +
+		"e"
+	m, err := Parse([]byte(payload))
+	require.Nil(t, err)
+	assert.Equal(t, []Peer{
+		{Peer: peers.Peer{IP: net.IP{192, 0, 2, 1}, Port: 6881}, Flags: FlagReachable | FlagSeed},
+		{Peer: peers.Peer{IP: net.IP{192, 0, 2, 2}, Port: 6882}, Flags: FlagEncryption},
+		{Peer: peers.Peer{IP: net.ParseIP("2001:db8::1"), Port: 6881}, Flags: FlagUTP},
+	}, m.Added)
+	assert.Equal(t, []peers.Peer{{IP: net.IP{192, 0, 2, 3}, Port: 6883}}, m.Dropped)
+}
+
+func TestParseMalformed(t *testing.T) {
+	_, err := Parse([]byte("d5:added5:abcdee"))
+	assert.NotNil(t, err)
+	_, err = Parse([]byte("not bencode"))
+	assert.NotNil(t, err)
+}
+
+func TestSerializeRoundTrip(t *testing.T) {
+	m := &Message{
+		Added: []Peer{
+			{Peer: peers.Peer{IP: net.IP{192, 0, 2, 1}, Port: 6881}, Flags: FlagReachable},
+			{Peer: peers.Peer{IP: net.ParseIP("2001:db8::1"), Port: 6881}, Flags: FlagUTP},
+		},
+		Dropped: []peers.Peer{{IP: net.IP{192, 0, 2, 3}, Port: 6883}},
+	}
+	buf, err := m.Serialize()
+	require.Nil(t, err)
+	parsed, err := Parse(buf)
+	require.Nil(t, err)
+	assert.Equal(t, m.Added[0].Flags, parsed.Added[0].Flags)
+	assert.Equal(t, m.Added[1].Flags, parsed.Added[1].Flags)
+	assert.True(t, m.Added[0].IP.Equal(parsed.Added[0].IP))
+	assert.True(t, m.Added[1].IP.Equal(parsed.Added[1].IP))
+	assert.Len(t, parsed.Dropped, 1)
+}
+
+func TestSerializeTooMany(t *testing.T) {
+	m := &Message{Added: make([]Peer, MaxPeers+1)}
+	_, err := m.Serialize()
+	assert.NotNil(t, err)
+}
+
+func TestState(t *testing.T) {
+	a := peers.Peer{IP: net.IP{192, 0, 2, 1}, Port: 6881}
+	b := peers.Peer{IP: net.IP{192, 0, 2, 2}, Port: 6881}
+	s := NewState()
+	now := time.Now()
+	assert.True(t, s.Due(now))
+
+	m := s.Next([]peers.Peer{a, b}, now)
+	require.NotNil(t, m)
+	assert.Len(t, m.Added, 2)
+	assert.False(t, s.Due(now.Add(time.Second)))
+	assert.True(t, s.Due(now.Add(Interval)))
+
+	assert.Nil(t, s.Next([]peers.Peer{a, b}, now.Add(Interval)))
+
+	m = s.Next([]peers.Peer{a}, now.Add(2*Interval))
+	require.NotNil(t, m)
+	assert.Empty(t, m.Added)
+	assert.Equal(t, []peers.Peer{b}, m.Dropped)
+}
+
+func TestStateLimit(t *testing.T) {
+	var connected []peers.Peer
+	for i := 0; i < MaxPeers+10; i++ {
+		connected = append(connected, peers.Peer{IP: net.IP{10, 0, byte(i / 256), byte(i)}, Port: 6881})
+	}
+	s := NewState()
+	m := s.Next(connected, time.Now())
+	assert.Len(t, m.Added, MaxPeers)
+	m = s.Next(connected, time.Now().Add(Interval))
+	assert.Len(t, m.Added, 10)
+}
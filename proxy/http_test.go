@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startConnectServer runs an HTTP proxy that only supports CONNECT. If auth is
+// set, it must match the Proxy-Authorization header.
+func startConnectServer(t *testing.T, auth string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveConnect(conn, auth)
+		}
+	}()
+	return ln
+}
+
+func serveConnect(conn net.Conn, auth string) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return
+	}
+	if req.Method != http.MethodConnect {
+		io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+		return
+	}
+	if auth != "" && req.Header.Get("Proxy-Authorization") != auth {
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return
+	}
+	remote, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		return
+	}
+	defer remote.Close()
+	io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+	go io.Copy(remote, br)
+	io.Copy(conn, remote)
+}
+
+func TestHTTPConnect(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+	server := startConnectServer(t, auth)
+	defer server.Close()
+
+	p, err := New("http://alice:secret@"+server.Addr().String(), true)
+	require.Nil(t, err)
+	conn, err := p.DialContext(context.Background(), "tcp", echo.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello"))
+	require.Nil(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.Nil(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
+
+func TestHTTPConnectRefused(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	server := startConnectServer(t, "Basic c29tZW9uZTplbHNl")
+	defer server.Close()
+
+	p, err := New("http://alice:secret@"+server.Addr().String(), true)
+	require.Nil(t, err)
+	_, err = p.DialContext(context.Background(), "tcp", echo.Addr().String())
+	assert.NotNil(t, err)
+}
+
+func TestHTTPProxyCantRelayUDP(t *testing.T) {
+	p, err := New("http://127.0.0.1:3128", true)
+	require.Nil(t, err)
+	_, err = p.ListenPacket(context.Background())
+	assert.NotNil(t, err)
+	_, err = p.DialContext(context.Background(), "utp", "127.0.0.1:6881")
+	assert.NotNil(t, err)
+}
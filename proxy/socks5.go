@@ -0,0 +1,275 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// SOCKS5 protocol constants (RFC 1928, RFC 1929)
+const (
+	socksVersion     = 5
+	authNone         = 0x00
+	authPassword     = 0x02
+	authNoAcceptable = 0xff
+	cmdConnect       = 0x01
+	cmdAssociate     = 0x03
+	atypIPv4         = 0x01
+	atypDomain       = 0x03
+	atypIPv6         = 0x04
+)
+
+// socksConnect asks the SOCKS5 server on conn to connect to addr
+func (p *Proxy) socksConnect(conn net.Conn, addr string) error {
+	err := p.socksAuth(conn)
+	if err != nil {
+		return err
+	}
+	_, err = socksRequest(conn, cmdConnect, addr)
+	return err
+}
+
+// socksAssociate asks the SOCKS5 server on conn to relay UDP for us. The
+// association lasts as long as conn stays open, so it is closed along with
+// the returned PacketConn.
+func (p *Proxy) socksAssociate(conn net.Conn) (net.PacketConn, error) {
+	err := p.socksAuth(conn)
+	if err != nil {
+		return nil, err
+	}
+	// We don't know the address we'll send from behind NAT, so we leave it
+	// for the server to find out
+	relay, err := socksRequest(conn, cmdAssociate, "0.0.0.0:0")
+	if err != nil {
+		return nil, err
+	}
+	if relay.IP.IsUnspecified() {
+		// The relay is on the server we're talking to
+		relay.IP = conn.RemoteAddr().(*net.TCPAddr).IP
+	}
+
+	pc, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	c := &socksPacketConn{PacketConn: pc, relay: relay, ctrl: conn}
+	go c.watchControl()
+	return c, nil
+}
+
+// socksAuth greets the server and logs in if the proxy URL has credentials
+func (p *Proxy) socksAuth(conn net.Conn) error {
+	method := byte(authNone)
+	if p.url.User != nil {
+		method = authPassword
+	}
+	_, err := conn.Write([]byte{socksVersion, 1, method})
+	if err != nil {
+		return err
+	}
+	res := make([]byte, 2)
+	_, err = io.ReadFull(conn, res)
+	if err != nil {
+		return err
+	}
+	if res[0] != socksVersion {
+		return fmt.Errorf("Proxy speaks SOCKS version %d", res[0])
+	}
+	if res[1] == authNoAcceptable {
+		return fmt.Errorf("Proxy refused our authentication method")
+	}
+	if res[1] != method {
+		return fmt.Errorf("Proxy picked authentication method %d we didn't offer", res[1])
+	}
+	if method == authNone {
+		return nil
+	}
+
+	user := p.url.User.Username()
+	password, _ := p.url.User.Password()
+	if len(user) > 255 || len(password) > 255 {
+		return fmt.Errorf("Proxy username or password is too long")
+	}
+	req := []byte{1, byte(len(user))}
+	req = append(req, user...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	_, err = conn.Write(req)
+	if err != nil {
+		return err
+	}
+	_, err = io.ReadFull(conn, res)
+	if err != nil {
+		return err
+	}
+	if res[1] != 0 {
+		return fmt.Errorf("Proxy rejected our username and password")
+	}
+	return nil
+}
+
+// socksRequest sends a command and returns the address the server bound for
+// it
+func socksRequest(conn net.Conn, cmd byte, addr string) (*net.UDPAddr, error) {
+	target, err := socksAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	req := append([]byte{socksVersion, cmd, 0}, target...)
+	_, err = conn.Write(req)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]byte, 3)
+	_, err = io.ReadFull(conn, res)
+	if err != nil {
+		return nil, err
+	}
+	if res[0] != socksVersion {
+		return nil, fmt.Errorf("Proxy speaks SOCKS version %d", res[0])
+	}
+	if res[1] != 0 {
+		return nil, fmt.Errorf("Proxy failed the request with code %d", res[1])
+	}
+	return readSocksAddr(conn)
+}
+
+// socksAddr encodes an address the way SOCKS5 requests and UDP headers carry
+// it
+func socksAddr(addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Bad port in %s", addr)
+	}
+
+	var buf []byte
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("Host name %s is too long", host)
+		}
+		buf = append([]byte{atypDomain, byte(len(host))}, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		buf = append([]byte{atypIPv4}, ip4...)
+	} else {
+		buf = append([]byte{atypIPv6}, ip.To16()...)
+	}
+	return append(buf, byte(port>>8), byte(port)), nil
+}
+
+// readSocksAddr reads an address in the SOCKS5 encoding. Domain names are
+// resolved, since the callers need an IP.
+func readSocksAddr(r io.Reader) (*net.UDPAddr, error) {
+	atyp := make([]byte, 1)
+	_, err := io.ReadFull(r, atyp)
+	if err != nil {
+		return nil, err
+	}
+	var host string
+	switch atyp[0] {
+	case atypIPv4, atypIPv6:
+		ip := make([]byte, net.IPv4len)
+		if atyp[0] == atypIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		_, err = io.ReadFull(r, ip)
+		if err != nil {
+			return nil, err
+		}
+		host = net.IP(ip).String()
+	case atypDomain:
+		length := make([]byte, 1)
+		_, err = io.ReadFull(r, length)
+		if err != nil {
+			return nil, err
+		}
+		name := make([]byte, length[0])
+		_, err = io.ReadFull(r, name)
+		if err != nil {
+			return nil, err
+		}
+		host = string(name)
+	default:
+		return nil, fmt.Errorf("Unknown SOCKS address type %d", atyp[0])
+	}
+	port := make([]byte, 2)
+	_, err = io.ReadFull(r, port)
+	if err != nil {
+		return nil, err
+	}
+	return net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+}
+
+// socksPacketConn sends and receives datagrams through a SOCKS5 UDP relay,
+// adding and stripping the header that says where each one goes
+type socksPacketConn struct {
+	net.PacketConn
+	relay *net.UDPAddr
+	// ctrl is the TCP connection that keeps the association alive
+	ctrl      net.Conn
+	closeOnce sync.Once
+}
+
+func (c *socksPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	target, err := socksAddr(addr.String())
+	if err != nil {
+		return 0, err
+	}
+	// RSV and FRAG, which we never use
+	buf := append([]byte{0, 0, 0}, target...)
+	buf = append(buf, b...)
+	_, err = c.PacketConn.WriteTo(buf, c.relay)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *socksPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, len(b)+262)
+	for {
+		n, from, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !udpAddrEqual(from, c.relay) || n < 3 || buf[2] != 0 {
+			// Not from the relay, or a fragment, which we don't reassemble
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		addr, err := readSocksAddr(r)
+		if err != nil {
+			continue
+		}
+		return copy(b, buf[n-r.Len():n]), addr, nil
+	}
+}
+
+// watchControl closes the PacketConn if the server ends the association
+func (c *socksPacketConn) watchControl() {
+	io.Copy(ioutil.Discard, c.ctrl)
+	c.Close()
+}
+
+func (c *socksPacketConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.ctrl.Close()
+		err = c.PacketConn.Close()
+	})
+	return err
+}
+
+func udpAddrEqual(a net.Addr, b *net.UDPAddr) bool {
+	u, ok := a.(*net.UDPAddr)
+	return ok && u.Port == b.Port && u.IP.Equal(b.IP)
+}
@@ -0,0 +1,289 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/torrent-client/utp"
+)
+
+// socksServer is a minimal SOCKS5 server that supports CONNECT and UDP
+// ASSOCIATE, with optional username and password
+type socksServer struct {
+	ln       net.Listener
+	user     string
+	password string
+}
+
+func startSocksServer(t *testing.T, user, password string) *socksServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	s := &socksServer{ln: ln, user: user, password: password}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *socksServer) serve(conn net.Conn) {
+	defer conn.Close()
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return
+	}
+	methods := make([]byte, buf[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	want := byte(authNone)
+	if s.user != "" {
+		want = authPassword
+	}
+	if bytes.IndexByte(methods, want) < 0 {
+		conn.Write([]byte{socksVersion, authNoAcceptable})
+		return
+	}
+	conn.Write([]byte{socksVersion, want})
+	if want == authPassword {
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		user := make([]byte, buf[1])
+		io.ReadFull(conn, user)
+		io.ReadFull(conn, buf[:1])
+		password := make([]byte, buf[0])
+		io.ReadFull(conn, password)
+		if string(user) != s.user || string(password) != s.password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	req := make([]byte, 3)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return
+	}
+	target, err := readSocksAddr(conn)
+	if err != nil {
+		return
+	}
+	switch req[1] {
+	case cmdConnect:
+		remote, err := net.Dial("tcp", target.String())
+		if err != nil {
+			conn.Write([]byte{socksVersion, 5, 0, atypIPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer remote.Close()
+		bound, _ := socksAddr(remote.LocalAddr().String())
+		conn.Write(append([]byte{socksVersion, 0, 0}, bound...))
+		go io.Copy(remote, conn)
+		io.Copy(conn, remote)
+	case cmdAssociate:
+		relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return
+		}
+		defer relay.Close()
+		// Answer with an unspecified IP, so the client has to use ours
+		port := relay.LocalAddr().(*net.UDPAddr).Port
+		bound, _ := socksAddr(net.JoinHostPort("0.0.0.0", strconv.Itoa(port)))
+		conn.Write(append([]byte{socksVersion, 0, 0}, bound...))
+		go relayUDP(relay)
+		io.Copy(ioutil.Discard, conn)
+	default:
+		conn.Write([]byte{socksVersion, 7, 0, atypIPv4, 0, 0, 0, 0, 0, 0})
+	}
+}
+
+// relayUDP forwards datagrams between the one client of an association and
+// everyone else
+func relayUDP(relay net.PacketConn) {
+	var client net.Addr
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := relay.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if client == nil || from.String() == client.String() {
+			client = from
+			r := bytes.NewReader(buf[3:n])
+			target, err := readSocksAddr(r)
+			if err != nil {
+				continue
+			}
+			relay.WriteTo(buf[n-r.Len():n], target)
+			continue
+		}
+		header, _ := socksAddr(from.String())
+		msg := append(append([]byte{0, 0, 0}, header...), buf[:n]...)
+		relay.WriteTo(msg, client)
+	}
+}
+
+func startEchoServer(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestSocksConnect(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	tests := map[string]struct {
+		url   string
+		fails bool
+	}{
+		"no auth": {
+			url: "socks5://%s",
+		},
+		"password": {
+			url: "socks5://alice:secret@%s",
+		},
+		"wrong password": {
+			url:   "socks5://alice:wrong@%s",
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			user, password := "", ""
+			if name != "no auth" {
+				user, password = "alice", "secret"
+			}
+			server := startSocksServer(t, user, password)
+			defer server.ln.Close()
+
+			p, err := New(fmt.Sprintf(test.url, server.ln.Addr()), true)
+			require.Nil(t, err)
+			conn, err := p.DialContext(context.Background(), "tcp", echo.Addr().String())
+			if test.fails {
+				assert.NotNil(t, err)
+				return
+			}
+			require.Nil(t, err)
+			defer conn.Close()
+
+			_, err = conn.Write([]byte("hello"))
+			require.Nil(t, err)
+			buf := make([]byte, 5)
+			_, err = io.ReadFull(conn, buf)
+			require.Nil(t, err)
+			assert.Equal(t, "hello", string(buf))
+		})
+	}
+}
+
+func TestSocksAssociate(t *testing.T) {
+	server := startSocksServer(t, "", "")
+	defer server.ln.Close()
+	p, err := New("socks5://"+server.ln.Addr().String(), true)
+	require.Nil(t, err)
+
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], from)
+		}
+	}()
+
+	pc, err := p.ListenPacket(context.Background())
+	require.Nil(t, err)
+	defer pc.Close()
+	_, err = pc.WriteTo([]byte("ping"), echo.LocalAddr())
+	require.Nil(t, err)
+
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	n, from, err := pc.ReadFrom(buf)
+	require.Nil(t, err)
+	assert.Equal(t, "ping", string(buf[:n]))
+	assert.Equal(t, echo.LocalAddr().String(), from.String())
+}
+
+func TestSocksUTP(t *testing.T) {
+	server := startSocksServer(t, "", "")
+	defer server.ln.Close()
+	p, err := New("socks5://"+server.ln.Addr().String(), true)
+	require.Nil(t, err)
+
+	peer, err := utp.Listen("127.0.0.1:0")
+	require.Nil(t, err)
+	defer peer.Close()
+	go func() {
+		conn, err := peer.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := p.DialContext(ctx, "utp", peer.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello"))
+	require.Nil(t, err)
+	buf := make([]byte, 5)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(conn, buf)
+	require.Nil(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
+
+func TestSocksAddr(t *testing.T) {
+	for _, addr := range []string{"1.2.3.4:6881", "[2001:db8::1]:80", "localhost:1080"} {
+		buf, err := socksAddr(addr)
+		require.Nil(t, err)
+		parsed, err := readSocksAddr(bytes.NewReader(buf))
+		require.Nil(t, err)
+		_, port, _ := net.SplitHostPort(addr)
+		assert.Equal(t, port, strconv.Itoa(parsed.Port))
+	}
+
+	_, err := socksAddr("1.2.3.4:70000")
+	assert.NotNil(t, err)
+	_, err = readSocksAddr(bytes.NewReader([]byte{9, 0, 0}))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,76 @@
+package ratelimit
+
+import "sync"
+
+// A Pool hands out Limiters that share a rate but each cap one connection on
+// its own. Changing the pool's rate changes every limiter it has handed out
+// that hasn't been put back. A nil Pool hands out nil Limiters, which allow
+// any rate.
+type Pool struct {
+	mu       sync.Mutex
+	rate     int
+	limiters map[*Limiter]struct{}
+}
+
+// NewPool returns a Pool whose limiters allow rate bytes per second. A rate
+// of zero means unlimited.
+func NewPool(rate int) *Pool {
+	return &Pool{rate: rate, limiters: make(map[*Limiter]struct{})}
+}
+
+// Get returns a new Limiter at the pool's rate. Put it back once the
+// connection it caps is closed.
+func (p *Pool) Get() *Limiter {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	l := NewLimiter(p.rate)
+	p.limiters[l] = struct{}{}
+	return l
+}
+
+// Put stops the pool from changing l's rate
+func (p *Pool) Put(l *Limiter) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.limiters, l)
+}
+
+// Rate returns the rate of the pool's limiters in bytes per second
+func (p *Pool) Rate() int {
+	if p == nil {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.rate
+}
+
+// SetRate changes the rate of every limiter in the pool, and of those it
+// hands out from now on. Zero removes the limit.
+func (p *Pool) SetRate(rate int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rate = rate
+	for l := range p.limiters {
+		l.SetRate(rate)
+	}
+}
+
+// Len returns how many limiters are out of the pool
+func (p *Pool) Len() int {
+	if p == nil {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.limiters)
+}
@@ -0,0 +1,33 @@
+package ratelimit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPool(t *testing.T) {
+	p := NewPool(100)
+	a := p.Get()
+	b := p.Get()
+	assert.Equal(t, 100, a.Rate())
+	assert.Equal(t, 2, p.Len())
+
+	p.Put(b)
+	p.SetRate(50)
+	assert.Equal(t, 50, p.Rate())
+	assert.Equal(t, 50, a.Rate())
+	// b was put back, so it keeps the rate it had
+	assert.Equal(t, 100, b.Rate())
+	assert.Equal(t, 50, p.Get().Rate())
+}
+
+func TestNilPool(t *testing.T) {
+	var p *Pool
+	l := p.Get()
+	assert.Nil(t, l)
+	p.Put(l)
+	p.SetRate(1024)
+	assert.Equal(t, 0, p.Rate())
+	assert.Equal(t, 0, p.Len())
+}
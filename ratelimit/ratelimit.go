@@ -0,0 +1,93 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// A Limiter is a token bucket that caps a transfer rate in bytes per second.
+// It is safe for concurrent use, and its rate can be changed at any time. A
+// nil Limiter, or one with a rate of zero, allows any rate.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   int
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a Limiter that allows rate bytes per second, with
+// bursts of up to one second's worth. A rate of zero means unlimited.
+func NewLimiter(rate int) *Limiter {
+	return &Limiter{rate: rate, tokens: float64(rate), last: time.Now()}
+}
+
+// Rate returns the current limit in bytes per second
+func (l *Limiter) Rate() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// SetRate changes the limit to rate bytes per second. Zero removes the limit.
+// It does nothing on a nil Limiter, which stays unlimited.
+func (l *Limiter) SetRate(rate int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	l.rate = rate
+	if l.tokens > float64(rate) {
+		l.tokens = float64(rate)
+	}
+}
+
+// refill adds the tokens earned since the last call, up to one second's worth
+func (l *Limiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+}
+
+// reserve takes n tokens, going into debt if there aren't enough, and
+// returns how long the caller has to wait for the debt to be paid off
+func (l *Limiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+// WaitN blocks until n bytes can be transferred without exceeding the rate,
+// or until ctx is done. n may be larger than the burst size.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	wait := l.reserve(n)
+	if wait == 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
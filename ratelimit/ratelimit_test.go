@@ -0,0 +1,46 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWaitN(t *testing.T) {
+	l := NewLimiter(100000)
+	start := time.Now()
+	// The first 100000 bytes come out of the initial burst, and the next
+	// 50000 take half a second
+	for i := 0; i < 15; i++ {
+		assert.Nil(t, l.WaitN(context.Background(), 10000))
+	}
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 400*time.Millisecond, "took %s", elapsed)
+	assert.True(t, elapsed < 2*time.Second, "took %s", elapsed)
+}
+
+func TestUnlimited(t *testing.T) {
+	var nilLimiter *Limiter
+	assert.Nil(t, nilLimiter.WaitN(context.Background(), 1<<30))
+	assert.Equal(t, 0, nilLimiter.Rate())
+	nilLimiter.SetRate(10)
+	assert.Equal(t, 0, nilLimiter.Rate())
+
+	l := NewLimiter(0)
+	start := time.Now()
+	assert.Nil(t, l.WaitN(context.Background(), 1<<30))
+	assert.True(t, time.Since(start) < 100*time.Millisecond)
+}
+
+func TestSetRate(t *testing.T) {
+	l := NewLimiter(10)
+	l.SetRate(0)
+	assert.Nil(t, l.WaitN(context.Background(), 1<<20))
+	l.SetRate(1)
+	assert.Equal(t, 1, l.Rate())
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, l.WaitN(ctx, 1000))
+}
@@ -0,0 +1,403 @@
+package session
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/veggiedefender/torrent-client/client"
+	"github.com/veggiedefender/torrent-client/handshake"
+	"github.com/veggiedefender/torrent-client/ipfilter"
+	"github.com/veggiedefender/torrent-client/logger"
+	"github.com/veggiedefender/torrent-client/mse"
+	"github.com/veggiedefender/torrent-client/p2p"
+	"github.com/veggiedefender/torrent-client/peerid"
+	"github.com/veggiedefender/torrent-client/proxy"
+	"github.com/veggiedefender/torrent-client/ratelimit"
+	"github.com/veggiedefender/torrent-client/torrentfile"
+	"github.com/veggiedefender/torrent-client/utp"
+)
+
+// Config configures a Session. The zero value is ready to use.
+type Config struct {
+	// ListenAddr is the address to accept peer connections on, over both TCP
+	// and uTP. It defaults to torrentfile.Port on every interface.
+	ListenAddr string
+	// Listener, if set, accepts peer connections in place of listening on
+	// ListenAddr. The session closes it when it is closed.
+	Listener net.Listener
+	// Dialer, if set, opens the connections to peers
+	Dialer client.Dialer
+	// Proxy, if set, carries connections to peers, trackers and web seeds.
+	// Dialer takes precedence for peers.
+	Proxy *proxy.Proxy
+	// PeerID identifies us to peers and trackers. If it is left zero, one is
+	// generated that starts with PeerIDPrefix, or peerid.DefaultPrefix.
+	PeerID       [20]byte
+	PeerIDPrefix string
+	// MaxConns caps the number of peer connections across every torrent.
+	// Zero means no limit.
+	MaxConns int
+	// MaxConnsPerTorrent caps the number of peers each torrent is connected
+	// to. It defaults to 50.
+	MaxConnsPerTorrent int
+	// DownloadRate caps the combined download rate of every torrent in bytes
+	// per second. Zero means no limit.
+	DownloadRate int
+	// UploadRate caps the combined upload rate of every torrent in bytes per
+	// second. Zero means no limit.
+	UploadRate int
+	// PeerDownloadRate and PeerUploadRate cap the rates of each peer
+	// connection on its own, in bytes per second. Zero means no limit.
+	PeerDownloadRate int
+	PeerUploadRate   int
+	// LimitPayloadOnly counts only piece data against the rate limits,
+	// leaving protocol overhead unlimited
+	LimitPayloadOnly bool
+	// IPFilter, if set, blocks address ranges that no torrent connects to or
+	// accepts connections from
+	IPFilter *ipfilter.Filter
+	// StallTimeout is how long a torrent keeps looking for peers after losing
+	// all of them before it fails
+	StallTimeout time.Duration
+	// Sources are asked for peers for every torrent, alongside its tracker
+	Sources []p2p.PeerSource
+	// Encryption decides whether connections use Message Stream Encryption,
+	// both those we open and those peers open to us
+	Encryption mse.Policy
+	// Transport decides whether connections we open use TCP, uTP or both
+	Transport client.TransportPolicy
+	// Logger receives log messages from the session and its torrents
+	Logger logger.Logger
+	// OnEvent, if set, receives progress events from every torrent
+	OnEvent func(infoHash [20]byte, e p2p.Event)
+}
+
+// A Session downloads many torrents at once, sharing a listen port, peer ID
+// and connection and bandwidth limits among them
+type Session struct {
+	cfg    Config
+	peerID [20]byte
+	port   uint16
+	ln     net.Listener
+	// utp accepts and dials uTP connections. It is nil if its UDP port
+	// could not be bound.
+	utp   *utp.Socket
+	conns *p2p.ConnLimiter
+	// bans is shared by every torrent, so a peer caught sending corrupt data
+	// for one is shut out of all of them
+	bans     *p2p.BanList
+	download *ratelimit.Limiter
+	upload   *ratelimit.Limiter
+	// peerDownload and peerUpload hand out the limiters of each connection
+	peerDownload *ratelimit.Pool
+	peerUpload   *ratelimit.Pool
+	// httpClient goes through cfg.Proxy, if there is one
+	httpClient *http.Client
+	log        logger.Logger
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*Torrent
+	// handshaking holds the connections peers opened to us that haven't
+	// been handed to a torrent yet
+	handshaking map[net.Conn]bool
+	closed      bool
+	wg          sync.WaitGroup
+}
+
+// New starts a session listening for peer connections on cfg.ListenAddr
+func New(cfg Config) (*Session, error) {
+	s := &Session{
+		cfg:          cfg,
+		peerID:       cfg.PeerID,
+		bans:         p2p.NewBanList(),
+		download:     ratelimit.NewLimiter(cfg.DownloadRate),
+		upload:       ratelimit.NewLimiter(cfg.UploadRate),
+		peerDownload: ratelimit.NewPool(cfg.PeerDownloadRate),
+		peerUpload:   ratelimit.NewPool(cfg.PeerUploadRate),
+		log:          cfg.Logger,
+		torrents:     make(map[[20]byte]*Torrent),
+		handshaking:  make(map[net.Conn]bool),
+	}
+	if s.log == nil {
+		s.log = logger.Discard
+	}
+	if cfg.Proxy != nil {
+		s.httpClient = cfg.Proxy.HTTPClient()
+	}
+	if cfg.MaxConns > 0 {
+		s.conns = p2p.NewConnLimiter(cfg.MaxConns)
+	}
+	if s.peerID == [20]byte{} {
+		var err error
+		s.peerID, err = peerid.New(cfg.PeerIDPrefix)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Listener != nil {
+		s.ln = cfg.Listener
+		s.port = listenPort(cfg.Listener.Addr())
+	} else {
+		err := s.listen()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.wg.Add(1)
+	go s.acceptLoop(s.ln)
+	return s, nil
+}
+
+// listen accepts connections on cfg.ListenAddr, over TCP and uTP
+func (s *Session) listen() error {
+	addr := s.cfg.ListenAddr
+	if addr == "" {
+		addr = fmt.Sprintf(":%d", torrentfile.Port)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.ln = ln
+	s.port = uint16(ln.Addr().(*net.TCPAddr).Port)
+
+	// uTP listens on the same port number, over UDP
+	ip := ln.Addr().(*net.TCPAddr).IP
+	socket, err := utp.Listen(net.JoinHostPort(ip.String(), fmt.Sprint(s.port)))
+	if err != nil {
+		s.log.Warnf("Not accepting uTP connections: %s", err)
+		return nil
+	}
+	s.utp = socket
+	s.wg.Add(1)
+	go s.acceptLoop(socket)
+	return nil
+}
+
+// listenPort returns the port of a listener's address, or zero if it has none
+func listenPort(addr net.Addr) uint16 {
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return 0
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return 0
+	}
+	return uint16(n)
+}
+
+// Port returns the port the session accepts peer connections on
+func (s *Session) Port() uint16 {
+	return s.port
+}
+
+// PeerID returns the peer ID the session identifies itself with
+func (s *Session) PeerID() [20]byte {
+	return s.peerID
+}
+
+// SetDownloadRate changes the combined download limit of every torrent in
+// bytes per second. Zero removes the limit.
+func (s *Session) SetDownloadRate(rate int) {
+	s.download.SetRate(rate)
+}
+
+// SetUploadRate changes the combined upload limit of every torrent in bytes
+// per second. Zero removes the limit.
+func (s *Session) SetUploadRate(rate int) {
+	s.upload.SetRate(rate)
+}
+
+// SetPeerRates changes the download and upload limits of each peer
+// connection in bytes per second, including those already open. Zero
+// removes a limit.
+func (s *Session) SetPeerRates(download, upload int) {
+	s.peerDownload.SetRate(download)
+	s.peerUpload.SetRate(upload)
+}
+
+// BanList returns the peers that every torrent in the session refuses to
+// talk to
+func (s *Session) BanList() *p2p.BanList {
+	return s.bans
+}
+
+// Add starts downloading tf to a file at path, or for a multi-file torrent,
+// to its files below the directory path/Name
+func (s *Session) Add(tf torrentfile.TorrentFile, path string) (*Torrent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, fmt.Errorf("Session is closed")
+	}
+	if _, ok := s.torrents[tf.InfoHash]; ok {
+		return nil, fmt.Errorf("Torrent %x was already added", tf.InfoHash)
+	}
+
+	t := newTorrent(s, &tf, path)
+	s.torrents[tf.InfoHash] = t
+	t.Resume()
+	return t, nil
+}
+
+// Torrent returns the torrent with infoHash, or nil if it wasn't added
+func (s *Session) Torrent(infoHash [20]byte) *Torrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.torrents[infoHash]
+}
+
+// Torrents returns every torrent in the session
+func (s *Session) Torrents() []*Torrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	torrents := make([]*Torrent, 0, len(s.torrents))
+	for _, t := range s.torrents {
+		torrents = append(torrents, t)
+	}
+	return torrents
+}
+
+// Remove stops the torrent with infoHash and removes it from the session.
+// Whatever was downloaded so far is discarded.
+func (s *Session) Remove(infoHash [20]byte) error {
+	s.mu.Lock()
+	t, ok := s.torrents[infoHash]
+	delete(s.torrents, infoHash)
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("No torrent with infohash %x", infoHash)
+	}
+	t.Pause()
+	return nil
+}
+
+// Close stops every torrent and stops accepting connections
+func (s *Session) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	torrents := s.torrents
+	s.torrents = make(map[[20]byte]*Torrent)
+	// Cut short the handshakes in progress rather than wait them out
+	for conn := range s.handshaking {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	err := s.ln.Close()
+	if s.utp != nil {
+		s.utp.Close()
+	}
+	for _, t := range torrents {
+		t.Pause()
+	}
+	s.wg.Wait()
+	return err
+}
+
+func (s *Session) acceptLoop(ln net.Listener) {
+	defer s.wg.Done()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if !closed {
+				s.log.Errorf("Stopped accepting connections: %s", err)
+			}
+			return
+		}
+		// Close waits for handshakes in progress, so none hand a connection
+		// to a torrent after it returns
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.handshaking[conn] = true
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go func() {
+			defer s.wg.Done()
+			s.handleInbound(conn)
+			s.mu.Lock()
+			delete(s.handshaking, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// infoHashes returns the infohashes of every torrent in the session
+func (s *Session) infoHashes() [][20]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hashes := make([][20]byte, 0, len(s.torrents))
+	for h := range s.torrents {
+		hashes = append(hashes, h)
+	}
+	return hashes
+}
+
+// handleInbound reads the handshake of a connection a peer opened to us and
+// hands it to the torrent it asks for. The connection is decrypted first if
+// the peer started with an encryption handshake.
+func (s *Session) handleInbound(conn net.Conn) {
+	log := s.log.With("peer", conn.RemoteAddr())
+	if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+		ip := net.ParseIP(host)
+		if s.bans.Banned(ip) || s.cfg.IPFilter.Blocked(ip) {
+			log.Debugf("Rejecting connection from banned peer")
+			conn.Close()
+			return
+		}
+	}
+	raw := conn
+	raw.SetDeadline(time.Now().Add(5 * time.Second))
+	conn, err := mse.Accept(raw, s.infoHashes(), s.cfg.Encryption)
+	if err != nil {
+		log.Debugf("Could not set up encryption: %s", err)
+		raw.Close()
+		return
+	}
+	hs, err := handshake.Read(conn)
+	raw.SetDeadline(time.Time{}) // Disable the deadline
+	if err != nil {
+		log.Debugf("Could not read handshake: %s", err)
+		conn.Close()
+		return
+	}
+
+	t := s.Torrent(hs.InfoHash)
+	if t == nil {
+		log.Debugf("Rejecting connection for unknown infohash %x", hs.InfoHash)
+		conn.Close()
+		return
+	}
+
+	c, err := client.Accept(conn, hs, s.peerID, client.Options{
+		NumPieces: len(t.p2p.PieceHashes),
+		Private:   t.p2p.Private,
+	})
+	if err != nil {
+		log.Debugf("Could not handshake: %s", err)
+		return
+	}
+	err = t.p2p.AddClient(c)
+	if err != nil {
+		log.Debugf("Rejecting connection: %s", err)
+		c.Conn.Close()
+	}
+}
@@ -0,0 +1,581 @@
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/torrent-client/client"
+	"github.com/veggiedefender/torrent-client/handshake"
+	"github.com/veggiedefender/torrent-client/ipfilter"
+	"github.com/veggiedefender/torrent-client/message"
+	"github.com/veggiedefender/torrent-client/mse"
+	"github.com/veggiedefender/torrent-client/peerid"
+	"github.com/veggiedefender/torrent-client/torrentfile"
+	"github.com/veggiedefender/torrent-client/utp"
+)
+
+const pieceLength = 32768
+
+// serve plays a seeder with every piece of data on conn, after the
+// handshakes have been exchanged
+func serve(conn net.Conn, data []byte) {
+	numPieces := (len(data) + pieceLength - 1) / pieceLength
+	bf := make([]byte, (numPieces+7)/8)
+	for i := 0; i < numPieces; i++ {
+		bf[i/8] |= 1 << uint(7-i%8)
+	}
+	conn.Write(message.FormatBitfield(bf).Serialize())
+	conn.Write((&message.Message{ID: message.MsgUnchoke}).Serialize())
+	for {
+		msg, err := message.Read(conn)
+		if err != nil {
+			return
+		}
+		body, err := message.Decode(msg)
+		req, ok := body.(message.Request)
+		if err != nil || !ok {
+			continue
+		}
+		offset := req.Index*pieceLength + req.Begin
+		block := data[offset : offset+req.Length]
+		conn.Write(message.FormatPiece(req.Index, req.Begin, block).Serialize())
+	}
+}
+
+// startSeeder listens for connections and serves data on each of them,
+// encrypting them as policy says
+func startSeeder(t *testing.T, infoHash [20]byte, data []byte, policy mse.Policy) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	serveSeeder(ln, infoHash, data, policy)
+	return ln
+}
+
+// serveSeeder serves data on each connection ln accepts
+func serveSeeder(ln net.Listener, infoHash [20]byte, data []byte, policy mse.Policy) {
+	go func() {
+		for {
+			raw, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer raw.Close()
+				conn, err := mse.Accept(raw, [][20]byte{infoHash}, policy)
+				if err != nil {
+					return
+				}
+				if _, err := handshake.Read(conn); err != nil {
+					return
+				}
+				conn.Write(handshake.New(infoHash, [20]byte{}).Serialize())
+				serve(conn, data)
+			}()
+		}
+	}()
+}
+
+// startTracker returns the peers in the compact format for every announce
+func startTracker(peers ...net.Addr) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var compact []byte
+		for _, addr := range peers {
+			host, port, _ := net.SplitHostPort(addr.String())
+			p, _ := strconv.Atoi(port)
+			compact = append(compact, net.ParseIP(host).To4()...)
+			compact = append(compact, byte(p>>8), byte(p))
+		}
+		w.Write([]byte("d8:intervali900e5:peers" + strconv.Itoa(len(compact)) + ":" + string(compact) + "e"))
+	}))
+}
+
+func testTorrentFile(t *testing.T, announce string, length int) (torrentfile.TorrentFile, []byte) {
+	data := make([]byte, length)
+	_, err := rand.Read(data)
+	require.Nil(t, err)
+	tf := torrentfile.TorrentFile{
+		Announce:    announce,
+		PieceLength: pieceLength,
+		Length:      length,
+		Name:        "test",
+	}
+	_, err = rand.Read(tf.InfoHash[:])
+	require.Nil(t, err)
+	for begin := 0; begin < length; begin += pieceLength {
+		end := begin + pieceLength
+		if end > length {
+			end = length
+		}
+		tf.PieceHashes = append(tf.PieceHashes, sha1.Sum(data[begin:end]))
+	}
+	return tf, data
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "session")
+	require.Nil(t, err)
+	return dir
+}
+
+func TestDownloadMany(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	s, err := New(Config{ListenAddr: "127.0.0.1:0", MaxConns: 2})
+	require.Nil(t, err)
+	defer s.Close()
+
+	var files []torrentfile.TorrentFile
+	var contents [][]byte
+	for i := 0; i < 3; i++ {
+		tf, data := testTorrentFile(t, "", 100000)
+		seeder := startSeeder(t, tf.InfoHash, data, mse.Disabled)
+		defer seeder.Close()
+		tracker := startTracker(seeder.Addr())
+		defer tracker.Close()
+		tf.Announce = tracker.URL
+		files = append(files, tf)
+		contents = append(contents, data)
+	}
+
+	for i, tf := range files {
+		_, err := s.Add(tf, filepath.Join(dir, strconv.Itoa(i)))
+		require.Nil(t, err)
+	}
+	_, err = s.Add(files[0], filepath.Join(dir, "again"))
+	assert.NotNil(t, err)
+	assert.Len(t, s.Torrents(), 3)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for i, tf := range files {
+		torrent := s.Torrent(tf.InfoHash)
+		require.Nil(t, torrent.Wait(ctx))
+		status := torrent.Status()
+		assert.Equal(t, StateComplete, status.State)
+		assert.Equal(t, len(contents[i]), status.Downloaded)
+
+		written, err := ioutil.ReadFile(filepath.Join(dir, strconv.Itoa(i)))
+		require.Nil(t, err)
+		assert.Equal(t, contents[i], written)
+	}
+
+	require.Nil(t, s.Remove(files[0].InfoHash))
+	assert.Nil(t, s.Torrent(files[0].InfoHash))
+	assert.NotNil(t, s.Remove(files[0].InfoHash))
+}
+
+func TestPauseResume(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	s, err := New(Config{ListenAddr: "127.0.0.1:0", StallTimeout: time.Minute})
+	require.Nil(t, err)
+	defer s.Close()
+
+	// Nobody has the torrent, so it keeps downloading until we pause it
+	tracker := startTracker()
+	defer tracker.Close()
+	tf, _ := testTorrentFile(t, tracker.URL, 100000)
+	torrent, err := s.Add(tf, filepath.Join(dir, "out"))
+	require.Nil(t, err)
+	assert.Equal(t, StateDownloading, torrent.Status().State)
+
+	torrent.Pause()
+	assert.Equal(t, StatePaused, torrent.Status().State)
+	torrent.Resume()
+	assert.Equal(t, StateDownloading, torrent.Status().State)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, torrent.Wait(ctx))
+}
+
+func TestInboundPeer(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	s, err := New(Config{ListenAddr: "127.0.0.1:0", StallTimeout: time.Minute})
+	require.Nil(t, err)
+	defer s.Close()
+
+	tracker := startTracker()
+	defer tracker.Close()
+	tf, data := testTorrentFile(t, tracker.URL, 100000)
+	torrent, err := s.Add(tf, filepath.Join(dir, "out"))
+	require.Nil(t, err)
+
+	// The seeder finds us instead of the other way around
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(s.Port()))))
+	require.Nil(t, err)
+	defer conn.Close()
+	conn.Write(handshake.New(tf.InfoHash, [20]byte{}).Serialize())
+	hs, err := handshake.Read(conn)
+	require.Nil(t, err)
+	assert.Equal(t, s.PeerID(), hs.PeerID)
+	go serve(conn, data)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.Nil(t, torrent.Wait(ctx))
+	written, err := ioutil.ReadFile(filepath.Join(dir, "out"))
+	require.Nil(t, err)
+	assert.Equal(t, data, written)
+}
+
+func TestCloseCutsHandshakesShort(t *testing.T) {
+	s, err := New(Config{ListenAddr: "127.0.0.1:0"})
+	require.Nil(t, err)
+
+	// The peer never sends its handshake
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(s.Port()))))
+	require.Nil(t, err)
+	defer conn.Close()
+	for i := 0; ; i++ {
+		s.mu.Lock()
+		n := len(s.handshaking)
+		s.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		require.True(t, i < 100, "connection was never accepted")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	start := time.Now()
+	require.Nil(t, s.Close())
+	assert.True(t, time.Since(start) < time.Second)
+	_, err = conn.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+}
+
+func TestEncryptedPeers(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	s, err := New(Config{ListenAddr: "127.0.0.1:0", StallTimeout: time.Minute, Encryption: mse.Require})
+	require.Nil(t, err)
+	defer s.Close()
+
+	// One torrent comes from a seeder we connect to
+	tracker := startTracker()
+	defer tracker.Close()
+	tf, data := testTorrentFile(t, tracker.URL, 100000)
+	seeder := startSeeder(t, tf.InfoHash, data, mse.Require)
+	defer seeder.Close()
+	outbound := startTracker(seeder.Addr())
+	defer outbound.Close()
+	tf.Announce = outbound.URL
+	first, err := s.Add(tf, filepath.Join(dir, "first"))
+	require.Nil(t, err)
+
+	// The other from a seeder that connects to us
+	tf2, data2 := testTorrentFile(t, tracker.URL, 100000)
+	second, err := s.Add(tf2, filepath.Join(dir, "second"))
+	require.Nil(t, err)
+	raw, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(s.Port()))))
+	require.Nil(t, err)
+	defer raw.Close()
+	conn, err := mse.Initiate(raw, tf2.InfoHash, mse.Require)
+	require.Nil(t, err)
+	conn.Write(handshake.New(tf2.InfoHash, [20]byte{}).Serialize())
+	_, err = handshake.Read(conn)
+	require.Nil(t, err)
+	go serve(conn, data2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.Nil(t, first.Wait(ctx))
+	require.Nil(t, second.Wait(ctx))
+	written, err := ioutil.ReadFile(filepath.Join(dir, "first"))
+	require.Nil(t, err)
+	assert.Equal(t, data, written)
+	written, err = ioutil.ReadFile(filepath.Join(dir, "second"))
+	require.Nil(t, err)
+	assert.Equal(t, data2, written)
+}
+
+func TestRequireEncryptionRejectsPlaintext(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	s, err := New(Config{ListenAddr: "127.0.0.1:0", Encryption: mse.Require})
+	require.Nil(t, err)
+	defer s.Close()
+	tracker := startTracker()
+	defer tracker.Close()
+	tf, _ := testTorrentFile(t, tracker.URL, 100000)
+	_, err = s.Add(tf, filepath.Join(dir, "out"))
+	require.Nil(t, err)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(s.Port()))))
+	require.Nil(t, err)
+	defer conn.Close()
+	conn.Write(handshake.New(tf.InfoHash, [20]byte{}).Serialize())
+	_, err = handshake.Read(conn)
+	assert.NotNil(t, err)
+}
+
+func TestUTPPeers(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	s, err := New(Config{ListenAddr: "127.0.0.1:0", StallTimeout: time.Minute, Transport: client.UTPOnly})
+	require.Nil(t, err)
+	defer s.Close()
+
+	// One torrent comes from a seeder we connect to over uTP
+	tf, data := testTorrentFile(t, "", 100000)
+	seeder, err := utp.Listen("127.0.0.1:0")
+	require.Nil(t, err)
+	defer seeder.Close()
+	serveSeeder(seeder, tf.InfoHash, data, mse.Disabled)
+	tracker := startTracker(seeder.Addr())
+	defer tracker.Close()
+	tf.Announce = tracker.URL
+	first, err := s.Add(tf, filepath.Join(dir, "first"))
+	require.Nil(t, err)
+
+	// The other from a seeder that connects to us over uTP
+	empty := startTracker()
+	defer empty.Close()
+	tf2, data2 := testTorrentFile(t, empty.URL, 100000)
+	second, err := s.Add(tf2, filepath.Join(dir, "second"))
+	require.Nil(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := utp.DialContext(ctx, net.JoinHostPort("127.0.0.1", strconv.Itoa(int(s.Port()))))
+	require.Nil(t, err)
+	defer conn.Close()
+	conn.Write(handshake.New(tf2.InfoHash, [20]byte{}).Serialize())
+	_, err = handshake.Read(conn)
+	require.Nil(t, err)
+	go serve(conn, data2)
+
+	require.Nil(t, first.Wait(ctx))
+	require.Nil(t, second.Wait(ctx))
+	written, err := ioutil.ReadFile(filepath.Join(dir, "first"))
+	require.Nil(t, err)
+	assert.Equal(t, data, written)
+	written, err = ioutil.ReadFile(filepath.Join(dir, "second"))
+	require.Nil(t, err)
+	assert.Equal(t, data2, written)
+}
+
+// pipeListener is an in-memory network. Every dial connects to the listener
+// over net.Pipe, whatever the address.
+type pipeListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, fmt.Errorf("Listener closed")
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+}
+
+func (l *pipeListener) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	a, b := net.Pipe()
+	select {
+	case l.conns <- newAsyncConn(b):
+		return newAsyncConn(a), nil
+	case <-l.done:
+		return nil, fmt.Errorf("Connection refused")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// asyncConn queues writes, so they don't wait for the other end of a
+// net.Pipe to read, as writes to a real connection mostly don't
+type asyncConn struct {
+	net.Conn
+	writes chan []byte
+}
+
+func newAsyncConn(conn net.Conn) *asyncConn {
+	c := &asyncConn{Conn: conn, writes: make(chan []byte, 1024)}
+	go func() {
+		for b := range c.writes {
+			if _, err := conn.Write(b); err != nil {
+				return
+			}
+		}
+	}()
+	return c
+}
+
+func (c *asyncConn) Write(b []byte) (int, error) {
+	c.writes <- append([]byte{}, b...)
+	return len(b), nil
+}
+
+func TestCustomDialerAndListener(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	network := newPipeListener()
+	inbound := newPipeListener()
+	s, err := New(Config{Listener: inbound, Dialer: network, StallTimeout: time.Minute})
+	require.Nil(t, err)
+	defer s.Close()
+	assert.Equal(t, uint16(6881), s.Port())
+
+	// One torrent comes from a seeder we dial
+	tf, data := testTorrentFile(t, "", 100000)
+	serveSeeder(network, tf.InfoHash, data, mse.Disabled)
+	tracker := startTracker(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1234})
+	defer tracker.Close()
+	tf.Announce = tracker.URL
+	first, err := s.Add(tf, filepath.Join(dir, "first"))
+	require.Nil(t, err)
+
+	// The other from a seeder that connects to us
+	empty := startTracker()
+	defer empty.Close()
+	tf2, data2 := testTorrentFile(t, empty.URL, 100000)
+	second, err := s.Add(tf2, filepath.Join(dir, "second"))
+	require.Nil(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := inbound.DialContext(ctx, "tcp", "")
+	require.Nil(t, err)
+	defer conn.Close()
+	conn.Write(handshake.New(tf2.InfoHash, [20]byte{}).Serialize())
+	_, err = handshake.Read(conn)
+	require.Nil(t, err)
+	go serve(conn, data2)
+
+	require.Nil(t, first.Wait(ctx))
+	require.Nil(t, second.Wait(ctx))
+	written, err := ioutil.ReadFile(filepath.Join(dir, "first"))
+	require.Nil(t, err)
+	assert.Equal(t, data, written)
+	written, err = ioutil.ReadFile(filepath.Join(dir, "second"))
+	require.Nil(t, err)
+	assert.Equal(t, data2, written)
+}
+
+func TestRateLimits(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	s, err := New(Config{ListenAddr: "127.0.0.1:0", PeerDownloadRate: 40000})
+	require.Nil(t, err)
+	defer s.Close()
+
+	tf, data := testTorrentFile(t, "", 100000)
+	seeder := startSeeder(t, tf.InfoHash, data, mse.Disabled)
+	defer seeder.Close()
+	tracker := startTracker(seeder.Addr())
+	defer tracker.Close()
+	tf.Announce = tracker.URL
+
+	// One second's worth comes out of the burst, and the rest takes
+	// another second and a half
+	start := time.Now()
+	torrent, err := s.Add(tf, filepath.Join(dir, "out"))
+	require.Nil(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.Nil(t, torrent.Wait(ctx))
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= time.Second, "took %s", elapsed)
+
+	status := torrent.Status()
+	assert.Equal(t, int64(len(data)), status.Transferred.PayloadDownloaded)
+	assert.True(t, status.Transferred.OverheadDownloaded > 0)
+	assert.True(t, status.Transferred.OverheadUploaded > 0)
+	assert.Equal(t, int64(0), status.Transferred.PayloadUploaded)
+}
+
+func TestBannedPeerRejected(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	s, err := New(Config{ListenAddr: "127.0.0.1:0", StallTimeout: time.Minute})
+	require.Nil(t, err)
+	defer s.Close()
+
+	tracker := startTracker()
+	defer tracker.Close()
+	tf, _ := testTorrentFile(t, tracker.URL, 100000)
+	torrent, err := s.Add(tf, filepath.Join(dir, "out"))
+	require.Nil(t, err)
+	// Every torrent shares the session's list
+	assert.Equal(t, s.BanList(), torrent.p2p.BanList)
+
+	s.BanList().Ban(net.IP{127, 0, 0, 1})
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(s.Port()))))
+	require.Nil(t, err)
+	defer conn.Close()
+	conn.Write(handshake.New(tf.InfoHash, [20]byte{}).Serialize())
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = handshake.Read(conn)
+	assert.NotNil(t, err)
+}
+
+func TestFilteredPeerRejected(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	filter := ipfilter.New()
+	require.Nil(t, filter.Deny("127.0.0.0/8"))
+	s, err := New(Config{ListenAddr: "127.0.0.1:0", StallTimeout: time.Minute, IPFilter: filter})
+	require.Nil(t, err)
+	defer s.Close()
+
+	tracker := startTracker()
+	defer tracker.Close()
+	tf, _ := testTorrentFile(t, tracker.URL, 100000)
+	torrent, err := s.Add(tf, filepath.Join(dir, "out"))
+	require.Nil(t, err)
+	assert.Equal(t, filter, torrent.p2p.IPFilter)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(s.Port()))))
+	require.Nil(t, err)
+	defer conn.Close()
+	conn.Write(handshake.New(tf.InfoHash, [20]byte{}).Serialize())
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = handshake.Read(conn)
+	assert.NotNil(t, err)
+}
+
+func TestPeerIDPrefix(t *testing.T) {
+	s, err := New(Config{ListenAddr: "127.0.0.1:0"})
+	require.Nil(t, err)
+	defer s.Close()
+	id := s.PeerID()
+	assert.Equal(t, peerid.DefaultPrefix, string(id[:len(peerid.DefaultPrefix)]))
+
+	s, err = New(Config{ListenAddr: "127.0.0.1:0", PeerIDPrefix: "-XX1234-"})
+	require.Nil(t, err)
+	defer s.Close()
+	id = s.PeerID()
+	assert.Equal(t, "-XX1234-", string(id[:8]))
+
+	_, err = New(Config{ListenAddr: "127.0.0.1:0", PeerIDPrefix: "this prefix is far too long"})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,249 @@
+package session
+
+import (
+	"context"
+	"sync"
+
+	"github.com/veggiedefender/torrent-client/client"
+	"github.com/veggiedefender/torrent-client/p2p"
+	"github.com/veggiedefender/torrent-client/ratelimit"
+	"github.com/veggiedefender/torrent-client/torrentfile"
+)
+
+// State is where a torrent is in its lifecycle
+type State int
+
+const (
+	// StateDownloading means the torrent is looking for peers or downloading
+	StateDownloading State = iota
+	// StatePaused means the torrent was paused and keeps what it downloaded
+	StatePaused
+	// StateComplete means the torrent was downloaded and written to its file
+	StateComplete
+	// StateFailed means the torrent stopped because of an error
+	StateFailed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateDownloading:
+		return "Downloading"
+	case StatePaused:
+		return "Paused"
+	case StateComplete:
+		return "Complete"
+	case StateFailed:
+		return "Failed"
+	default:
+		return "Unknown"
+	}
+}
+
+// Status is a snapshot of a torrent's progress
+type Status struct {
+	State State
+	// Err is why the torrent failed
+	Err         error
+	DonePieces  int
+	TotalPieces int
+	Downloaded  int
+	Length      int
+	// Rate is the most recent download rate in bytes per second
+	Rate     float64
+	NumPeers int
+	// Transferred counts the payload and protocol overhead exchanged with
+	// peers
+	Transferred client.Stats
+}
+
+// A Torrent is a download managed by a Session
+type Torrent struct {
+	session *Session
+	p2p     *p2p.Torrent
+	path    string
+	// download and upload cap the rates of this torrent alone
+	download *ratelimit.Limiter
+	upload   *ratelimit.Limiter
+
+	mu       sync.Mutex
+	state    State
+	err      error
+	rate     float64
+	numPeers int
+	cancel   context.CancelFunc
+	// stopped is closed when the running download goroutine exits
+	stopped chan struct{}
+	// changed is closed and replaced whenever state changes
+	changed chan struct{}
+}
+
+func newTorrent(s *Session, tf *torrentfile.TorrentFile, path string) *Torrent {
+	t := &Torrent{
+		session:  s,
+		path:     path,
+		download: ratelimit.NewLimiter(0),
+		upload:   ratelimit.NewLimiter(0),
+		state:    StatePaused,
+		changed:  make(chan struct{}),
+	}
+	t.p2p = tf.NewTorrent(s.peerID, s.port)
+	t.p2p.StallTimeout = s.cfg.StallTimeout
+	t.p2p.ConnLimiter = s.conns
+	t.p2p.BanList = s.bans
+	t.p2p.IPFilter = s.cfg.IPFilter
+	t.p2p.MaxConns = s.cfg.MaxConnsPerTorrent
+	t.p2p.DownloadLimiters = []*ratelimit.Limiter{s.download, t.download}
+	t.p2p.UploadLimiters = []*ratelimit.Limiter{s.upload, t.upload}
+	t.p2p.LimitPayloadOnly = s.cfg.LimitPayloadOnly
+	t.p2p.PeerDownloadLimits = s.peerDownload
+	t.p2p.PeerUploadLimits = s.peerUpload
+	t.p2p.Logger = s.log
+	t.p2p.Sources = s.cfg.Sources
+	t.p2p.Encryption = s.cfg.Encryption
+	t.p2p.Transport = s.cfg.Transport
+	t.p2p.UTPSocket = s.utp
+	t.p2p.Dialer = s.cfg.Dialer
+	if s.cfg.Proxy != nil {
+		if t.p2p.Dialer == nil {
+			t.p2p.Dialer = s.cfg.Proxy
+		}
+		t.p2p.HTTPClient = s.httpClient
+	}
+	t.p2p.OnEvent = t.handleEvent
+	return t
+}
+
+// InfoHash returns the infohash identifying the torrent
+func (t *Torrent) InfoHash() [20]byte {
+	return t.p2p.InfoHash
+}
+
+// Name returns the torrent's name
+func (t *Torrent) Name() string {
+	return t.p2p.Name
+}
+
+// SetRates changes the download and upload limits of this torrent in bytes
+// per second. They apply on top of the session's limits. Zero removes a
+// limit.
+func (t *Torrent) SetRates(download, upload int) {
+	t.download.SetRate(download)
+	t.upload.SetRate(upload)
+}
+
+// Status returns the torrent's current progress
+func (t *Torrent) Status() Status {
+	donePieces, downloaded := t.p2p.Progress()
+	transferred := t.p2p.Transferred()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return Status{
+		State:       t.state,
+		Err:         t.err,
+		DonePieces:  donePieces,
+		TotalPieces: len(t.p2p.PieceHashes),
+		Downloaded:  downloaded,
+		Length:      t.p2p.Length,
+		Rate:        t.rate,
+		NumPeers:    t.numPeers,
+		Transferred: transferred,
+	}
+}
+
+// Pause stops downloading, keeping the pieces downloaded so far. It does
+// nothing unless the torrent is downloading.
+func (t *Torrent) Pause() {
+	t.mu.Lock()
+	if t.state != StateDownloading {
+		t.mu.Unlock()
+		return
+	}
+	t.setState(StatePaused, nil)
+	t.cancel()
+	stopped := t.stopped
+	t.mu.Unlock()
+	<-stopped
+}
+
+// Resume continues a paused or failed download. It does nothing if the
+// torrent is downloading or complete.
+func (t *Torrent) Resume() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state != StatePaused && t.state != StateFailed {
+		return
+	}
+	t.setState(StateDownloading, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.cancel = cancel
+	t.stopped = make(chan struct{})
+	go t.run(ctx, t.stopped)
+}
+
+// Wait blocks until the torrent is complete or has failed, or until ctx is
+// done. It returns the torrent's error if it failed.
+func (t *Torrent) Wait(ctx context.Context) error {
+	for {
+		t.mu.Lock()
+		state, err, changed := t.state, t.err, t.changed
+		t.mu.Unlock()
+		switch state {
+		case StateComplete:
+			return nil
+		case StateFailed:
+			return err
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// setState must be called with t.mu held
+func (t *Torrent) setState(state State, err error) {
+	t.state, t.err = state, err
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+func (t *Torrent) run(ctx context.Context, stopped chan struct{}) {
+	defer close(stopped)
+	buf, err := t.p2p.DownloadContext(ctx)
+	if err == nil {
+		err = t.p2p.WriteFiles(t.path, buf)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rate, t.numPeers = 0, 0
+	if ctx.Err() != nil {
+		return // Paused or removed
+	}
+	t.cancel()
+	if err != nil {
+		t.session.log.With("torrent", t.p2p.Name).Errorf("Download failed: %s", err)
+		t.setState(StateFailed, err)
+		return
+	}
+	t.setState(StateComplete, nil)
+}
+
+func (t *Torrent) handleEvent(e p2p.Event) {
+	t.mu.Lock()
+	switch e.Type {
+	case p2p.EventAnnounce:
+		// NumPeers is the number of peers the tracker returned
+	case p2p.EventRate:
+		t.rate = e.Rate
+		t.numPeers = e.NumPeers
+	default:
+		t.numPeers = e.NumPeers
+	}
+	t.mu.Unlock()
+
+	if t.session.cfg.OnEvent != nil {
+		t.session.cfg.OnEvent(t.p2p.InfoHash, e)
+	}
+}
@@ -0,0 +1,96 @@
+package torrentfile
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
+// maxDepth is how deeply lists and dicts can nest before a file is taken to
+// be malformed
+const maxDepth = 64
+
+// findInfo returns the exact bytes of the info dict in a bencoded torrent
+// file, which the infohash is computed over. Decoding and encoding the dict
+// again would drop or reorder keys we don't know about.
+func findInfo(data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0] != 'd' {
+		return nil, fmt.Errorf("Torrent is not a dictionary")
+	}
+	pos := 1
+	for pos < len(data) && data[pos] != 'e' {
+		keyStart := pos
+		var err error
+		pos, err = skipString(data, pos)
+		if err != nil {
+			return nil, err
+		}
+		key := data[keyStart:pos]
+		valueStart := pos
+		pos, err = skipValue(data, pos, 0)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(key, []byte("4:info")) {
+			if data[valueStart] != 'd' {
+				return nil, fmt.Errorf("Info is not a dictionary")
+			}
+			return data[valueStart:pos], nil
+		}
+	}
+	return nil, fmt.Errorf("Torrent has no info dictionary")
+}
+
+// skipValue returns the position just past the bencoded value at pos
+func skipValue(data []byte, pos int, depth int) (int, error) {
+	if pos >= len(data) {
+		return 0, fmt.Errorf("Unexpected end of torrent")
+	}
+	if depth > maxDepth {
+		return 0, fmt.Errorf("Torrent nests too deeply")
+	}
+	switch c := data[pos]; {
+	case c == 'i':
+		end := bytes.IndexByte(data[pos:], 'e')
+		if end < 0 {
+			return 0, fmt.Errorf("Unterminated integer at offset %d", pos)
+		}
+		return pos + end + 1, nil
+	case c == 'l' || c == 'd':
+		pos++
+		for {
+			if pos >= len(data) {
+				return 0, fmt.Errorf("Unexpected end of torrent")
+			}
+			if data[pos] == 'e' {
+				return pos + 1, nil
+			}
+			var err error
+			pos, err = skipValue(data, pos, depth+1)
+			if err != nil {
+				return 0, err
+			}
+		}
+	case c >= '0' && c <= '9':
+		return skipString(data, pos)
+	default:
+		return 0, fmt.Errorf("Unexpected %q at offset %d", c, pos)
+	}
+}
+
+// skipString returns the position just past the bencoded string at pos
+func skipString(data []byte, pos int) (int, error) {
+	colon := bytes.IndexByte(data[pos:], ':')
+	if colon < 0 {
+		return 0, fmt.Errorf("Malformed string at offset %d", pos)
+	}
+	length, err := strconv.Atoi(string(data[pos : pos+colon]))
+	if err != nil || length < 0 {
+		return 0, fmt.Errorf("Malformed string at offset %d", pos)
+	}
+	end := pos + colon + 1 + length
+	if end > len(data) || end < pos {
+		return 0, fmt.Errorf("Unexpected end of torrent")
+	}
+	return end, nil
+}
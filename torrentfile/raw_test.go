@@ -0,0 +1,45 @@
+package torrentfile
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindInfo(t *testing.T) {
+	info := "d5:filesld6:lengthi1e4:pathl1:aeee6:md5sum32:0123456789abcdef0123456789abcdef" +
+		"4:name1:x6:sourcei-3e6:pieces0:e"
+	data := "d8:announce3:url13:creation datei1e4:info" + info + "8:url-listl1:a1:bee"
+	raw, err := findInfo([]byte(data))
+	require.Nil(t, err)
+	assert.Equal(t, info, string(raw))
+}
+
+func TestFindInfoMalformed(t *testing.T) {
+	tests := []string{
+		"",
+		"le",
+		"d8:announce3:urle",
+		"d4:infoi1ee",
+		"d4:infod4:name",
+		"d4:infod4:name99:xee",
+		"d4:infod4:namex1:xee",
+		"d4:infod4:namei1",
+		"d4:infod4:name-1:ee",
+		"d8:announce",
+	}
+	for _, data := range tests {
+		_, err := findInfo([]byte(data))
+		assert.NotNil(t, err, data)
+	}
+}
+
+func TestFindInfoDepth(t *testing.T) {
+	deep := "d4:info" + "d1:a"
+	for i := 0; i < 100; i++ {
+		deep += "l"
+	}
+	_, err := findInfo([]byte(deep))
+	assert.NotNil(t, err)
+}
@@ -2,13 +2,22 @@ package torrentfile
 
 import (
 	"bytes"
-	"crypto/rand"
+	"context"
 	"crypto/sha1"
 	"fmt"
-	"os"
+	"io/ioutil"
+	"time"
 
 	"github.com/jackpal/bencode-go"
+	"github.com/veggiedefender/torrent-client/client"
+	"github.com/veggiedefender/torrent-client/ipfilter"
+	"github.com/veggiedefender/torrent-client/logger"
+	"github.com/veggiedefender/torrent-client/mse"
 	"github.com/veggiedefender/torrent-client/p2p"
+	"github.com/veggiedefender/torrent-client/peerid"
+	"github.com/veggiedefender/torrent-client/peers"
+	"github.com/veggiedefender/torrent-client/proxy"
+	"github.com/veggiedefender/torrent-client/ratelimit"
 )
 
 // Port to listen on
@@ -22,83 +31,202 @@ type TorrentFile struct {
 	PieceLength int
 	Length      int
 	Name        string
+	// Files lists the files of a multi-file torrent in the order their data
+	// is laid out in. It is nil for a single-file torrent.
+	Files []p2p.File
+	// URLList holds the URLs of web seeds serving the torrent's data
+	URLList []string
+	// HTTPSeeds holds the URLs of HTTP seeds serving the torrent's pieces
+	HTTPSeeds []string
+	// Private torrents only get peers from their tracker, not the DHT, PEX
+	// or local service discovery (BEP 27)
+	Private bool
+	// InfoBytes is the info dict exactly as it was encoded in the file, keys
+	// we don't use included. InfoHash is its SHA-1 hash.
+	InfoBytes []byte
+}
+
+type bencodeFile struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
 }
 
 type bencodeInfo struct {
-	Pieces      string `bencode:"pieces"`
-	PieceLength int    `bencode:"piece length"`
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
+	Pieces      string        `bencode:"pieces"`
+	PieceLength int           `bencode:"piece length"`
+	Length      int           `bencode:"length,omitempty"`
+	Files       []bencodeFile `bencode:"files,omitempty"`
+	Name        string        `bencode:"name"`
+	Private     int           `bencode:"private,omitempty"`
 }
 
 type bencodeTorrent struct {
 	Announce string      `bencode:"announce"`
 	Info     bencodeInfo `bencode:"info"`
+	// URLList is either a single URL or a list of them. Unmarshal can't
+	// decode a list into an interface, so Open fills it in separately.
+	URLList   interface{} `bencode:"-"`
+	HTTPSeeds []string    `bencode:"httpseeds"`
+	// RawInfo is the info dict as it was encoded in the file. Open fills it
+	// in, and Info is encoded again in its place if it is nil.
+	RawInfo []byte `bencode:"-"`
 }
 
-// DownloadToFile downloads a torrent and writes it to a file
+// Options configures a download started from a TorrentFile
+type Options struct {
+	// OnEvent, if set, receives progress events from the download
+	OnEvent func(p2p.Event)
+	// Logger, if set, receives the download's log messages
+	Logger logger.Logger
+	// Sources are asked for peers alongside the tracker, unless the torrent
+	// is private
+	Sources []p2p.PeerSource
+	// Encryption decides whether peer connections use Message Stream
+	// Encryption
+	Encryption mse.Policy
+	// Transport decides whether peer connections use TCP, uTP or both
+	Transport client.TransportPolicy
+	// Dialer, if set, opens the connections to peers
+	Dialer client.Dialer
+	// Proxy, if set, carries connections to peers, the tracker and web seeds.
+	// Dialer takes precedence for peers.
+	Proxy *proxy.Proxy
+	// DownloadRate and UploadRate cap the rates of the whole download in
+	// bytes per second, and PeerDownloadRate and PeerUploadRate cap those of
+	// each peer connection. Zero means no limit.
+	DownloadRate     int
+	UploadRate       int
+	PeerDownloadRate int
+	PeerUploadRate   int
+	// LimitPayloadOnly counts only piece data against the rate limits,
+	// leaving protocol overhead unlimited
+	LimitPayloadOnly bool
+	// MaxConns caps the number of peers the download is connected to. It
+	// defaults to 50.
+	MaxConns int
+	// IPFilter, if set, blocks address ranges the download won't connect to
+	IPFilter *ipfilter.Filter
+	// PeerIDPrefix starts the peer ID we identify ourselves with, and the
+	// rest is random. It defaults to peerid.DefaultPrefix.
+	PeerIDPrefix string
+	// StallTimeout is how long the download keeps looking for peers after
+	// losing all of them. Zero gives up as soon as none are left to try.
+	StallTimeout time.Duration
+}
+
+// DownloadToFile downloads a torrent and writes it to a file at path, or for
+// a multi-file torrent, to its files below the directory path/Name
 func (t *TorrentFile) DownloadToFile(path string) error {
-	var peerID [20]byte
-	_, err := rand.Read(peerID[:])
+	return t.DownloadToFileContext(context.Background(), path)
+}
+
+// DownloadToFileContext is like DownloadToFile, but cancels the tracker
+// request and download as soon as ctx is done
+func (t *TorrentFile) DownloadToFileContext(ctx context.Context, path string) error {
+	return t.DownloadToFileOptions(ctx, path, Options{})
+}
+
+// DownloadToFileOptions is like DownloadToFileContext, but configures the
+// download with opts
+func (t *TorrentFile) DownloadToFileOptions(ctx context.Context, path string, opts Options) error {
+	peerID, err := peerid.New(opts.PeerIDPrefix)
 	if err != nil {
 		return err
 	}
 
-	peers, err := t.requestPeers(peerID, Port)
+	torrent := t.NewTorrent(peerID, Port)
+	torrent.OnEvent = opts.OnEvent
+	torrent.Logger = opts.Logger
+	torrent.Sources = opts.Sources
+	torrent.Encryption = opts.Encryption
+	torrent.Transport = opts.Transport
+	torrent.Dialer = opts.Dialer
+	torrent.MaxConns = opts.MaxConns
+	torrent.IPFilter = opts.IPFilter
+	torrent.LimitPayloadOnly = opts.LimitPayloadOnly
+	torrent.StallTimeout = opts.StallTimeout
+	if opts.DownloadRate > 0 {
+		torrent.DownloadLimiters = []*ratelimit.Limiter{ratelimit.NewLimiter(opts.DownloadRate)}
+	}
+	if opts.UploadRate > 0 {
+		torrent.UploadLimiters = []*ratelimit.Limiter{ratelimit.NewLimiter(opts.UploadRate)}
+	}
+	if opts.PeerDownloadRate > 0 {
+		torrent.PeerDownloadLimits = ratelimit.NewPool(opts.PeerDownloadRate)
+	}
+	if opts.PeerUploadRate > 0 {
+		torrent.PeerUploadLimits = ratelimit.NewPool(opts.PeerUploadRate)
+	}
+	if opts.Proxy != nil {
+		if torrent.Dialer == nil {
+			torrent.Dialer = opts.Proxy
+		}
+		torrent.HTTPClient = opts.Proxy.HTTPClient()
+	}
+	buf, err := torrent.DownloadContext(ctx)
 	if err != nil {
 		return err
 	}
 
-	torrent := p2p.Torrent{
-		Peers:       peers,
+	return torrent.WriteFiles(path, buf)
+}
+
+// NewTorrent sets up a download of t that announces to t's tracker as peerID
+// listening on port. The download announces itself once it finds it has no
+// peers, which is right away.
+func (t *TorrentFile) NewTorrent(peerID [20]byte, port uint16) *p2p.Torrent {
+	torrent := &p2p.Torrent{
 		PeerID:      peerID,
 		InfoHash:    t.InfoHash,
 		PieceHashes: t.PieceHashes,
 		PieceLength: t.PieceLength,
 		Length:      t.Length,
 		Name:        t.Name,
+		Files:       t.Files,
+		WebSeeds:    t.URLList,
+		HTTPSeeds:   t.HTTPSeeds,
+		Private:     t.Private,
+		Port:        port,
 	}
-	buf, err := torrent.Download()
-	if err != nil {
-		return err
-	}
-
-	outFile, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-	defer outFile.Close()
-	_, err = outFile.Write(buf)
-	if err != nil {
-		return err
+	torrent.Announce = func(ctx context.Context) ([]peers.Peer, error) {
+		return t.requestPeersClient(ctx, torrent.HTTPClient, peerID, port)
 	}
-	return nil
+	return torrent
 }
 
 // Open parses a torrent file
 func Open(path string) (TorrentFile, error) {
-	file, err := os.Open(path)
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return TorrentFile{}, err
 	}
-	defer file.Close()
 
 	bto := bencodeTorrent{}
-	err = bencode.Unmarshal(file, &bto)
+	err = bencode.Unmarshal(bytes.NewReader(data), &bto)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	raw, err := bencode.Decode(bytes.NewReader(data))
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	if dict, ok := raw.(map[string]interface{}); ok {
+		bto.URLList = dict["url-list"]
+	}
+	bto.RawInfo, err = findInfo(data)
 	if err != nil {
 		return TorrentFile{}, err
 	}
 	return bto.toTorrentFile()
 }
 
-func (i *bencodeInfo) hash() ([20]byte, error) {
+func (i *bencodeInfo) marshal() ([]byte, error) {
 	var buf bytes.Buffer
 	err := bencode.Marshal(&buf, *i)
 	if err != nil {
-		return [20]byte{}, err
+		return nil, err
 	}
-	h := sha1.Sum(buf.Bytes())
-	return h, nil
+	return buf.Bytes(), nil
 }
 
 func (i *bencodeInfo) splitPieceHashes() ([][20]byte, error) {
@@ -118,9 +246,13 @@ func (i *bencodeInfo) splitPieceHashes() ([][20]byte, error) {
 }
 
 func (bto *bencodeTorrent) toTorrentFile() (TorrentFile, error) {
-	infoHash, err := bto.Info.hash()
-	if err != nil {
-		return TorrentFile{}, err
+	info := bto.RawInfo
+	if info == nil {
+		var err error
+		info, err = bto.Info.marshal()
+		if err != nil {
+			return TorrentFile{}, err
+		}
 	}
 	pieceHashes, err := bto.Info.splitPieceHashes()
 	if err != nil {
@@ -128,11 +260,44 @@ func (bto *bencodeTorrent) toTorrentFile() (TorrentFile, error) {
 	}
 	t := TorrentFile{
 		Announce:    bto.Announce,
-		InfoHash:    infoHash,
+		InfoHash:    sha1.Sum(info),
 		PieceHashes: pieceHashes,
 		PieceLength: bto.Info.PieceLength,
 		Length:      bto.Info.Length,
 		Name:        bto.Info.Name,
+		URLList:     parseURLList(bto.URLList),
+		HTTPSeeds:   bto.HTTPSeeds,
+		Private:     bto.Info.Private == 1,
+		InfoBytes:   info,
+	}
+	if len(bto.Info.Files) > 0 {
+		t.Length = 0
+		for _, f := range bto.Info.Files {
+			if f.Length < 0 || len(f.Path) == 0 {
+				return TorrentFile{}, fmt.Errorf("Received malformed file %q of length %d", f.Path, f.Length)
+			}
+			t.Files = append(t.Files, p2p.File{Path: f.Path, Length: f.Length})
+			t.Length += f.Length
+		}
 	}
 	return t, nil
 }
+
+// parseURLList reads url-list, which is either a single URL or a list of
+// them. An empty URL means there are none.
+func parseURLList(v interface{}) []string {
+	var urls []string
+	switch v := v.(type) {
+	case string:
+		if v != "" {
+			urls = append(urls, v)
+		}
+	case []interface{}:
+		for _, item := range v {
+			if u, ok := item.(string); ok && u != "" {
+				urls = append(urls, u)
+			}
+		}
+	}
+	return urls
+}
@@ -1,13 +1,16 @@
 package torrentfile
 
 import (
+	"crypto/sha1"
 	"encoding/json"
 	"flag"
 	"io/ioutil"
+	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/torrent-client/p2p"
 )
 
 var update = flag.Bool("update", false, "update .golden.json files")
@@ -58,6 +61,8 @@ func TestToTorrentFile(t *testing.T) {
 				PieceLength: 262144,
 				Length:      351272960,
 				Name:        "debian-10.2.0-amd64-netinst.iso",
+				InfoBytes: []byte("d6:lengthi351272960e4:name31:debian-10.2.0-amd64-netinst.iso" +
+					"12:piece lengthi262144e6:pieces40:1234567890abcdefghijabcdefghij1234567890e"),
 			},
 			fails: false,
 		},
@@ -86,3 +91,76 @@ func TestToTorrentFile(t *testing.T) {
 		assert.Equal(t, test.output, to)
 	}
 }
+
+func TestMultiFile(t *testing.T) {
+	bto := &bencodeTorrent{
+		Info: bencodeInfo{
+			Pieces:      "1234567890abcdefghij",
+			PieceLength: 16384,
+			Files: []bencodeFile{
+				{Length: 100, Path: []string{"a.txt"}},
+				{Length: 200, Path: []string{"dir", "b.txt"}},
+			},
+			Name: "multi",
+		},
+	}
+	to, err := bto.toTorrentFile()
+	require.Nil(t, err)
+	assert.Equal(t, 300, to.Length)
+	assert.Equal(t, []p2p.File{{Path: []string{"a.txt"}, Length: 100}, {Path: []string{"dir", "b.txt"}, Length: 200}}, to.Files)
+
+	// Multi-file info dicts have no length key
+	info := "d5:filesld6:lengthi100e4:pathl5:a.txteed6:lengthi200e4:pathl3:dir5:b.txteee" +
+		"4:name5:multi12:piece lengthi16384e6:pieces20:1234567890abcdefghije"
+	assert.Equal(t, sha1.Sum([]byte(info)), to.InfoHash)
+}
+
+func TestPrivate(t *testing.T) {
+	bto := &bencodeTorrent{
+		Info: bencodeInfo{
+			Pieces:      "1234567890abcdefghij",
+			PieceLength: 16384,
+			Length:      100,
+			Name:        "private",
+			Private:     1,
+		},
+	}
+	to, err := bto.toTorrentFile()
+	require.Nil(t, err)
+	assert.True(t, to.Private)
+	assert.True(t, to.NewTorrent([20]byte{}, Port).Private)
+	// The private key is part of the infohash
+	info := "d6:lengthi100e4:name7:private12:piece lengthi16384e6:pieces20:1234567890abcdefghij" +
+		"7:privatei1ee"
+	assert.Equal(t, sha1.Sum([]byte(info)), to.InfoHash)
+
+	bto.Info.Private = 0
+	to, err = bto.toTorrentFile()
+	require.Nil(t, err)
+	assert.False(t, to.Private)
+}
+
+func TestOpenHashesRawInfo(t *testing.T) {
+	// Keys we don't decode still count towards the infohash
+	info := "d6:lengthi100e6:md5sum32:0123456789abcdef0123456789abcdef4:name1:x" +
+		"12:piece lengthi16384e6:pieces20:1234567890abcdefghij7:privatei1e6:source3:abce"
+	f, err := ioutil.TempFile("", "torrent")
+	require.Nil(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString("d8:announce3:url4:info" + info + "e")
+	f.Close()
+
+	to, err := Open(f.Name())
+	require.Nil(t, err)
+	assert.Equal(t, []byte(info), to.InfoBytes)
+	assert.Equal(t, sha1.Sum([]byte(info)), to.InfoHash)
+	assert.True(t, to.Private)
+	assert.Equal(t, "x", to.Name)
+}
+
+func TestParseURLList(t *testing.T) {
+	assert.Equal(t, []string{"http://example.com/file"}, parseURLList("http://example.com/file"))
+	assert.Equal(t, []string{"http://a/", "http://b/"}, parseURLList([]interface{}{"http://a/", "", "http://b/"}))
+	assert.Nil(t, parseURLList(""))
+	assert.Nil(t, parseURLList(nil))
+}
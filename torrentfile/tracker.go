@@ -1,6 +1,7 @@
 package torrentfile
 
 import (
+	"context"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -34,14 +35,27 @@ func (t *TorrentFile) buildTrackerURL(peerID [20]byte, port uint16) (string, err
 	return base.String(), nil
 }
 
-func (t *TorrentFile) requestPeers(peerID [20]byte, port uint16) ([]peers.Peer, error) {
+// trackerTimeout is how long we wait for the tracker to answer
+const trackerTimeout = 15 * time.Second
+
+// requestPeersClient announces to the tracker with c, or http.DefaultClient
+// if c is nil
+func (t *TorrentFile) requestPeersClient(ctx context.Context, c *http.Client, peerID [20]byte, port uint16) ([]peers.Peer, error) {
 	url, err := t.buildTrackerURL(peerID, port)
 	if err != nil {
 		return nil, err
 	}
 
-	c := &http.Client{Timeout: 15 * time.Second}
-	resp, err := c.Get(url)
+	ctx, cancel := context.WithTimeout(ctx, trackerTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		c = http.DefaultClient
+	}
+	resp, err := c.Do(req)
 	if err != nil {
 		return nil, err
 	}
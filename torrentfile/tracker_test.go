@@ -1,6 +1,7 @@
 package torrentfile
 
 import (
+	"context"
 	"net"
 	"net/http"
 	"net/http/httptest"
@@ -60,7 +61,19 @@ func TestRequestPeers(t *testing.T) {
 		{IP: net.IP{192, 0, 2, 123}, Port: 6881},
 		{IP: net.IP{127, 0, 0, 1}, Port: 6889},
 	}
-	p, err := tf.requestPeers(peerID, port)
+	p, err := tf.requestPeersClient(context.Background(), nil, peerID, port)
 	assert.Nil(t, err)
 	assert.Equal(t, expected, p)
 }
+
+func TestRequestPeersContextCancel(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+	tf := TorrentFile{Announce: ts.URL}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := tf.requestPeersClient(ctx, nil, [20]byte{}, 6882)
+	assert.NotNil(t, err)
+}
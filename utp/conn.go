@@ -0,0 +1,681 @@
+package utp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// maxPacketSize keeps packets under the MTU of most links
+	maxPacketSize = 1400
+	maxPayload    = maxPacketSize - headerSize
+	// minWindow is the smallest the congestion window gets, so one packet
+	// can always be in flight
+	minWindow = maxPacketSize
+	// maxWindow caps the congestion window
+	maxWindow = 1 << 20
+	// maxRecvBuffer is how much received data we hold for Read
+	maxRecvBuffer = 1 << 20
+	// maxOutOfOrder is how many packets we hold that arrived ahead of a gap
+	maxOutOfOrder = 1024
+)
+
+// LEDBAT congestion control parameters
+const (
+	// targetDelay is the queueing delay LEDBAT aims to add to the link
+	targetDelay = 100 * time.Millisecond
+	// maxWindowIncrease is how many bytes the window grows per round trip when
+	// there is no queueing delay at all
+	maxWindowIncrease = 3000
+	// baseDelayInterval is how often the lowest delay seen is renewed, so the
+	// base delay follows route changes
+	baseDelayInterval = time.Minute
+)
+
+const (
+	initialTimeout = time.Second
+	minTimeout     = 500 * time.Millisecond
+	maxTimeout     = 30 * time.Second
+	// maxTransmissions is how many times a packet is sent before the
+	// connection is given up on
+	maxTransmissions = 6
+	tickInterval     = 50 * time.Millisecond
+)
+
+type connState int
+
+const (
+	stateSynSent connState = iota
+	stateConnected
+	stateClosed
+)
+
+// An outgoing packet waits in flight until it is acknowledged
+type outgoing struct {
+	typ           uint8
+	seqNr         uint16
+	payload       []byte
+	sentAt        time.Time
+	transmissions int
+}
+
+// A Conn is a uTP connection. It implements net.Conn.
+type Conn struct {
+	s      *Socket
+	remote net.Addr
+	recvID uint16
+	sendID uint16
+
+	mu sync.Mutex
+	// changed is closed and replaced whenever anything that Read, Write or
+	// DialContext wait on changes
+	changed chan struct{}
+	// done is closed once the connection is finished with
+	done  chan struct{}
+	state connState
+	err   error
+	// closed is set once Close is called
+	closed bool
+
+	seqNr uint16
+	ackNr uint16
+	// inflight holds packets that were sent but not acknowledged, in order
+	inflight      []*outgoing
+	inflightBytes int
+	// window is the congestion window in bytes
+	window int
+	// peerWindow is how many bytes the peer is ready to receive
+	peerWindow int
+	// replyMicro is the timestamp difference to send back to the peer
+	replyMicro uint32
+	delays     delayHistory
+	dupAcks    int
+	rtt        time.Duration
+	rttVar     time.Duration
+	timeout    time.Duration
+
+	recvBuf    []byte
+	outOfOrder map[uint16][]byte
+	// finSeqNr is the sequence number of the peer's FIN, once it arrives
+	finSeqNr    uint16
+	finReceived bool
+	eof         bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newConn(s *Socket, remote net.Addr, recvID, sendID uint16) *Conn {
+	return &Conn{
+		s:          s,
+		remote:     remote,
+		recvID:     recvID,
+		sendID:     sendID,
+		changed:    make(chan struct{}),
+		done:       make(chan struct{}),
+		window:     2 * maxPacketSize,
+		peerWindow: maxPacketSize,
+		timeout:    initialTimeout,
+		outOfOrder: make(map[uint16][]byte),
+	}
+}
+
+// accept answers a SYN from the peer that opened the connection
+func (c *Conn) accept(syn *packet) {
+	seqNr, _ := randomID()
+	c.seqNr = seqNr
+	c.ackNr = syn.seqNr
+	c.state = stateConnected
+	c.replyMicro = timestamp() - syn.timestamp
+	c.peerWindow = int(syn.wndSize)
+	c.sendState()
+}
+
+// waitConnected waits for the peer to answer our SYN
+func (c *Conn) waitConnected(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		if c.err != nil {
+			return c.err
+		}
+		if c.state == stateConnected {
+			return nil
+		}
+		changed := c.changed
+		c.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			c.mu.Lock()
+			return ctx.Err()
+		}
+		c.mu.Lock()
+	}
+}
+
+// notify wakes everyone waiting on the connection. It is called with c.mu
+// held.
+func (c *Conn) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// wait blocks until the connection changes or deadline passes. It is called
+// with c.mu held and returns with it held again.
+func (c *Conn) wait(deadline time.Time) error {
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return timeoutError{}
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		expired = t.C
+	}
+	changed := c.changed
+	c.mu.Unlock()
+	defer c.mu.Lock()
+	select {
+	case <-changed:
+		return nil
+	case <-expired:
+		return timeoutError{}
+	}
+}
+
+// fail ends the connection with err. It is called with c.mu held.
+func (c *Conn) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.finish()
+}
+
+// finish forgets the connection. It is called with c.mu held.
+func (c *Conn) finish() {
+	if c.state == stateClosed {
+		return
+	}
+	c.state = stateClosed
+	if c.err == nil {
+		c.err = errClosed
+	}
+	close(c.done)
+	c.notify()
+	c.s.remove(c)
+}
+
+// send queues a packet that takes up a sequence number, and sends it
+func (c *Conn) send(typ uint8, payload []byte) {
+	o := &outgoing{
+		typ:     typ,
+		seqNr:   c.seqNr,
+		payload: append([]byte{}, payload...),
+	}
+	c.seqNr++
+	c.inflight = append(c.inflight, o)
+	c.inflightBytes += len(o.payload)
+	c.transmit(o)
+}
+
+// transmit sends, or resends, a packet that is in flight
+func (c *Conn) transmit(o *outgoing) {
+	id := c.sendID
+	if o.typ == stSyn {
+		id = c.recvID
+	}
+	p := packet{
+		typ:           o.typ,
+		connID:        id,
+		timestamp:     timestamp(),
+		timestampDiff: c.replyMicro,
+		wndSize:       c.recvWindow(),
+		seqNr:         o.seqNr,
+		ackNr:         c.ackNr,
+		payload:       o.payload,
+	}
+	o.sentAt = time.Now()
+	o.transmissions++
+	c.s.write(&p, c.remote)
+}
+
+// sendState acknowledges what we have received. Packets that arrived past a
+// gap are acknowledged selectively, so the peer can tell what was lost.
+func (c *Conn) sendState() {
+	p := packet{
+		typ:           stState,
+		connID:        c.sendID,
+		timestamp:     timestamp(),
+		timestampDiff: c.replyMicro,
+		wndSize:       c.recvWindow(),
+		seqNr:         c.seqNr,
+		ackNr:         c.ackNr,
+	}
+	if len(c.outOfOrder) > 0 {
+		p.selectiveAck = make([]byte, 4)
+		for i := 0; i < len(p.selectiveAck)*8; i++ {
+			if _, ok := c.outOfOrder[c.ackNr+2+uint16(i)]; ok {
+				p.selectiveAck[i/8] |= 1 << uint(i%8)
+			}
+		}
+	}
+	c.s.write(&p, c.remote)
+}
+
+func (c *Conn) recvWindow() uint32 {
+	if len(c.recvBuf) >= maxRecvBuffer {
+		return 0
+	}
+	return uint32(maxRecvBuffer - len(c.recvBuf))
+}
+
+// handle processes a packet the socket received for this connection
+func (c *Conn) handle(p *packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == stateClosed {
+		return
+	}
+	c.replyMicro = timestamp() - p.timestamp
+	c.peerWindow = int(p.wndSize)
+
+	switch p.typ {
+	case stReset:
+		c.fail(fmt.Errorf("uTP connection reset by peer"))
+		return
+	case stSyn:
+		// Our answer to the SYN was lost
+		c.sendState()
+		return
+	}
+	if c.state == stateSynSent {
+		if p.typ != stState {
+			return
+		}
+		c.state = stateConnected
+		// The peer's first data packet carries the sequence number of this
+		// STATE
+		c.ackNr = p.seqNr - 1
+	}
+
+	c.handleAck(p)
+	if p.typ == stData || p.typ == stFin {
+		if p.typ == stFin {
+			c.finReceived = true
+			c.finSeqNr = p.seqNr
+		}
+		c.receive(p.seqNr, p.payload)
+		c.sendState()
+	}
+	c.notify()
+}
+
+// handleAck drops the packets p acknowledges from flight, adjusts the
+// congestion window, and resends the first packet in flight if the peer
+// seems to have lost it
+func (c *Conn) handleAck(p *packet) {
+	now := time.Now()
+	advanced := false
+	acked, ackedBytes := 0, 0
+	for len(c.inflight) > 0 && !seqLess(p.ackNr, c.inflight[0].seqNr) {
+		o := c.inflight[0]
+		c.inflight = c.inflight[1:]
+		advanced = true
+		acked++
+		ackedBytes += len(o.payload)
+		if o.transmissions == 1 {
+			c.updateRTT(now.Sub(o.sentAt))
+		}
+	}
+	sacked := 0
+	if p.selectiveAck != nil {
+		var bytes int
+		sacked, bytes = c.dropSelectivelyAcked(p)
+		acked += sacked
+		ackedBytes += bytes
+	}
+
+	if acked > 0 {
+		c.inflightBytes = 0
+		for _, o := range c.inflight {
+			c.inflightBytes += len(o.payload)
+		}
+		c.updateWindow(p.timestampDiff, ackedBytes)
+		c.timeout = c.retransmitTimeout()
+	}
+	if advanced {
+		c.dupAcks = 0
+	} else if p.typ == stState && len(c.inflight) > 0 && p.ackNr == c.inflight[0].seqNr-1 {
+		c.dupAcks++
+	}
+
+	// Three duplicate ACKs, or three packets received past it, mean the
+	// first packet in flight was lost
+	if len(c.inflight) > 0 && (c.dupAcks >= 3 || sacked >= 3) && now.Sub(c.inflight[0].sentAt) > c.rtt {
+		c.transmit(c.inflight[0])
+		c.window = max(c.window/2, minWindow)
+		c.dupAcks = 0
+	}
+}
+
+// dropSelectivelyAcked drops packets the peer received out of order, and
+// returns how many there were and their total size
+func (c *Conn) dropSelectivelyAcked(p *packet) (int, int) {
+	received := make(map[uint16]bool)
+	for i := 0; i < len(p.selectiveAck)*8; i++ {
+		if p.selectiveAck[i/8]&(1<<uint(i%8)) != 0 {
+			received[p.ackNr+2+uint16(i)] = true
+		}
+	}
+	kept := c.inflight[:0]
+	dropped, bytes := 0, 0
+	for _, o := range c.inflight {
+		if received[o.seqNr] {
+			dropped++
+			bytes += len(o.payload)
+			continue
+		}
+		kept = append(kept, o)
+	}
+	c.inflight = kept
+	return dropped, bytes
+}
+
+func (c *Conn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.timeout = c.retransmitTimeout()
+}
+
+// retransmitTimeout is how long we wait for an ACK before resending
+func (c *Conn) retransmitTimeout() time.Duration {
+	if c.rtt == 0 {
+		return initialTimeout
+	}
+	timeout := c.rtt + 4*c.rttVar
+	if timeout < minTimeout {
+		timeout = minTimeout
+	}
+	return timeout
+}
+
+// updateWindow applies LEDBAT: the window grows while the delay the peer
+// measured stays under targetDelay, and shrinks once it goes over
+func (c *Conn) updateWindow(delay uint32, ackedBytes int) {
+	if delay != 0 {
+		c.delays.add(delay, time.Now())
+		ourDelay := time.Duration(delay-c.delays.base()) * time.Microsecond
+		offTarget := float64(targetDelay-ourDelay) / float64(targetDelay)
+		windowFactor := float64(ackedBytes) / float64(max(c.window, ackedBytes))
+		c.window += int(maxWindowIncrease * offTarget * windowFactor)
+	}
+	if c.window < minWindow {
+		c.window = minWindow
+	}
+	if c.window > maxWindow {
+		c.window = maxWindow
+	}
+}
+
+// receive takes in the payload of a data or FIN packet
+func (c *Conn) receive(seqNr uint16, payload []byte) {
+	if !seqLess(c.ackNr, seqNr) {
+		return // A duplicate
+	}
+	if seqNr != c.ackNr+1 {
+		if len(c.outOfOrder) < maxOutOfOrder {
+			c.outOfOrder[seqNr] = payload
+		}
+		return
+	}
+	c.deliver(payload)
+	c.ackNr = seqNr
+	for {
+		next, ok := c.outOfOrder[c.ackNr+1]
+		if !ok {
+			break
+		}
+		delete(c.outOfOrder, c.ackNr+1)
+		c.deliver(next)
+		c.ackNr++
+	}
+	if c.finReceived && c.ackNr == c.finSeqNr {
+		c.eof = true
+	}
+}
+
+func (c *Conn) deliver(payload []byte) {
+	if c.closed {
+		return // Nobody will read it
+	}
+	c.recvBuf = append(c.recvBuf, payload...)
+}
+
+// loop resends packets that time out, and finishes the connection once it
+// is closed and everything we sent was acknowledged
+func (c *Conn) loop() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.tick()
+		}
+	}
+}
+
+func (c *Conn) tick() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == stateClosed {
+		return
+	}
+	if c.closed && len(c.inflight) == 0 {
+		c.finish()
+		return
+	}
+	if len(c.inflight) == 0 || time.Since(c.inflight[0].sentAt) < c.timeout {
+		return
+	}
+	o := c.inflight[0]
+	if o.transmissions >= maxTransmissions {
+		c.fail(fmt.Errorf("uTP connection timed out"))
+		return
+	}
+	c.transmit(o)
+	c.window = minWindow
+	c.timeout *= 2
+	if c.timeout > maxTimeout {
+		c.timeout = maxTimeout
+	}
+}
+
+// Read reads data from the connection
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		if c.closed {
+			return 0, errClosed
+		}
+		if len(c.recvBuf) > 0 {
+			n := copy(b, c.recvBuf)
+			c.recvBuf = c.recvBuf[n:]
+			if len(c.recvBuf) == 0 {
+				c.recvBuf = nil
+			}
+			return n, nil
+		}
+		if c.eof {
+			return 0, io.EOF
+		}
+		if c.state == stateClosed {
+			return 0, c.err
+		}
+		err := c.wait(c.readDeadline)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write writes data to the connection. It returns once the data is sent, but
+// before it is acknowledged.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	written := 0
+	for written < len(b) {
+		n := len(b) - written
+		if n > maxPayload {
+			n = maxPayload
+		}
+		for {
+			if c.closed {
+				return written, errClosed
+			}
+			if c.state == stateClosed {
+				return written, c.err
+			}
+			if c.inflightBytes == 0 || c.inflightBytes+n <= min(c.window, c.peerWindow) {
+				break
+			}
+			err := c.wait(c.writeDeadline)
+			if err != nil {
+				return written, err
+			}
+		}
+		c.send(stData, b[written:written+n])
+		written += n
+	}
+	return written, nil
+}
+
+// Close sends a FIN to the peer. The connection lingers until the peer
+// acknowledges everything we sent.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return errClosed
+	}
+	c.closed = true
+	c.recvBuf = nil
+	if c.state == stateConnected {
+		c.send(stFin, nil)
+	} else {
+		c.finish()
+	}
+	c.notify()
+	return nil
+}
+
+// LocalAddr returns the address of the socket the connection runs over
+func (c *Conn) LocalAddr() net.Addr {
+	return c.s.Addr()
+}
+
+// RemoteAddr returns the peer's address
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// SetDeadline sets the read and write deadlines
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.notify()
+	return nil
+}
+
+// SetReadDeadline sets the deadline for Read calls
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.notify()
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for Write calls
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.notify()
+	return nil
+}
+
+// delayHistory tracks the lowest one-way delay seen recently, which LEDBAT
+// takes to be the delay of the link with empty queues
+type delayHistory struct {
+	current  uint32
+	previous uint32
+	started  time.Time
+}
+
+func (h *delayHistory) add(delay uint32, now time.Time) {
+	if h.started.IsZero() {
+		h.current, h.previous, h.started = delay, delay, now
+		return
+	}
+	if now.Sub(h.started) > baseDelayInterval {
+		h.previous, h.current, h.started = h.current, delay, now
+	}
+	if delayLess(delay, h.current) {
+		h.current = delay
+	}
+}
+
+func (h *delayHistory) base() uint32 {
+	if delayLess(h.previous, h.current) {
+		return h.previous
+	}
+	return h.current
+}
+
+// delayLess compares delays, which wrap around along with the clocks they are
+// measured with
+func delayLess(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// timeoutError is returned when a deadline passes
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "uTP i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,121 @@
+package utp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Packet types
+const (
+	stData  uint8 = 0
+	stFin   uint8 = 1
+	stState uint8 = 2
+	stReset uint8 = 3
+	stSyn   uint8 = 4
+)
+
+const version = 1
+
+const headerSize = 20
+
+// extSelectiveAck is the extension that acknowledges packets received out of
+// order
+const extSelectiveAck = 1
+
+type packet struct {
+	typ uint8
+	// connID is the receiver's ID for the connection, except in a SYN where
+	// it is the ID the sender will receive on
+	connID uint16
+	// timestamp is when the packet was sent, in microseconds
+	timestamp uint32
+	// timestampDiff is how late the last packet received from the other side
+	// arrived, measured against its own timestamp
+	timestampDiff uint32
+	// wndSize is how many more bytes the sender is ready to receive
+	wndSize uint32
+	seqNr   uint16
+	ackNr   uint16
+	// selectiveAck has bit i set if packet ackNr+2+i was received
+	selectiveAck []byte
+	payload      []byte
+}
+
+func (p *packet) serialize() []byte {
+	length := headerSize + len(p.payload)
+	if p.selectiveAck != nil {
+		length += 2 + len(p.selectiveAck)
+	}
+	buf := make([]byte, length)
+	buf[0] = p.typ<<4 | version
+	binary.BigEndian.PutUint16(buf[2:4], p.connID)
+	binary.BigEndian.PutUint32(buf[4:8], p.timestamp)
+	binary.BigEndian.PutUint32(buf[8:12], p.timestampDiff)
+	binary.BigEndian.PutUint32(buf[12:16], p.wndSize)
+	binary.BigEndian.PutUint16(buf[16:18], p.seqNr)
+	binary.BigEndian.PutUint16(buf[18:20], p.ackNr)
+	offset := headerSize
+	if p.selectiveAck != nil {
+		buf[1] = extSelectiveAck
+		buf[offset+1] = byte(len(p.selectiveAck))
+		copy(buf[offset+2:], p.selectiveAck)
+		offset += 2 + len(p.selectiveAck)
+	}
+	copy(buf[offset:], p.payload)
+	return buf
+}
+
+// parsePacket parses a packet, skipping any extensions other than selective
+// ACK. The payload is copied, so buf can be reused.
+func parsePacket(buf []byte) (*packet, error) {
+	if len(buf) < headerSize {
+		return nil, fmt.Errorf("Packet of length %d is too short", len(buf))
+	}
+	if buf[0]&0x0f != version {
+		return nil, fmt.Errorf("Unknown uTP version %d", buf[0]&0x0f)
+	}
+	p := &packet{
+		typ:           buf[0] >> 4,
+		connID:        binary.BigEndian.Uint16(buf[2:4]),
+		timestamp:     binary.BigEndian.Uint32(buf[4:8]),
+		timestampDiff: binary.BigEndian.Uint32(buf[8:12]),
+		wndSize:       binary.BigEndian.Uint32(buf[12:16]),
+		seqNr:         binary.BigEndian.Uint16(buf[16:18]),
+		ackNr:         binary.BigEndian.Uint16(buf[18:20]),
+	}
+	if p.typ > stSyn {
+		return nil, fmt.Errorf("Unknown packet type %d", p.typ)
+	}
+
+	ext := buf[1]
+	offset := headerSize
+	for ext != 0 {
+		if len(buf) < offset+2 {
+			return nil, fmt.Errorf("Extension header is truncated")
+		}
+		next, length := buf[offset], int(buf[offset+1])
+		offset += 2
+		if len(buf) < offset+length {
+			return nil, fmt.Errorf("Extension of length %d is truncated", length)
+		}
+		if ext == extSelectiveAck {
+			p.selectiveAck = append([]byte{}, buf[offset:offset+length]...)
+		}
+		offset += length
+		ext = next
+	}
+	p.payload = append([]byte{}, buf[offset:]...)
+	return p, nil
+}
+
+// timestamp returns the current time in microseconds, as it is sent in packet
+// headers
+func timestamp() uint32 {
+	return uint32(time.Now().UnixNano() / int64(time.Microsecond))
+}
+
+// seqLess tells if sequence number a comes before b, allowing for wraparound
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
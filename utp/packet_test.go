@@ -0,0 +1,82 @@
+package utp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPacketSerialize(t *testing.T) {
+	p := &packet{
+		typ:           stData,
+		connID:        0x1234,
+		timestamp:     1,
+		timestampDiff: 2,
+		wndSize:       3,
+		seqNr:         4,
+		ackNr:         5,
+		payload:       []byte("hi"),
+	}
+	buf := p.serialize()
+	assert.Equal(t, []byte{
+		0x01, 0x00, 0x12, 0x34,
+		0x00, 0x00, 0x00, 0x01,
+		0x00, 0x00, 0x00, 0x02,
+		0x00, 0x00, 0x00, 0x03,
+		0x00, 0x04, 0x00, 0x05,
+		'h', 'i',
+	}, buf)
+
+	parsed, err := parsePacket(buf)
+	require.Nil(t, err)
+	assert.Equal(t, p, parsed)
+}
+
+func TestParsePacketExtensions(t *testing.T) {
+	buf := []byte{
+		0x21, 0x02, 0x00, 0x07,
+		0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+		0x00, 0x01, 0x00, 0x02,
+		// An unknown extension, then a selective ACK
+		0x01, 0x02, 0xaa, 0xbb,
+		0x00, 0x04, 0x01, 0x00, 0x00, 0x80,
+	}
+	p, err := parsePacket(buf)
+	require.Nil(t, err)
+	assert.Equal(t, stState, p.typ)
+	assert.Equal(t, []byte{0x01, 0x00, 0x00, 0x80}, p.selectiveAck)
+	assert.Equal(t, []byte{}, p.payload)
+}
+
+func TestParsePacketMalformed(t *testing.T) {
+	tests := map[string][]byte{
+		"too short": {0x01, 0x00},
+		"bad version": {
+			0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		},
+		"bad type": {
+			0x51, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		},
+		"truncated extension": {
+			0x01, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x04, 0x00,
+		},
+	}
+	for name, buf := range tests {
+		_, err := parsePacket(buf)
+		assert.NotNil(t, err, name)
+	}
+}
+
+func TestSeqLess(t *testing.T) {
+	assert.True(t, seqLess(1, 2))
+	assert.False(t, seqLess(2, 1))
+	assert.False(t, seqLess(2, 2))
+	assert.True(t, seqLess(0xffff, 0))
+}
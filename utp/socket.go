@@ -0,0 +1,281 @@
+// Package utp implements the Micro Transport Protocol (BEP 29), a reliable,
+// ordered stream over UDP. Its LEDBAT congestion control backs off as soon as
+// it sees queueing delay, so it gives way to other traffic on the link.
+package utp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// maxBacklog is how many accepted connections can wait for Accept before more
+// are turned away
+const maxBacklog = 32
+
+// A Socket carries any number of uTP connections over one UDP socket. It
+// accepts connections from peers and dials connections to them.
+type Socket struct {
+	pc      net.PacketConn
+	backlog chan *Conn
+	// accepting is unset for sockets made just to dial one connection, which
+	// are closed once that connection is done
+	accepting     bool
+	closeWhenIdle bool
+
+	mu        sync.Mutex
+	conns     map[connKey]*Conn
+	closed    bool
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// connKey identifies a connection by the remote address and the ID we
+// receive its packets on
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+// Listen accepts uTP connections on a UDP address
+func Listen(addr string) (*Socket, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewSocket(pc), nil
+}
+
+// NewSocket runs uTP over pc. The Socket takes ownership of pc and closes it
+// when it is closed.
+func NewSocket(pc net.PacketConn) *Socket {
+	return newSocket(pc, true)
+}
+
+func newSocket(pc net.PacketConn, accepting bool) *Socket {
+	s := &Socket{
+		pc:            pc,
+		backlog:       make(chan *Conn, maxBacklog),
+		accepting:     accepting,
+		closeWhenIdle: !accepting,
+		conns:         make(map[connKey]*Conn),
+		done:          make(chan struct{}),
+	}
+	go s.readLoop()
+	return s
+}
+
+// DialContext opens a uTP connection to addr from a socket of its own, which
+// is closed along with the connection
+func DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	pc, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	return DialPacketConn(ctx, pc, addr)
+}
+
+// DialPacketConn opens a uTP connection to addr over pc, for example a UDP
+// relay through a proxy. pc is closed along with the connection.
+func DialPacketConn(ctx context.Context, pc net.PacketConn, addr string) (net.Conn, error) {
+	s := newSocket(pc, false)
+	conn, err := s.DialContext(ctx, addr)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// DialContext opens a uTP connection to addr from this socket
+func (s *Socket) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, errClosed
+	}
+	var id uint16
+	for {
+		id, err = randomID()
+		if err != nil {
+			s.mu.Unlock()
+			return nil, err
+		}
+		if _, ok := s.conns[connKey{raddr.String(), id}]; !ok {
+			break
+		}
+	}
+	c := newConn(s, raddr, id, id+1)
+	s.conns[connKey{raddr.String(), id}] = c
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	c.state = stateSynSent
+	c.seqNr = 1
+	c.send(stSyn, nil)
+	c.mu.Unlock()
+	go c.loop()
+
+	err = c.waitConnected(ctx)
+	if err != nil {
+		c.mu.Lock()
+		c.fail(err)
+		c.mu.Unlock()
+		return nil, err
+	}
+	return c, nil
+}
+
+func randomID() (uint16, error) {
+	var buf [2]byte
+	_, err := rand.Read(buf[:])
+	return binary.BigEndian.Uint16(buf[:]), err
+}
+
+// Accept waits for a peer to connect and returns the connection
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.backlog:
+		return c, nil
+	case <-s.done:
+		return nil, errClosed
+	}
+}
+
+// Addr returns the UDP address the socket is bound to
+func (s *Socket) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+// Close closes the socket and every connection on it
+func (s *Socket) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	return s.pc.Close()
+}
+
+func (s *Socket) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			s.shutdown()
+			return
+		}
+		p, err := parsePacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		s.dispatch(p, addr)
+	}
+}
+
+// shutdown fails every connection once the socket can no longer be read
+func (s *Socket) shutdown() {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.closed = true
+		conns := make([]*Conn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.mu.Unlock()
+
+		for _, c := range conns {
+			c.mu.Lock()
+			c.fail(errClosed)
+			c.mu.Unlock()
+		}
+		close(s.done)
+	})
+}
+
+// dispatch hands a packet to the connection it belongs to. A SYN starts a
+// new connection.
+func (s *Socket) dispatch(p *packet, addr net.Addr) {
+	s.mu.Lock()
+	if p.typ == stSyn {
+		key := connKey{addr.String(), p.connID + 1}
+		c, ok := s.conns[key]
+		if !ok {
+			if !s.accepting || s.closed {
+				s.mu.Unlock()
+				return
+			}
+			if len(s.backlog) == cap(s.backlog) {
+				s.mu.Unlock()
+				s.reset(p, addr)
+				return
+			}
+			c = newConn(s, addr, p.connID+1, p.connID)
+			c.accept(p)
+			s.conns[key] = c
+			s.backlog <- c
+			s.mu.Unlock()
+			go c.loop()
+			return
+		}
+		s.mu.Unlock()
+		c.handle(p)
+		return
+	}
+
+	c, ok := s.conns[connKey{addr.String(), p.connID}]
+	if !ok && p.typ == stReset {
+		// A reset carries the ID the peer sends on, which is one off the ID
+		// we receive on
+		for _, id := range []uint16{p.connID - 1, p.connID + 1} {
+			c, ok = s.conns[connKey{addr.String(), id}]
+			if ok && c.sendID == p.connID {
+				break
+			}
+			ok = false
+		}
+	}
+	s.mu.Unlock()
+	if !ok {
+		if p.typ != stReset {
+			s.reset(p, addr)
+		}
+		return
+	}
+	c.handle(p)
+}
+
+// reset tells the sender of p that we know of no such connection
+func (s *Socket) reset(p *packet, addr net.Addr) {
+	res := packet{
+		typ:       stReset,
+		connID:    p.connID,
+		timestamp: timestamp(),
+		ackNr:     p.seqNr,
+	}
+	s.write(&res, addr)
+}
+
+// remove forgets a connection once it is done
+func (s *Socket) remove(c *Conn) {
+	s.mu.Lock()
+	delete(s.conns, connKey{c.remote.String(), c.recvID})
+	idle := s.closeWhenIdle && len(s.conns) == 0
+	s.mu.Unlock()
+	if idle {
+		s.pc.Close()
+	}
+}
+
+func (s *Socket) write(p *packet, addr net.Addr) error {
+	_, err := s.pc.WriteTo(p.serialize(), addr)
+	return err
+}
+
+var errClosed = fmt.Errorf("uTP connection closed")
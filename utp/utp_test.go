@@ -0,0 +1,258 @@
+package utp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func listen(t *testing.T) *Socket {
+	s, err := Listen("127.0.0.1:0")
+	require.Nil(t, err)
+	return s
+}
+
+// connect returns both ends of a connection between two sockets
+func connect(t *testing.T, a, b *Socket) (net.Conn, net.Conn) {
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := b.Accept()
+		accepted <- conn
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dialed, err := a.DialContext(ctx, b.Addr().String())
+	require.Nil(t, err)
+	return dialed, <-accepted
+}
+
+func randomData(t *testing.T, n int) []byte {
+	data := make([]byte, n)
+	_, err := rand.Read(data)
+	require.Nil(t, err)
+	return data
+}
+
+// exchange sends data each way over the connection at once, and checks it
+// arrives intact
+func exchange(t *testing.T, a, b net.Conn, n int) {
+	ab, ba := randomData(t, n), randomData(t, n)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		a.Write(ab)
+	}()
+	go func() {
+		defer wg.Done()
+		b.Write(ba)
+	}()
+
+	buf := make([]byte, n)
+	_, err := io.ReadFull(b, buf)
+	require.Nil(t, err)
+	assert.True(t, bytes.Equal(ab, buf))
+	_, err = io.ReadFull(a, buf)
+	require.Nil(t, err)
+	assert.True(t, bytes.Equal(ba, buf))
+	wg.Wait()
+}
+
+func TestDialAccept(t *testing.T) {
+	a, b := listen(t), listen(t)
+	defer a.Close()
+	defer b.Close()
+	dialed, accepted := connect(t, a, b)
+	assert.Equal(t, b.Addr().String(), dialed.RemoteAddr().String())
+	assert.Equal(t, a.Addr().String(), accepted.RemoteAddr().String())
+
+	exchange(t, dialed, accepted, 1<<20)
+
+	// A second connection between the same sockets is independent
+	dialed2, accepted2 := connect(t, a, b)
+	exchange(t, dialed2, accepted2, 10000)
+}
+
+func TestDialContext(t *testing.T) {
+	b := listen(t)
+	defer b.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := b.Accept()
+		accepted <- conn
+	}()
+	dialed, err := DialContext(context.Background(), b.Addr().String())
+	require.Nil(t, err)
+	exchange(t, dialed, <-accepted, 10000)
+}
+
+// lossyConn drops every nth packet written
+type lossyConn struct {
+	net.PacketConn
+	n int
+
+	mu      sync.Mutex
+	written int
+}
+
+func (c *lossyConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	c.written++
+	drop := c.written%c.n == 0
+	c.mu.Unlock()
+	if drop {
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func lossySocket(t *testing.T, n int) *Socket {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	return NewSocket(&lossyConn{PacketConn: pc, n: n})
+}
+
+func TestPacketLoss(t *testing.T) {
+	a, b := lossySocket(t, 13), lossySocket(t, 10)
+	defer a.Close()
+	defer b.Close()
+	dialed, accepted := connect(t, a, b)
+	exchange(t, dialed, accepted, 100000)
+}
+
+func TestClose(t *testing.T) {
+	a, b := listen(t), listen(t)
+	defer a.Close()
+	defer b.Close()
+	dialed, accepted := connect(t, a, b)
+
+	dialed.Write([]byte("goodbye"))
+	require.Nil(t, dialed.Close())
+	data, err := ioutil.ReadAll(accepted)
+	require.Nil(t, err)
+	assert.Equal(t, "goodbye", string(data))
+
+	_, err = dialed.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+	_, err = dialed.Write([]byte("more"))
+	assert.NotNil(t, err)
+	accepted.Close()
+}
+
+func TestReset(t *testing.T) {
+	a, b := listen(t), listen(t)
+	defer a.Close()
+	dialed, _ := connect(t, a, b)
+
+	// The other side forgets about the connection, so it answers our next
+	// packet with a reset
+	b.Close()
+	b2, err := NewSocketAt(t, b.Addr().String())
+	require.Nil(t, err)
+	defer b2.Close()
+	dialed.Write([]byte("hello"))
+	_, err = dialed.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+}
+
+// NewSocketAt listens on an address that was just freed
+func NewSocketAt(t *testing.T, addr string) (*Socket, error) {
+	var err error
+	for i := 0; i < 10; i++ {
+		var s *Socket
+		s, err = Listen(addr)
+		if err == nil {
+			return s, nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil, err
+}
+
+func TestReadDeadline(t *testing.T) {
+	a, b := listen(t), listen(t)
+	defer a.Close()
+	defer b.Close()
+	dialed, _ := connect(t, a, b)
+
+	dialed.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := dialed.Read(make([]byte, 1))
+	require.NotNil(t, err)
+	netErr, ok := err.(net.Error)
+	require.True(t, ok)
+	assert.True(t, netErr.Timeout())
+}
+
+func TestDialUnresponsive(t *testing.T) {
+	a := listen(t)
+	defer a.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer pc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = a.DialContext(ctx, pc.LocalAddr().String())
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestCloseSocket(t *testing.T) {
+	a, b := listen(t), listen(t)
+	defer b.Close()
+	dialed, _ := connect(t, a, b)
+	a.Close()
+	_, err := dialed.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+	_, err = a.Accept()
+	assert.NotNil(t, err)
+}
+
+func TestLEDBAT(t *testing.T) {
+	c := newConn(nil, nil, 0, 0)
+	start := c.window
+
+	// No queueing delay grows the window
+	base := uint32(1000000)
+	for i := 0; i < 10; i++ {
+		c.updateWindow(base, maxPayload)
+	}
+	assert.True(t, c.window > start)
+
+	// Delay well over the target shrinks it
+	grown := c.window
+	delay := base + uint32(3*targetDelay/time.Microsecond)
+	for i := 0; i < 10; i++ {
+		c.updateWindow(delay, maxPayload)
+	}
+	assert.True(t, c.window < grown)
+
+	// It never gets smaller than a packet
+	for i := 0; i < 1000; i++ {
+		c.updateWindow(delay, maxPayload)
+	}
+	assert.Equal(t, minWindow, c.window)
+}
+
+func TestDelayHistory(t *testing.T) {
+	var h delayHistory
+	now := time.Now()
+	h.add(500, now)
+	h.add(300, now.Add(time.Second))
+	h.add(400, now.Add(2*time.Second))
+	assert.Equal(t, uint32(300), h.base())
+
+	// The lowest delay is forgotten after two intervals
+	h.add(600, now.Add(baseDelayInterval+2*time.Second))
+	assert.Equal(t, uint32(300), h.base())
+	h.add(700, now.Add(2*baseDelayInterval+3*time.Second))
+	assert.Equal(t, uint32(600), h.base())
+}